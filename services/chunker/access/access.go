@@ -0,0 +1,105 @@
+package access
+
+import (
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// who may see a track: private ones only their owner and the users that
+// uploaded the same file, unlisted ones anybody logged in who has the id,
+// public ones anybody logged in and they show up in listings. tracks from
+// before visibility existed have an empty value and count as private.
+// superusers see everything
+
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+
+	// users need this role to upload
+	RoleUploader = "uploader"
+)
+
+var (
+	Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+	Roles        = []string{RoleUploader}
+)
+
+func IsVisibility(v string) bool {
+	return slices.Contains(Visibilities, v)
+}
+
+// IsOwner reports whether auth owns the track or uploaded the same file
+func IsOwner(auth *core.Record, track *core.Record) bool {
+	if auth == nil {
+		return false
+	}
+	return track.GetString("owner") == auth.Id || slices.Contains(track.GetStringSlice("uploaders"), auth.Id)
+}
+
+func CanListen(auth *core.Record, track *core.Record) bool {
+	if auth == nil {
+		return false
+	}
+	if auth.IsSuperuser() || IsOwner(auth, track) {
+		return true
+	}
+	switch track.GetString("visibility") {
+	case VisibilityPublic, VisibilityUnlisted:
+		return true
+	default:
+		return false
+	}
+}
+
+func CanUpload(auth *core.Record) bool {
+	if auth == nil {
+		return false
+	}
+	return auth.IsSuperuser() || slices.Contains(auth.GetStringSlice("roles"), RoleUploader)
+}
+
+// ListFilter limits a query over UploadedFiles to the tracks auth gets to
+// see in listings, unlisted tracks are left out unless auth owns them
+func ListFilter(auth *core.Record) dbx.Expression {
+	return FileFilter(auth, "")
+}
+
+// FileFilter is ListFilter for queries that join UploadedFiles under alias
+func FileFilter(auth *core.Record, alias string) dbx.Expression {
+	if auth.IsSuperuser() {
+		return dbx.NewExp("1=1")
+	}
+	column := func(name string) string {
+		if alias == "" {
+			return name
+		}
+		return alias + "." + name
+	}
+	return dbx.Or(
+		dbx.HashExp{column("visibility"): VisibilityPublic},
+		dbx.HashExp{column("owner"): auth.Id},
+		dbx.NewExp("EXISTS (SELECT 1 FROM json_each([["+column("uploaders")+"]]) WHERE json_each.value = {:listUser})", dbx.Params{"listUser": auth.Id}),
+	)
+}
+
+// ListenFilter is CanListen for queries that join UploadedFiles under
+// alias, unlike FileFilter it keeps unlisted tracks
+func ListenFilter(auth *core.Record, alias string) dbx.Expression {
+	column := "visibility"
+	if alias != "" {
+		column = alias + "." + column
+	}
+	return dbx.Or(dbx.HashExp{column: VisibilityUnlisted}, FileFilter(auth, alias))
+}
+
+// RequireUploader rejects requests from users without the uploader role,
+// it expects the request to be authenticated already
+func RequireUploader(e *core.RequestEvent) error {
+	if !CanUpload(e.Auth) {
+		return e.String(403, "Forbidden")
+	}
+	return e.Next()
+}
@@ -0,0 +1,315 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	flacBlockStreamInfo = 0
+	flacMaxProbeWindow  = 1 << 20
+)
+
+type flacStreamInfo struct {
+	minBlockSize  int
+	maxBlockSize  int
+	maxFrameSize  int
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  int64
+}
+
+// probeFLAC expects the "fLaC" marker at offset
+func probeFLAC(src *source, offset int64) (*Info, error) {
+	pos := offset + 4
+	var si *flacStreamInfo
+
+	for {
+		hdr := make([]byte, 4)
+		if err := src.readFull(hdr, pos); err != nil {
+			return nil, fmt.Errorf("flac metadata: %w", err)
+		}
+		last := hdr[0]&0x80 != 0
+		blockType := hdr[0] & 0x7f
+		length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		pos += 4
+
+		if blockType == 127 {
+			return nil, errors.New("flac metadata: invalid block type")
+		}
+		if pos+length > src.size {
+			return nil, errors.New("flac metadata: block runs past end of file")
+		}
+
+		if blockType == flacBlockStreamInfo {
+			if length != 34 {
+				return nil, errors.New("flac metadata: bad STREAMINFO length")
+			}
+			body := make([]byte, 34)
+			if err := src.readFull(body, pos); err != nil {
+				return nil, err
+			}
+			si = parseFLACStreamInfo(body)
+		} else if si == nil {
+			return nil, errors.New("flac metadata: STREAMINFO is not the first block")
+		}
+
+		pos += length
+		if last {
+			break
+		}
+	}
+
+	if si == nil {
+		return nil, errors.New("flac metadata: missing STREAMINFO")
+	}
+	if si.sampleRate == 0 || si.minBlockSize < 16 || si.maxBlockSize < si.minBlockSize {
+		return nil, errors.New("flac metadata: invalid STREAMINFO")
+	}
+
+	if err := checkFLACFrames(src, pos, si); err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Format:        FormatFLAC,
+		Codec:         "flac",
+		MimeType:      "audio/flac",
+		SampleRate:    si.sampleRate,
+		Channels:      si.channels,
+		BitsPerSample: si.bitsPerSample,
+		TotalSamples:  si.totalSamples,
+		AudioOffset:   pos,
+	}
+	if si.minBlockSize == si.maxBlockSize {
+		info.BlockSize = si.minBlockSize
+	}
+	if si.totalSamples > 0 {
+		info.Duration = float64(si.totalSamples) / float64(si.sampleRate)
+	}
+	return info, nil
+}
+
+func parseFLACStreamInfo(b []byte) *flacStreamInfo {
+	packed := binary.BigEndian.Uint64(b[10:18])
+	return &flacStreamInfo{
+		minBlockSize:  int(binary.BigEndian.Uint16(b[0:2])),
+		maxBlockSize:  int(binary.BigEndian.Uint16(b[2:4])),
+		maxFrameSize:  int(b[7])<<16 | int(b[8])<<8 | int(b[9]),
+		sampleRate:    int(packed >> 44),
+		channels:      int(packed>>41&0x7) + 1,
+		bitsPerSample: int(packed>>36&0x1f) + 1,
+		totalSamples:  int64(packed & 0xfffffffff),
+	}
+}
+
+// checkFLACFrames makes sure the stream starts with a valid frame 0 and
+// that its CRC-16 footer matches, which proves the first frame decodes
+// byte for byte without having to run the subframe decoder.
+func checkFLACFrames(src *source, pos int64, si *flacStreamInfo) error {
+	window := int64(flacMaxProbeWindow)
+	if si.maxFrameSize > 0 {
+		window = int64(si.maxFrameSize)*2 + 64
+	}
+	atEOF := false
+	if pos+window >= src.size {
+		window = src.size - pos
+		atEOF = true
+	}
+	if window < 6 {
+		return errors.New("flac: no audio frames")
+	}
+
+	buf := make([]byte, window)
+	if err := src.readFull(buf, pos); err != nil {
+		return fmt.Errorf("flac: %w", err)
+	}
+
+	first, ok := parseFLACFrameHeader(buf)
+	if !ok {
+		return errors.New("flac: first frame header is invalid")
+	}
+	if first.number != 0 {
+		return errors.New("flac: stream does not start at frame 0")
+	}
+
+	wantNext := uint64(1)
+	if first.variable {
+		wantNext = uint64(first.blockSize)
+	}
+
+	for i := first.length + 2; i < len(buf)-1; i++ {
+		if buf[i] != 0xff || buf[i+1]&0xfe != 0xf8 {
+			continue
+		}
+		next, ok := parseFLACFrameHeader(buf[i:])
+		if !ok || next.number != wantNext || next.variable != first.variable {
+			continue
+		}
+		if crc16(buf[:i-2]) == binary.BigEndian.Uint16(buf[i-2:i]) {
+			return nil
+		}
+	}
+
+	// a stream made of a single frame ends at EOF
+	if atEOF && crc16(buf[:len(buf)-2]) == binary.BigEndian.Uint16(buf[len(buf)-2:]) {
+		return nil
+	}
+	return errors.New("flac: first frame failed CRC check")
+}
+
+type flacFrameHeader struct {
+	variable   bool
+	number     uint64 // frame number, or sample number when variable
+	blockSize  int
+	sampleRate int
+	channels   int
+	length     int
+}
+
+func parseFLACFrameHeader(b []byte) (flacFrameHeader, bool) {
+	var h flacFrameHeader
+	if len(b) < 6 || b[0] != 0xff || b[1]&0xfe != 0xf8 {
+		return h, false
+	}
+	h.variable = b[1]&0x01 != 0
+
+	bsCode := b[2] >> 4
+	srCode := b[2] & 0x0f
+	chCode := b[3] >> 4
+	ssCode := (b[3] >> 1) & 0x07
+	if bsCode == 0 || srCode == 15 || chCode > 10 || ssCode == 3 || b[3]&0x01 != 0 {
+		return h, false
+	}
+
+	num, n, ok := readFLACUTF8(b[4:])
+	if !ok {
+		return h, false
+	}
+	h.number = num
+	pos := 4 + n
+
+	switch {
+	case bsCode == 1:
+		h.blockSize = 192
+	case bsCode <= 5:
+		h.blockSize = 576 << (bsCode - 2)
+	case bsCode == 6:
+		if pos >= len(b) {
+			return h, false
+		}
+		h.blockSize = int(b[pos]) + 1
+		pos++
+	case bsCode == 7:
+		if pos+1 >= len(b) {
+			return h, false
+		}
+		h.blockSize = int(binary.BigEndian.Uint16(b[pos:])) + 1
+		pos += 2
+	default:
+		h.blockSize = 256 << (bsCode - 8)
+	}
+
+	rates := [...]int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+	switch {
+	case srCode < 12:
+		h.sampleRate = rates[srCode]
+	case srCode == 12:
+		if pos >= len(b) {
+			return h, false
+		}
+		h.sampleRate = int(b[pos]) * 1000
+		pos++
+	default:
+		if pos+1 >= len(b) {
+			return h, false
+		}
+		h.sampleRate = int(binary.BigEndian.Uint16(b[pos:]))
+		if srCode == 14 {
+			h.sampleRate *= 10
+		}
+		pos += 2
+	}
+
+	if chCode < 8 {
+		h.channels = int(chCode) + 1
+	} else {
+		h.channels = 2
+	}
+
+	if pos >= len(b) || crc8(b[:pos]) != b[pos] {
+		return h, false
+	}
+	h.length = pos + 1
+	return h, true
+}
+
+// readFLACUTF8 decodes the "UTF-8 like" coded frame/sample number
+func readFLACUTF8(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	lead := b[0]
+	var n int
+	var v uint64
+	switch {
+	case lead&0x80 == 0:
+		return uint64(lead), 1, true
+	case lead&0xe0 == 0xc0:
+		n, v = 2, uint64(lead&0x1f)
+	case lead&0xf0 == 0xe0:
+		n, v = 3, uint64(lead&0x0f)
+	case lead&0xf8 == 0xf0:
+		n, v = 4, uint64(lead&0x07)
+	case lead&0xfc == 0xf8:
+		n, v = 5, uint64(lead&0x03)
+	case lead&0xfe == 0xfc:
+		n, v = 6, uint64(lead&0x01)
+	case lead == 0xfe:
+		n, v = 7, 0
+	default:
+		return 0, 0, false
+	}
+	if len(b) < n {
+		return 0, 0, false
+	}
+	for _, c := range b[1:n] {
+		if c&0xc0 != 0x80 {
+			return 0, 0, false
+		}
+		v = v<<6 | uint64(c&0x3f)
+	}
+	return v, n, true
+}
+
+func crc8(b []byte) byte {
+	var crc byte
+	for _, c := range b {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,189 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	mp3SyncSearch    = 64 << 10
+	mp3FramesToCheck = 3
+)
+
+var mp3Bitrates = [2][3][15]int{
+	{ // MPEG-1, layers I, II, III
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{ // MPEG-2 and 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mp3SampleRates = map[byte][3]int{
+	3: {44100, 48000, 32000}, // MPEG-1
+	2: {22050, 24000, 16000}, // MPEG-2
+	0: {11025, 12000, 8000},  // MPEG-2.5
+}
+
+type mp3FrameHeader struct {
+	version         byte // raw version bits
+	layer           int  // 1, 2 or 3
+	bitrate         int  // kbps
+	sampleRate      int
+	channels        int
+	samplesPerFrame int
+	length          int
+}
+
+func parseMP3FrameHeader(b []byte) (mp3FrameHeader, bool) {
+	var h mp3FrameHeader
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	h.version = (b[1] >> 3) & 0x03
+	layerBits := (b[1] >> 1) & 0x03
+	brIndex := b[2] >> 4
+	srIndex := (b[2] >> 2) & 0x03
+	padding := int(b[2]>>1) & 0x01
+	if h.version == 1 || layerBits == 0 || brIndex == 0 || brIndex == 15 || srIndex == 3 {
+		return h, false
+	}
+
+	h.layer = int(4 - layerBits)
+	table := 0
+	if h.version != 3 {
+		table = 1
+	}
+	h.bitrate = mp3Bitrates[table][h.layer-1][brIndex]
+	h.sampleRate = mp3SampleRates[h.version][srIndex]
+	h.channels = 2
+	if b[3]>>6 == 3 {
+		h.channels = 1
+	}
+
+	switch {
+	case h.layer == 1:
+		h.samplesPerFrame = 384
+		h.length = (12*h.bitrate*1000/h.sampleRate + padding) * 4
+	case h.layer == 3 && h.version != 3:
+		h.samplesPerFrame = 576
+		h.length = 72*h.bitrate*1000/h.sampleRate + padding
+	default:
+		h.samplesPerFrame = 1152
+		h.length = 144*h.bitrate*1000/h.sampleRate + padding
+	}
+	return h, h.length > 4
+}
+
+func probeMP3(src *source, offset int64) (*Info, error) {
+	window := int64(mp3SyncSearch)
+	if offset+window > src.size {
+		window = src.size - offset
+	}
+	if window < 4 {
+		return nil, ErrUnknownFormat
+	}
+	buf := make([]byte, window)
+	if err := src.readFull(buf, offset); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+4 <= len(buf); i++ {
+		first, ok := parseMP3FrameHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		if !checkMP3Frames(src, offset+int64(i), first) {
+			continue
+		}
+
+		audioOffset := offset + int64(i)
+		info := &Info{
+			Format:      FormatMP3,
+			Codec:       "mp3",
+			MimeType:    "audio/mpeg",
+			SampleRate:  first.sampleRate,
+			Channels:    first.channels,
+			AudioOffset: audioOffset,
+		}
+
+		if frames := readXingFrames(src, audioOffset, first); frames > 0 {
+			info.TotalSamples = frames * int64(first.samplesPerFrame)
+			info.Duration = float64(info.TotalSamples) / float64(first.sampleRate)
+		} else {
+			audioBytes := src.size - audioOffset
+			if hasID3v1(src) {
+				audioBytes -= 128
+			}
+			info.Bitrate = first.bitrate * 1000
+			info.Duration = float64(audioBytes) * 8 / float64(info.Bitrate)
+			info.TotalSamples = int64(info.Duration * float64(first.sampleRate))
+		}
+		return info, nil
+	}
+
+	if offset > 0 {
+		return nil, errors.New("mp3: no valid frames after ID3 tag")
+	}
+	return nil, ErrUnknownFormat
+}
+
+// checkMP3Frames walks a few frames forward, a real stream has
+// consecutive headers that agree with each other
+func checkMP3Frames(src *source, pos int64, first mp3FrameHeader) bool {
+	hdr := make([]byte, 4)
+	cur := first
+	for i := 1; i < mp3FramesToCheck; i++ {
+		pos += int64(cur.length)
+		if pos == src.size || (pos+128 == src.size && hasID3v1(src)) {
+			return true
+		}
+		if err := src.readFull(hdr, pos); err != nil {
+			return false
+		}
+		next, ok := parseMP3FrameHeader(hdr)
+		if !ok || next.version != first.version || next.layer != first.layer || next.sampleRate != first.sampleRate {
+			return false
+		}
+		cur = next
+	}
+	return true
+}
+
+func readXingFrames(src *source, pos int64, h mp3FrameHeader) int64 {
+	sideInfo := 32
+	switch {
+	case h.version == 3 && h.channels == 1:
+		sideInfo = 17
+	case h.version != 3 && h.channels == 2:
+		sideInfo = 17
+	case h.version != 3:
+		sideInfo = 9
+	}
+	tag := make([]byte, 12)
+	if err := src.readFull(tag, pos+4+int64(sideInfo)); err != nil {
+		return 0
+	}
+	if string(tag[:4]) != "Xing" && string(tag[:4]) != "Info" {
+		return 0
+	}
+	if binary.BigEndian.Uint32(tag[4:8])&0x01 == 0 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(tag[8:12]))
+}
+
+func hasID3v1(src *source) bool {
+	if src.size < 128 {
+		return false
+	}
+	tag := make([]byte, 3)
+	if err := src.readFull(tag, src.size-128); err != nil {
+		return false
+	}
+	return string(tag) == "TAG"
+}
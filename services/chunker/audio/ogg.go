@@ -0,0 +1,151 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	oggHeaderSize = 27
+	oggTailSearch = 64 << 10
+)
+
+type oggPage struct {
+	granule int64
+	serial  uint32
+	body    []byte
+	length  int64 // header + segment table + body
+}
+
+func readOggPage(src *source, pos int64) (*oggPage, error) {
+	hdr := make([]byte, oggHeaderSize)
+	if err := src.readFull(hdr, pos); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "OggS" || hdr[4] != 0 {
+		return nil, errors.New("ogg: bad page header")
+	}
+	segments := make([]byte, hdr[26])
+	if err := src.readFull(segments, pos+oggHeaderSize); err != nil {
+		return nil, err
+	}
+	bodyLen := 0
+	for _, s := range segments {
+		bodyLen += int(s)
+	}
+	body := make([]byte, bodyLen)
+	if err := src.readFull(body, pos+oggHeaderSize+int64(len(segments))); err != nil {
+		return nil, err
+	}
+
+	want := binary.LittleEndian.Uint32(hdr[22:26])
+	copy(hdr[22:26], []byte{0, 0, 0, 0})
+	crc := oggCRC(0, hdr)
+	crc = oggCRC(crc, segments)
+	crc = oggCRC(crc, body)
+	if crc != want {
+		return nil, errors.New("ogg: page CRC mismatch")
+	}
+
+	return &oggPage{
+		granule: int64(binary.LittleEndian.Uint64(hdr[6:14])),
+		serial:  binary.LittleEndian.Uint32(hdr[14:18]),
+		body:    body,
+		length:  oggHeaderSize + int64(len(segments)) + int64(bodyLen),
+	}, nil
+}
+
+func probeOgg(src *source) (*Info, error) {
+	first, err := readOggPage(src, 0)
+	if err != nil {
+		return nil, err
+	}
+	// the second page carries the comment/setup headers, it has to be
+	// intact too before we call the stream decodable
+	second, err := readOggPage(src, first.length)
+	if err != nil {
+		return nil, err
+	}
+	if second.serial != first.serial {
+		return nil, errors.New("ogg: multiplexed streams are not supported")
+	}
+
+	info := &Info{Format: FormatOgg, MimeType: "audio/ogg", AudioOffset: 0}
+	id := first.body
+	var preSkip int64
+
+	switch {
+	case len(id) >= 30 && bytes.HasPrefix(id, []byte("\x01vorbis")):
+		info.Codec = "vorbis"
+		info.Channels = int(id[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		info.Bitrate = int(int32(binary.LittleEndian.Uint32(id[20:24])))
+	case len(id) >= 19 && bytes.HasPrefix(id, []byte("OpusHead")):
+		info.Codec = "opus"
+		info.Channels = int(id[9])
+		info.SampleRate = 48000 // opus always decodes at 48kHz
+		preSkip = int64(binary.LittleEndian.Uint16(id[10:12]))
+	case len(id) >= 51 && bytes.HasPrefix(id, []byte("\x7fFLAC")) && string(id[9:13]) == "fLaC":
+		si := parseFLACStreamInfo(id[17:51])
+		info.Codec = "flac"
+		info.Channels = si.channels
+		info.SampleRate = si.sampleRate
+		info.BitsPerSample = si.bitsPerSample
+	default:
+		return nil, errors.New("ogg: unsupported codec")
+	}
+	if info.Channels == 0 || info.SampleRate == 0 {
+		return nil, errors.New("ogg: invalid identification header")
+	}
+	if info.Bitrate < 0 {
+		info.Bitrate = 0
+	}
+
+	if granule := lastOggGranule(src, first.serial); granule > preSkip {
+		info.TotalSamples = granule - preSkip
+		info.Duration = float64(info.TotalSamples) / float64(info.SampleRate)
+	}
+	return info, nil
+}
+
+func lastOggGranule(src *source, serial uint32) int64 {
+	start := src.size - oggTailSearch
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, src.size-start)
+	if err := src.readFull(tail, start); err != nil {
+		return 0
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		page, err := readOggPage(src, start+int64(i))
+		if err == nil && page.serial == serial && page.granule >= 0 {
+			return page.granule
+		}
+	}
+	return 0
+}
+
+var oggCRCTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(crc uint32, b []byte) uint32 {
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
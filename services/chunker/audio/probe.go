@@ -0,0 +1,142 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// the probe reads just enough of a file to tell what it is and whether the
+// first frames decode, it does not decode the whole stream
+
+type Format string
+
+const (
+	FormatFLAC Format = "flac"
+	FormatMP3  Format = "mp3"
+	FormatWAV  Format = "wav"
+	FormatOgg  Format = "ogg"
+)
+
+var ErrUnknownFormat = errors.New("unrecognised audio format")
+
+type Info struct {
+	Format        Format  `json:"format"`
+	Codec         string  `json:"codec"`
+	MimeType      string  `json:"mime_type"`
+	SampleRate    int     `json:"sample_rate"`
+	Channels      int     `json:"channels"`
+	BitsPerSample int     `json:"bits_per_sample,omitempty"`
+	TotalSamples  int64   `json:"total_samples,omitempty"`
+	BlockSize     int     `json:"block_size,omitempty"` // fixed flac block size
+	Duration      float64 `json:"duration"`
+	Bitrate       int     `json:"bitrate,omitempty"`
+	AudioOffset   int64   `json:"audio_offset"`
+	Size          int64   `json:"size"`
+	Tags          *Tags   `json:"tags,omitempty"`
+}
+
+// Extension returns the file extension (with the dot) used when storing
+// a file of this format.
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+func Probe(r io.ReadSeeker) (*Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("error seeking: %w", err)
+	}
+	src := &source{rs: r, size: size}
+
+	head := make([]byte, 12)
+	n, _ := src.ReadAt(head, 0)
+	head = head[:n]
+	if len(head) < 4 {
+		return nil, ErrUnknownFormat
+	}
+
+	var info *Info
+	switch {
+	case string(head[:4]) == "fLaC":
+		info, err = probeFLAC(src, 0)
+	case string(head[:4]) == "OggS":
+		info, err = probeOgg(src)
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		info, err = probeWAV(src)
+	default:
+		// id3v2 tags can sit in front of both flac and mp3 streams
+		offset, terr := skipID3v2(src, 0)
+		if terr != nil {
+			return nil, terr
+		}
+		magic := make([]byte, 4)
+		if _, merr := src.ReadAt(magic, offset); merr == nil && string(magic) == "fLaC" {
+			info, err = probeFLAC(src, offset)
+		} else {
+			info, err = probeMP3(src, offset)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.Size = size
+	if info.Duration > 0 && info.Bitrate == 0 {
+		info.Bitrate = int(float64(size-info.AudioOffset) * 8 / info.Duration)
+	}
+	// broken tags don't make the audio invalid, the file just goes without
+	if tags, err := ReadTags(r); err == nil {
+		info.Tags = tags
+	}
+	return info, nil
+}
+
+// source gives the format parsers random access over the io.ReadSeeker
+type source struct {
+	rs   io.ReadSeeker
+	size int64
+}
+
+func (s *source) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
+
+// readFull is ReadAt that treats a short read as corrupt input
+func (s *source) readFull(p []byte, off int64) error {
+	n, err := s.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("unexpected end of file at offset %d", off+int64(n))
+	}
+	return err
+}
+
+func skipID3v2(src *source, offset int64) (int64, error) {
+	hdr := make([]byte, 10)
+	if n, _ := src.ReadAt(hdr, offset); n < 10 || string(hdr[:3]) != "ID3" {
+		return offset, nil
+	}
+	for _, b := range hdr[6:10] {
+		if b&0x80 != 0 {
+			return 0, errors.New("invalid ID3v2 tag size")
+		}
+	}
+	size := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	end := offset + 10 + size
+	if hdr[5]&0x10 != 0 {
+		end += 10 // footer present
+	}
+	if end > src.size {
+		return 0, errors.New("ID3v2 tag runs past end of file")
+	}
+	return end, nil
+}
@@ -0,0 +1,347 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// the test files are built byte by byte, just enough of each format for
+// the probe to accept it
+
+func wavFile(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	b := append([]byte("RIFF"), le32(uint32(len(body)))...)
+	return append(b, body...)
+}
+
+// riffChunk pads odd sized bodies like a well formed file does
+func riffChunk(id string, body []byte) []byte {
+	b := append([]byte(id), le32(uint32(len(body)))...)
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func wavFmt(format uint16, channels, rate, bits int) []byte {
+	blockAlign := channels * bits / 8
+	b := le16(format)
+	b = append(b, le16(uint16(channels))...)
+	b = append(b, le32(uint32(rate))...)
+	b = append(b, le32(uint32(rate*blockAlign))...)
+	b = append(b, le16(uint16(blockAlign))...)
+	b = append(b, le16(uint16(bits))...)
+	return riffChunk("fmt ", b)
+}
+
+func flacStreamInfoBlock(last bool, blockSize, rate, channels, bits int, total int64) []byte {
+	b := flacBlockHeader(last, flacBlockStreamInfo, 34)
+	b = append(b, be16(uint16(blockSize))...)
+	b = append(b, be16(uint16(blockSize))...)
+	b = append(b, 0, 0, 0, 0, 0, 0) // frame sizes unknown
+	packed := uint64(rate)<<44 | uint64(channels-1)<<41 | uint64(bits-1)<<36 | uint64(total)
+	b = binary.BigEndian.AppendUint64(b, packed)
+	return append(b, make([]byte, 16)...) // md5
+}
+
+func flacBlockHeader(last bool, kind byte, length int) []byte {
+	if last {
+		kind |= 0x80
+	}
+	return []byte{kind, byte(length >> 16), byte(length >> 8), byte(length)}
+}
+
+// flacFrame is a fixed 4096 sample, 44.1kHz, 16 bit stereo frame whose
+// header and footer checksums are right, the subframes are filler
+func flacFrame(number byte) []byte {
+	b := []byte{0xff, 0xf8, 0xc9, 0x18, number}
+	b = append(b, crc8(b))
+	b = append(b, bytes.Repeat([]byte{0x55}, 100)...)
+	return append(b, be16(crc16(b))...)
+}
+
+// flacFile puts extra metadata blocks after STREAMINFO, they have to have
+// the last block flag set right
+func flacFile(frames int, extra ...[]byte) []byte {
+	b := []byte("fLaC")
+	b = append(b, flacStreamInfoBlock(len(extra) == 0, 4096, 44100, 2, 16, int64(frames)*4096)...)
+	for _, block := range extra {
+		b = append(b, block...)
+	}
+	for i := 0; i < frames; i++ {
+		b = append(b, flacFrame(byte(i))...)
+	}
+	return b
+}
+
+// mp3Frames are mpeg-1 layer III frames at 128kbps and 44.1kHz
+func mp3Frames(n int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+	return bytes.Repeat(frame, n)
+}
+
+func oggPageBytes(serial uint32, seq uint32, granule int64, flags byte, body []byte) []byte {
+	var segments []byte
+	for n := len(body); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+	hdr := []byte("OggS")
+	hdr = append(hdr, 0, flags)
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(granule))
+	hdr = append(hdr, le32(serial)...)
+	hdr = append(hdr, le32(seq)...)
+	hdr = append(hdr, 0, 0, 0, 0)
+	hdr = append(hdr, byte(len(segments)))
+
+	crc := oggCRC(0, hdr)
+	crc = oggCRC(crc, segments)
+	crc = oggCRC(crc, body)
+	binary.LittleEndian.PutUint32(hdr[22:26], crc)
+
+	page := append(hdr, segments...)
+	return append(page, body...)
+}
+
+func vorbisIdent(channels, rate, bitrate int) []byte {
+	b := []byte("\x01vorbis")
+	b = append(b, 0, 0, 0, 0, byte(channels))
+	b = append(b, le32(uint32(rate))...)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, le32(uint32(bitrate))...)
+	b = append(b, 0, 0, 0, 0)
+	return append(b, 0xb8, 0x01)
+}
+
+func vorbisComments(comments ...string) []byte {
+	b := append(le32(6), "tester"...)
+	b = append(b, le32(uint32(len(comments)))...)
+	for _, c := range comments {
+		b = append(b, le32(uint32(len(c)))...)
+		b = append(b, c...)
+	}
+	return b
+}
+
+func oggFile(ident, comment []byte, granule int64) []byte {
+	b := oggPageBytes(7, 0, 0, 0x02, ident)
+	b = append(b, oggPageBytes(7, 1, 0, 0, comment)...)
+	return append(b, oggPageBytes(7, 2, granule, 0x04, bytes.Repeat([]byte{1}, 50))...)
+}
+
+func id3v2(version byte, frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	size := len(body)
+	hdr := []byte{'I', 'D', '3', version, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(hdr, body...)
+}
+
+// id3Frame builds a 2.3 or 2.4 frame, text is latin-1 unless it starts
+// with an encoding byte of its own
+func id3Frame(version byte, id string, data []byte) []byte {
+	b := []byte(id)
+	if version == 4 {
+		n := len(data)
+		b = append(b, byte(n>>21&0x7f), byte(n>>14&0x7f), byte(n>>7&0x7f), byte(n&0x7f))
+	} else {
+		b = append(b, be32(uint32(len(data)))...)
+	}
+	b = append(b, 0, 0)
+	return append(b, data...)
+}
+
+func le16(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func TestProbe(t *testing.T) {
+	wav := wavFile(wavFmt(wavFormatPCM, 2, 44100, 16), riffChunk("data", make([]byte, 44100*4)))
+	mp3 := mp3Frames(10)
+	mp3Duration := float64(len(mp3)) * 8 / 128000
+	mp3Samples := int64(mp3Duration * 44100)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		format       Format
+		codec        string
+		rate         int
+		channels     int
+		totalSamples int64
+		duration     float64
+		audioOffset  int64
+	}{
+		{"wav", wav, FormatWAV, "pcm", 44100, 2, 44100, 1, 44},
+		{"wav with a list chunk first", wavFile(
+			wavFmt(wavFormatPCM, 1, 8000, 8),
+			riffChunk("LIST", []byte("INFOodd")),
+			riffChunk("data", make([]byte, 8000)),
+		), FormatWAV, "pcm", 8000, 1, 8000, 1, 60},
+		{"flac", flacFile(3), FormatFLAC, "flac", 44100, 2, 3 * 4096, 3 * 4096.0 / 44100, 42},
+		{"flac single frame", flacFile(1), FormatFLAC, "flac", 44100, 2, 4096, 4096.0 / 44100, 42},
+		{"flac behind id3", append(id3v2(3, id3Frame(3, "TIT2", []byte("\x00x"))), flacFile(2)...),
+			FormatFLAC, "flac", 44100, 2, 2 * 4096, 2 * 4096.0 / 44100, 10 + 12 + 42},
+		{"flac with padding block", flacFile(2, append(flacBlockHeader(true, 1, 10), make([]byte, 10)...)),
+			FormatFLAC, "flac", 44100, 2, 2 * 4096, 2 * 4096.0 / 44100, 42 + 14},
+		{"mp3", mp3, FormatMP3, "mp3", 44100, 2, mp3Samples, mp3Duration, 0},
+		{"mp3 after garbage", append([]byte{1, 2, 3}, mp3...), FormatMP3, "mp3", 44100, 2, mp3Samples, mp3Duration, 3},
+		{"mp3 behind id3", append(id3v2(4, id3Frame(4, "TIT2", []byte("\x03x"))), mp3...),
+			FormatMP3, "mp3", 44100, 2, mp3Samples, mp3Duration, 10 + 12},
+		{"mp3 with id3v1", append(mp3Frames(10), append([]byte("TAG"), make([]byte, 125)...)...),
+			FormatMP3, "mp3", 44100, 2, mp3Samples, mp3Duration, 0},
+		{"ogg vorbis", oggFile(vorbisIdent(2, 44100, 128000), append([]byte("\x03vorbis"), vorbisComments()...), 88200),
+			FormatOgg, "vorbis", 44100, 2, 88200, 2, 0},
+		{"ogg opus", oggFile(append([]byte("OpusHead\x01\x02"), append(le16(312), make([]byte, 7)...)...), []byte("OpusTags"), 48000+312),
+			FormatOgg, "opus", 48000, 2, 48000, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Probe(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+			if info.Format != tt.format || info.Codec != tt.codec {
+				t.Errorf("format %s/%s, want %s/%s", info.Format, info.Codec, tt.format, tt.codec)
+			}
+			if info.SampleRate != tt.rate || info.Channels != tt.channels {
+				t.Errorf("%d Hz %d channels, want %d Hz %d channels", info.SampleRate, info.Channels, tt.rate, tt.channels)
+			}
+			if info.TotalSamples != tt.totalSamples {
+				t.Errorf("total samples %d, want %d", info.TotalSamples, tt.totalSamples)
+			}
+			if math.Abs(info.Duration-tt.duration) > 1e-3 {
+				t.Errorf("duration %f, want %f", info.Duration, tt.duration)
+			}
+			if info.AudioOffset != tt.audioOffset {
+				t.Errorf("audio offset %d, want %d", info.AudioOffset, tt.audioOffset)
+			}
+			if info.Size != int64(len(tt.data)) {
+				t.Errorf("size %d, want %d", info.Size, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestProbeRejects(t *testing.T) {
+	badCRC := flacFile(2)
+	badCRC[len(badCRC)-1] ^= 0xff
+	// the next frame's crc then breaks as well, the first frame has to
+	// fail on its own
+	badFirst := flacFile(2)
+	badFirst[42+20] ^= 0xff
+
+	badPage := oggFile(vorbisIdent(2, 44100, 0), []byte("\x03vorbis"), 100)
+	badPage[40] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+		want string // part of the error, "" for ErrUnknownFormat
+	}{
+		{"empty", nil, ""},
+		{"text", []byte("hello, this is not audio at all"), ""},
+		{"zeros", make([]byte, 4096), ""},
+		{"wav without data", wavFile(wavFmt(wavFormatPCM, 2, 44100, 16)), "missing data chunk"},
+		{"wav data before fmt", wavFile(riffChunk("data", make([]byte, 16)), wavFmt(wavFormatPCM, 2, 44100, 16)), "data chunk before fmt"},
+		{"wav compressed", wavFile(wavFmt(2, 2, 44100, 4), riffChunk("data", make([]byte, 16))), "unsupported sample format"},
+		{"wav short fmt", wavFile(riffChunk("fmt ", make([]byte, 8)), riffChunk("data", make([]byte, 16))), "fmt chunk too short"},
+		{"flac truncated metadata", flacFile(1)[:20], "flac metadata"},
+		{"flac without frames", flacFile(0), "no audio frames"},
+		{"flac bad crc", badFirst, "CRC"},
+		{"flac streaminfo not first", append([]byte("fLaC"), append(flacBlockHeader(true, 1, 0), flacFrame(0)...)...), "STREAMINFO"},
+		{"mp3 single header", append([]byte{0xff, 0xfb, 0x90, 0x00}, make([]byte, 100)...), ""},
+		{"mp3 behind id3 without frames", append(id3v2(3), make([]byte, 100)...), "no valid frames"},
+		{"id3 size runs past the end", []byte("ID3\x03\x00\x00\x00\x00\x7f\x7f"), "past end of file"},
+		{"ogg bad crc", badPage, "CRC"},
+		{"ogg unknown codec", oggFile([]byte("\x80theora-ish"), []byte("x"), 1), "unsupported codec"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Probe(bytes.NewReader(tt.data))
+			if err == nil {
+				t.Fatalf("Probe accepted it as %s", info.Format)
+			}
+			if tt.want == "" && err != ErrUnknownFormat {
+				t.Errorf("got %v, want ErrUnknownFormat", err)
+			}
+			if tt.want != "" && !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+
+	// a broken last frame still passes, only the first one is checked
+	if _, err := Probe(bytes.NewReader(badCRC)); err != nil {
+		t.Errorf("broken last frame: %v", err)
+	}
+}
+
+func TestProbeNeverPanics(t *testing.T) {
+	files := [][]byte{
+		wavFile(wavFmt(wavFormatPCM, 2, 44100, 16), riffChunk("data", make([]byte, 64))),
+		flacFile(2),
+		mp3Frames(4),
+		oggFile(vorbisIdent(2, 44100, 0), append([]byte("\x03vorbis"), vorbisComments("TITLE=x")...), 100),
+	}
+	for _, file := range files {
+		// every truncation and a flipped byte at every position
+		for n := 0; n <= len(file); n++ {
+			Probe(bytes.NewReader(file[:n]))
+		}
+		for i := range file {
+			broken := bytes.Clone(file)
+			broken[i] ^= 0xa5
+			Probe(bytes.NewReader(broken))
+		}
+	}
+}
+
+func TestSampleAt(t *testing.T) {
+	data := flacFile(3)
+	info, err := Probe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := int64(len(flacFrame(0)))
+
+	tests := []struct {
+		offset int64
+		want   int64
+	}{
+		{0, 0},
+		{info.AudioOffset, 0},
+		{info.AudioOffset + frame, 4096},
+		{info.AudioOffset + 2*frame, 8192},
+		// in the middle of a frame the next header is found
+		{info.AudioOffset + frame/2, 4096},
+	}
+	for _, tt := range tests {
+		if got := SampleAt(info, data[tt.offset:], tt.offset); got != tt.want {
+			t.Errorf("SampleAt(%d) = %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+
+	// other formats are estimated from the position
+	wav := &Info{Format: FormatWAV, AudioOffset: 44, Size: 44 + 4000, TotalSamples: 1000}
+	if got := SampleAt(wav, nil, 44+2000); got != 500 {
+		t.Errorf("wav SampleAt = %d, want 500", got)
+	}
+}
@@ -0,0 +1,49 @@
+package audio
+
+// SampleAt tells which sample the audio at byte offset belongs to. data
+// holds the bytes starting at offset, for flac the first frame header in
+// data gives the exact sample, the other formats are estimated from the
+// position within the audio data
+func SampleAt(info *Info, data []byte, offset int64) int64 {
+	if offset <= info.AudioOffset {
+		return 0
+	}
+	if info.Format == FormatFLAC {
+		if sample, ok := flacSampleAt(info, data); ok {
+			return sample
+		}
+	}
+
+	audioBytes := info.Size - info.AudioOffset
+	if audioBytes <= 0 || info.TotalSamples <= 0 {
+		return 0
+	}
+	return int64(float64(offset-info.AudioOffset) / float64(audioBytes) * float64(info.TotalSamples))
+}
+
+func flacSampleAt(info *Info, data []byte) (int64, bool) {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xfe != 0xf8 {
+			continue
+		}
+		h, ok := parseFLACFrameHeader(data[i:])
+		if !ok || h.channels != info.Channels || (h.sampleRate != 0 && h.sampleRate != info.SampleRate) {
+			continue
+		}
+
+		sample := int64(h.number)
+		if !h.variable {
+			if info.BlockSize == 0 {
+				continue
+			}
+			sample *= int64(info.BlockSize)
+		}
+		// a sync pattern inside the audio data can pass the header crc
+		// by chance, the sample number has to make sense as well
+		if info.TotalSamples > 0 && sample >= info.TotalSamples {
+			continue
+		}
+		return sample, true
+	}
+	return 0, false
+}
@@ -0,0 +1,528 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// tags come from vorbis comments (flac and ogg), id3v2 (mp3, and sometimes
+// in front of flac or inside wav) and RIFF INFO lists. only the fields the
+// library needs are picked out, everything else is skipped
+
+const maxTagSize = 4 << 20
+
+type Tags struct {
+	Title       string   `json:"title,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+	AlbumArtist string   `json:"album_artist,omitempty"`
+	Album       string   `json:"album,omitempty"`
+	TrackNumber int      `json:"track_number,omitempty"`
+	TrackTotal  int      `json:"track_total,omitempty"`
+	DiscNumber  int      `json:"disc_number,omitempty"`
+	DiscTotal   int      `json:"disc_total,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	Genres      []string `json:"genres,omitempty"`
+	Lyrics      string   `json:"lyrics,omitempty"`
+
+	MusicBrainzTrackId       string `json:"musicbrainz_track_id,omitempty"`
+	MusicBrainzAlbumId       string `json:"musicbrainz_album_id,omitempty"`
+	MusicBrainzArtistId      string `json:"musicbrainz_artist_id,omitempty"`
+	MusicBrainzAlbumArtistId string `json:"musicbrainz_album_artist_id,omitempty"`
+}
+
+// ReadTags returns the tags of the file, a file without any gives empty Tags
+func ReadTags(r io.ReadSeeker) (*Tags, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("error seeking: %w", err)
+	}
+	src := &source{rs: r, size: size}
+	tags := &Tags{}
+
+	head := make([]byte, 12)
+	n, _ := src.ReadAt(head, 0)
+	head = head[:n]
+	if len(head) < 4 {
+		return tags, nil
+	}
+
+	switch {
+	case string(head[:4]) == "OggS":
+		err = readOggTags(src, tags)
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		err = readWAVTags(src, tags)
+	default:
+		offset := int64(0)
+		if string(head[:3]) == "ID3" {
+			if err := readID3v2(src, 0, tags); err != nil {
+				return nil, err
+			}
+			if offset, err = skipID3v2(src, 0); err != nil {
+				return nil, err
+			}
+		}
+		magic := make([]byte, 4)
+		if _, merr := src.ReadAt(magic, offset); merr == nil && string(magic) == "fLaC" {
+			err = readFLACTags(src, offset, tags)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func readFLACTags(src *source, offset int64, tags *Tags) error {
+	pos := offset + 4
+	for {
+		hdr := make([]byte, 4)
+		if err := src.readFull(hdr, pos); err != nil {
+			return fmt.Errorf("flac metadata: %w", err)
+		}
+		last := hdr[0]&0x80 != 0
+		length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		pos += 4
+
+		if hdr[0]&0x7f == 4 && length <= maxTagSize {
+			body := make([]byte, length)
+			if err := src.readFull(body, pos); err != nil {
+				return err
+			}
+			return parseVorbisComment(body, tags)
+		}
+
+		pos += length
+		if last || pos >= src.size {
+			return nil
+		}
+	}
+}
+
+func readOggTags(src *source, tags *Tags) error {
+	first, err := readOggPage(src, 0)
+	if err != nil {
+		return err
+	}
+
+	// the comment packet starts on the second page and can run over
+	// several, the parser stops at its own end so extra bytes don't matter
+	var packet []byte
+	pos := first.length
+	for i := 0; i < 64 && pos < src.size && len(packet) < maxTagSize; i++ {
+		page, err := readOggPage(src, pos)
+		if err != nil || page.serial != first.serial {
+			break
+		}
+		packet = append(packet, page.body...)
+		pos += page.length
+		if len(page.body)%255 != 0 {
+			// a segment shorter than 255 ends the packet
+			break
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		return parseVorbisComment(packet[7:], tags)
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		return parseVorbisComment(packet[8:], tags)
+	case len(packet) > 4 && packet[0]&0x7f == 4:
+		// flac in ogg, the packet is a metadata block
+		return parseVorbisComment(packet[4:], tags)
+	}
+	return nil
+}
+
+func readWAVTags(src *source, tags *Tags) error {
+	header := make([]byte, 8)
+	for pos := int64(12); pos+8 <= src.size; {
+		if err := src.readFull(header, pos); err != nil {
+			return err
+		}
+		id := string(header[:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+		body := pos + 8
+
+		switch {
+		case (id == "id3 " || id == "ID3 ") && size <= maxTagSize:
+			if err := readID3v2(src, body, tags); err != nil {
+				return err
+			}
+		case id == "LIST" && size >= 4 && size <= maxTagSize:
+			list := make([]byte, size)
+			if err := src.readFull(list, body); err != nil {
+				return err
+			}
+			if string(list[:4]) == "INFO" {
+				parseRIFFInfo(list[4:], tags)
+			}
+		}
+
+		// chunks are padded to an even size
+		pos = body + size + size%2
+	}
+	return nil
+}
+
+func parseRIFFInfo(b []byte, tags *Tags) {
+	for len(b) >= 8 {
+		id := string(b[:4])
+		size := int(binary.LittleEndian.Uint32(b[4:8]))
+		if 8+size > len(b) {
+			return
+		}
+		value := strings.TrimRight(string(b[8:8+size]), "\x00 ")
+		switch id {
+		case "INAM":
+			setIfEmpty(&tags.Title, value)
+		case "IART":
+			setIfEmpty(&tags.Artist, value)
+		case "IPRD":
+			setIfEmpty(&tags.Album, value)
+		case "ICRD":
+			setYear(tags, value)
+		case "IGNR":
+			addGenres(tags, value)
+		case "ITRK", "IPRT":
+			setNumber(&tags.TrackNumber, &tags.TrackTotal, value)
+		}
+		// the pad byte after an odd sized value can be missing on the last one
+		b = b[min(8+size+size%2, len(b)):]
+	}
+}
+
+var errCommentTruncated = errors.New("vorbis comment: truncated")
+
+func parseVorbisComment(b []byte, tags *Tags) error {
+	read := func() ([]byte, error) {
+		if len(b) < 4 {
+			return nil, errCommentTruncated
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, errCommentTruncated
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, nil
+	}
+
+	if _, err := read(); err != nil { // vendor string
+		return err
+	}
+	if len(b) < 4 {
+		return errCommentTruncated
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+
+	for i := uint32(0); i < count; i++ {
+		comment, err := read()
+		if err != nil {
+			return err
+		}
+		key, value, ok := strings.Cut(string(comment), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			setIfEmpty(&tags.Title, value)
+		case "ARTIST":
+			setIfEmpty(&tags.Artist, value)
+		case "ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST":
+			setIfEmpty(&tags.AlbumArtist, value)
+		case "ALBUM":
+			setIfEmpty(&tags.Album, value)
+		case "TRACKNUMBER":
+			setNumber(&tags.TrackNumber, &tags.TrackTotal, value)
+		case "TRACKTOTAL", "TOTALTRACKS":
+			setNumber(&tags.TrackTotal, nil, value)
+		case "DISCNUMBER":
+			setNumber(&tags.DiscNumber, &tags.DiscTotal, value)
+		case "DISCTOTAL", "TOTALDISCS":
+			setNumber(&tags.DiscTotal, nil, value)
+		case "DATE", "YEAR", "ORIGINALDATE":
+			setYear(tags, value)
+		case "GENRE":
+			addGenres(tags, value)
+		case "LYRICS", "UNSYNCEDLYRICS":
+			setIfEmpty(&tags.Lyrics, value)
+		case "MUSICBRAINZ_TRACKID":
+			setIfEmpty(&tags.MusicBrainzTrackId, value)
+		case "MUSICBRAINZ_ALBUMID":
+			setIfEmpty(&tags.MusicBrainzAlbumId, value)
+		case "MUSICBRAINZ_ARTISTID":
+			setIfEmpty(&tags.MusicBrainzArtistId, value)
+		case "MUSICBRAINZ_ALBUMARTISTID":
+			setIfEmpty(&tags.MusicBrainzAlbumArtistId, value)
+		}
+	}
+	return nil
+}
+
+// readID3v2 reads the text frames of the id3v2 tag at offset (2.2, 2.3 and 2.4)
+func readID3v2(src *source, offset int64, tags *Tags) error {
+	hdr := make([]byte, 10)
+	if n, _ := src.ReadAt(hdr, offset); n < 10 || string(hdr[:3]) != "ID3" {
+		return nil
+	}
+	version := hdr[3]
+	flags := hdr[5]
+	size := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	if version < 2 || version > 4 {
+		return nil
+	}
+	size = min(size, maxTagSize, src.size-offset-10)
+	if size <= 0 {
+		return nil
+	}
+
+	body := make([]byte, size)
+	if err := src.readFull(body, offset+10); err != nil {
+		return err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		// skip the extended header
+		ext := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			ext = synchsafe(body[:4])
+		} else {
+			ext += 4
+		}
+		if ext > len(body) {
+			return nil
+		}
+		body = body[ext:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		default:
+			frameSize = synchsafe(body[4:8])
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		}
+		if frameSize < 0 || headerLen+frameSize > len(body) {
+			break
+		}
+		frame := body[headerLen : headerLen+frameSize]
+		body = body[headerLen+frameSize:]
+
+		// compressed or encrypted frames are skipped
+		if version == 3 && frameFlags&0x00c0 != 0 || version == 4 && frameFlags&0x000c != 0 {
+			continue
+		}
+		if version == 4 && frameFlags&0x0002 != 0 {
+			frame = removeUnsync(frame)
+		}
+		if version == 4 && frameFlags&0x0001 != 0 && len(frame) >= 4 {
+			frame = frame[4:] // data length indicator
+		}
+		applyID3Frame(id, frame, tags)
+	}
+	return nil
+}
+
+func applyID3Frame(id string, frame []byte, tags *Tags) {
+	switch id {
+	case "TIT2", "TT2":
+		setIfEmpty(&tags.Title, firstValue(id3Text(frame)))
+	case "TPE1", "TP1":
+		setIfEmpty(&tags.Artist, firstValue(id3Text(frame)))
+	case "TPE2", "TP2":
+		setIfEmpty(&tags.AlbumArtist, firstValue(id3Text(frame)))
+	case "TALB", "TAL":
+		setIfEmpty(&tags.Album, firstValue(id3Text(frame)))
+	case "TRCK", "TRK":
+		setNumber(&tags.TrackNumber, &tags.TrackTotal, firstValue(id3Text(frame)))
+	case "TPOS", "TPA":
+		setNumber(&tags.DiscNumber, &tags.DiscTotal, firstValue(id3Text(frame)))
+	case "TDRC", "TYER", "TYE", "TDOR", "TORY":
+		setYear(tags, firstValue(id3Text(frame)))
+	case "TCON", "TCO":
+		for _, genre := range id3Text(frame) {
+			addGenres(tags, id3Genre(genre))
+		}
+	case "TXXX", "TXX":
+		values := id3Text(frame)
+		if len(values) < 2 {
+			return
+		}
+		switch strings.ToLower(values[0]) {
+		case "musicbrainz album id":
+			setIfEmpty(&tags.MusicBrainzAlbumId, values[1])
+		case "musicbrainz artist id":
+			setIfEmpty(&tags.MusicBrainzArtistId, values[1])
+		case "musicbrainz album artist id":
+			setIfEmpty(&tags.MusicBrainzAlbumArtistId, values[1])
+		case "musicbrainz release track id", "musicbrainz track id":
+			setIfEmpty(&tags.MusicBrainzTrackId, values[1])
+		}
+	case "USLT", "ULT":
+		// encoding, 3 letter language, then description and text like TXXX
+		if len(frame) > 4 {
+			values := id3Text(append([]byte{frame[0]}, frame[4:]...))
+			if len(values) > 0 {
+				setIfEmpty(&tags.Lyrics, values[len(values)-1])
+			}
+		}
+	case "UFID", "UFI":
+		owner, id, ok := bytes.Cut(frame, []byte{0})
+		if ok && string(owner) == "http://musicbrainz.org" {
+			setIfEmpty(&tags.MusicBrainzTrackId, string(id))
+		}
+	}
+}
+
+// id3Text decodes a text frame into its values, 2.4 separates multiple
+// values with a null character
+func id3Text(frame []byte) []string {
+	if len(frame) < 1 {
+		return nil
+	}
+	encoding, data := frame[0], frame[1:]
+
+	var text string
+	switch encoding {
+	case 0: // latin-1
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		text = string(runes)
+	case 1, 2: // utf-16, with a bom for 1, big endian for 2
+		text = decodeUTF16(data, encoding == 2)
+	default: // utf-8
+		text = string(data)
+	}
+
+	var values []string
+	for _, v := range strings.Split(text, "\x00") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	var units []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		// every value may start with its own bom
+		if data[i] == 0xff && data[i+1] == 0xfe {
+			bigEndian = false
+			continue
+		}
+		if data[i] == 0xfe && data[i+1] == 0xff {
+			bigEndian = true
+			continue
+		}
+		if bigEndian {
+			units = append(units, binary.BigEndian.Uint16(data[i:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(data[i:]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// id3Genre drops the "(17)" id3v1 genre references, their names aren't kept
+func id3Genre(genre string) string {
+	for strings.HasPrefix(genre, "(") {
+		end := strings.Index(genre, ")")
+		if end < 0 {
+			break
+		}
+		genre = genre[end+1:]
+	}
+	if _, err := strconv.Atoi(genre); err == nil {
+		return ""
+	}
+	return genre
+}
+
+func removeUnsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = strings.TrimSpace(value)
+	}
+}
+
+// setNumber reads "3" or "3/12", total is optional
+func setNumber(number *int, total *int, value string) {
+	n, t, _ := strings.Cut(strings.TrimSpace(value), "/")
+	if v, err := strconv.Atoi(strings.TrimSpace(n)); err == nil && *number == 0 {
+		*number = v
+	}
+	if total != nil {
+		if v, err := strconv.Atoi(strings.TrimSpace(t)); err == nil && *total == 0 {
+			*total = v
+		}
+	}
+}
+
+// setYear takes the year out of "2001", "2001-05-12" and the like
+func setYear(tags *Tags, value string) {
+	value = strings.TrimSpace(value)
+	if tags.Year != 0 || len(value) < 4 {
+		return
+	}
+	if year, err := strconv.Atoi(value[:4]); err == nil {
+		tags.Year = year
+	}
+}
+
+// addGenres splits "Rock; Indie" style lists and skips duplicates
+func addGenres(tags *Tags, value string) {
+	for _, genre := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '/' || r == ',' }) {
+		genre = strings.TrimSpace(genre)
+		if genre == "" {
+			continue
+		}
+		duplicate := false
+		for _, existing := range tags.Genres {
+			if strings.EqualFold(existing, genre) {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			tags.Genres = append(tags.Genres, genre)
+		}
+	}
+}
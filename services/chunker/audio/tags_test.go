@@ -0,0 +1,217 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// the builders are in probe_test.go
+
+func infoEntry(id, value string) []byte {
+	return riffChunk(id, []byte(value))
+}
+
+func infoList(entries ...[]byte) []byte {
+	body := []byte("INFO")
+	for _, e := range entries {
+		body = append(body, e...)
+	}
+	return riffChunk("LIST", body)
+}
+
+// id3v22Frame is the 3 letter, 3 byte size frame of id3v2.2
+func id3v22Frame(id string, data []byte) []byte {
+	n := len(data)
+	b := append([]byte(id), byte(n>>16), byte(n>>8), byte(n))
+	return append(b, data...)
+}
+
+func flacComments(comments ...string) []byte {
+	c := vorbisComments(comments...)
+	return append(flacBlockHeader(true, 4, len(c)), c...)
+}
+
+func tagTestFiles() []struct {
+	name string
+	data []byte
+	want Tags
+} {
+	pcm := riffChunk("data", make([]byte, 100))
+	fmt := wavFmt(wavFormatPCM, 2, 44100, 16)
+
+	return []struct {
+		name string
+		data []byte
+		want Tags
+	}{
+		{"no tags", mp3Frames(2), Tags{}},
+		{"wav info", wavFile(fmt, pcm, infoList(
+			infoEntry("INAM", "Song"),
+			infoEntry("IART", "Band"),
+			infoEntry("IPRD", "Record"),
+			infoEntry("ICRD", "1999-01-01"),
+			infoEntry("IGNR", "Rock; Indie"),
+			infoEntry("ITRK", "3/12"),
+		)), Tags{Title: "Song", Artist: "Band", Album: "Record", Year: 1999, Genres: []string{"Rock", "Indie"}, TrackNumber: 3, TrackTotal: 12}},
+		// the odd sized INAM is the last thing in the list and has no pad byte
+		{"wav info unpadded", wavFile(fmt, pcm, riffChunk("LIST", append([]byte("INFOINAM"), append(le32(3), "abc"...)...))),
+			Tags{Title: "abc"}},
+		{"wav info null terminated", wavFile(fmt, pcm, infoList(infoEntry("INAM", "Song\x00"))), Tags{Title: "Song"}},
+		{"wav id3", wavFile(fmt, pcm, riffChunk("id3 ", id3v2(3, id3Frame(3, "TIT2", []byte("\x00Song"))))),
+			Tags{Title: "Song"}},
+		{"flac", flacFile(1, flacComments(
+			"TITLE=Title",
+			"artist=Artist",
+			"ALBUMARTIST=Various",
+			"ALBUM=Album",
+			"TRACKNUMBER=2",
+			"TRACKTOTAL=10",
+			"DISCNUMBER=1/2",
+			"DATE=2004-03-01",
+			"GENRE=Jazz",
+			"GENRE=jazz",
+			"LYRICS=la la",
+			"MUSICBRAINZ_TRACKID=mbtrack",
+			"MUSICBRAINZ_ALBUMID=mbalbum",
+			"no separator",
+		)), Tags{
+			Title: "Title", Artist: "Artist", AlbumArtist: "Various", Album: "Album",
+			TrackNumber: 2, TrackTotal: 10, DiscNumber: 1, DiscTotal: 2, Year: 2004,
+			Genres: []string{"Jazz"}, Lyrics: "la la",
+			MusicBrainzTrackId: "mbtrack", MusicBrainzAlbumId: "mbalbum",
+		}},
+		{"flac first value wins", flacFile(1, flacComments("TITLE=One", "TITLE=Two")), Tags{Title: "One"}},
+		{"flac behind id3", append(id3v2(4, id3Frame(4, "TIT2", []byte("\x03From id3"))), flacFile(1, flacComments("ARTIST=From flac"))...),
+			Tags{Title: "From id3", Artist: "From flac"}},
+		{"ogg vorbis", oggFile(vorbisIdent(2, 44100, 128000), append([]byte("\x03vorbis"), vorbisComments("TITLE=Ogg", "ARTIST=Vorbis")...), 88200),
+			Tags{Title: "Ogg", Artist: "Vorbis"}},
+		{"ogg opus", oggFile(append([]byte("OpusHead\x01\x02"), append(le16(312), make([]byte, 7)...)...), append([]byte("OpusTags"), vorbisComments("TITLE=Opus")...), 48312),
+			Tags{Title: "Opus"}},
+		{"id3v2.3", append(id3v2(3,
+			id3Frame(3, "TIT2", []byte("\x00Caf\xe9")),
+			// utf-16 with a bom, "Bänd"
+			id3Frame(3, "TPE1", []byte("\x01\xff\xfeB\x00\xe4\x00n\x00d\x00")),
+			id3Frame(3, "TPE2", []byte("\x00Album Band")),
+			id3Frame(3, "TALB", []byte("\x00Album")),
+			id3Frame(3, "TRCK", []byte("\x005/9")),
+			id3Frame(3, "TPOS", []byte("\x002")),
+			id3Frame(3, "TYER", []byte("\x001987")),
+			id3Frame(3, "TCON", []byte("\x00(17)Rock")),
+			id3Frame(3, "TXXX", []byte("\x00MusicBrainz Album Id\x00mbalbum")),
+		), mp3Frames(2)...), Tags{
+			Title: "Café", Artist: "Bänd", AlbumArtist: "Album Band", Album: "Album",
+			TrackNumber: 5, TrackTotal: 9, DiscNumber: 2, Year: 1987, Genres: []string{"Rock"},
+			MusicBrainzAlbumId: "mbalbum",
+		}},
+		{"id3v2.4", append(id3v2(4,
+			id3Frame(4, "TPE1", []byte("\x03First\x00Second")),
+			id3Frame(4, "TCON", []byte("\x03Pop\x0017\x00Rock")),
+			id3Frame(4, "TDRC", []byte("\x032010-05-01")),
+			// utf-16 big endian without a bom
+			id3Frame(4, "TIT2", []byte("\x02\x00H\x00i")),
+			id3Frame(4, "USLT", []byte("\x03eng\x00words")),
+			id3Frame(4, "UFID", []byte("http://musicbrainz.org\x00mbtrack")),
+		), mp3Frames(2)...), Tags{
+			Title: "Hi", Artist: "First", Year: 2010, Genres: []string{"Pop", "Rock"},
+			Lyrics: "words", MusicBrainzTrackId: "mbtrack",
+		}},
+		{"id3v2.2", append(id3v2(2,
+			id3v22Frame("TT2", []byte("\x00Old")),
+			id3v22Frame("TP1", []byte("\x00Timer")),
+		), mp3Frames(2)...), Tags{Title: "Old", Artist: "Timer"}},
+		{"id3 frame past the tag", append(id3v2(3,
+			id3Frame(3, "TIT2", []byte("\x00Kept")),
+			append([]byte("TPE1"), be32(1000)...),
+		), mp3Frames(2)...), Tags{Title: "Kept"}},
+	}
+}
+
+func TestReadTags(t *testing.T) {
+	for _, tt := range tagTestFiles() {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := ReadTags(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("ReadTags: %v", err)
+			}
+			if !reflect.DeepEqual(*tags, tt.want) {
+				t.Errorf("got %+v\nwant %+v", *tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTagsNeverPanics(t *testing.T) {
+	for _, tt := range tagTestFiles() {
+		for n := 0; n < len(tt.data); n++ {
+			ReadTags(bytes.NewReader(tt.data[:n]))
+		}
+		for i := 0; i < len(tt.data) && i < 512; i++ {
+			data := bytes.Clone(tt.data)
+			data[i] ^= 0xff
+			ReadTags(bytes.NewReader(data))
+		}
+	}
+}
+
+func TestParseRIFFInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want Tags
+	}{
+		{"empty", nil, Tags{}},
+		{"padded", append(infoEntry("INAM", "abc"), infoEntry("IART", "de")...), Tags{Title: "abc", Artist: "de"}},
+		{"odd last entry without pad", append([]byte("INAM"), append(le32(3), "abc"...)...), Tags{Title: "abc"}},
+		{"odd entry without pad before another", append(append([]byte("INAM"), append(le32(3), "abc"...)...), infoEntry("IART", "de")...),
+			// the missing pad byte eats the next id, nothing more can be read
+			Tags{Title: "abc"}},
+		{"size past the end", append([]byte("INAM"), append(le32(100), "abc"...)...), Tags{}},
+		{"short header", []byte("INAM\x03"), Tags{}},
+		{"unknown ids", append(infoEntry("ISFT", "Encoder"), infoEntry("INAM", "x")...), Tags{Title: "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tags Tags
+			parseRIFFInfo(tt.data, &tags)
+			if !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("got %+v, want %+v", tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVorbisComment(t *testing.T) {
+	full := vorbisComments("TITLE=a", "ARTIST=b")
+	var tags Tags
+	if err := parseVorbisComment(full, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags.Title != "a" || tags.Artist != "b" {
+		t.Errorf("got %+v", tags)
+	}
+
+	for n := 0; n < len(full); n++ {
+		var tags Tags
+		if err := parseVorbisComment(full[:n], &tags); !errors.Is(err, errCommentTruncated) {
+			t.Errorf("%d bytes: got %v, want errCommentTruncated", n, err)
+		}
+	}
+}
+
+func TestID3Genre(t *testing.T) {
+	tests := map[string]string{
+		"Rock":           "Rock",
+		"(17)":           "",
+		"(17)Rock":       "Rock",
+		"(17)(18)Techno": "Techno",
+		"17":             "",
+		"(Broken":        "(Broken",
+	}
+	for in, want := range tests {
+		if got := id3Genre(in); got != want {
+			t.Errorf("id3Genre(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+func probeWAV(src *source) (*Info, error) {
+	var (
+		info   *Info
+		pos    int64 = 12
+		header       = make([]byte, 8)
+	)
+
+	for pos+8 <= src.size {
+		if err := src.readFull(header, pos); err != nil {
+			return nil, err
+		}
+		id := string(header[:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+		body := pos + 8
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("wav: fmt chunk too short")
+			}
+			fmtChunk := make([]byte, 16)
+			if err := src.readFull(fmtChunk, body); err != nil {
+				return nil, err
+			}
+			audioFormat := binary.LittleEndian.Uint16(fmtChunk[0:2])
+			if audioFormat != wavFormatPCM && audioFormat != wavFormatFloat && audioFormat != wavFormatExtensible {
+				return nil, errors.New("wav: unsupported sample format")
+			}
+			info = &Info{
+				Format:        FormatWAV,
+				Codec:         "pcm",
+				MimeType:      "audio/wav",
+				Channels:      int(binary.LittleEndian.Uint16(fmtChunk[2:4])),
+				SampleRate:    int(binary.LittleEndian.Uint32(fmtChunk[4:8])),
+				Bitrate:       int(binary.LittleEndian.Uint32(fmtChunk[8:12])) * 8,
+				BitsPerSample: int(binary.LittleEndian.Uint16(fmtChunk[14:16])),
+			}
+			blockAlign := int(binary.LittleEndian.Uint16(fmtChunk[12:14]))
+			if info.Channels == 0 || info.SampleRate == 0 || blockAlign == 0 || info.Bitrate == 0 {
+				return nil, errors.New("wav: invalid fmt chunk")
+			}
+
+		case "data":
+			if info == nil {
+				return nil, errors.New("wav: data chunk before fmt chunk")
+			}
+			available := src.size - body
+			if size > available {
+				size = available
+			}
+			blockAlign := int64(info.Channels * ((info.BitsPerSample + 7) / 8))
+			if size < blockAlign || blockAlign == 0 {
+				return nil, errors.New("wav: no sample data")
+			}
+			// make sure the first frames are actually readable
+			first := make([]byte, blockAlign)
+			if err := src.readFull(first, body); err != nil {
+				return nil, err
+			}
+			info.AudioOffset = body
+			info.TotalSamples = size / blockAlign
+			info.Duration = float64(info.TotalSamples) / float64(info.SampleRate)
+			return info, nil
+		}
+
+		pos = body + size + size%2
+	}
+
+	return nil, errors.New("wav: missing data chunk")
+}
@@ -0,0 +1,169 @@
+package chunkcache
+
+import (
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache keeps the bytes of recently streamed chunk files in memory, bounded
+// by a byte budget rather than an entry count. entries are evicted least
+// recently used first, and concurrent misses for the same chunk share one
+// disk read. chunk files never change once written so entries are only
+// dropped when they are evicted or their record is deleted
+
+type Cache struct {
+	budget int64
+
+	mu       sync.Mutex
+	lru      *simplelru.LRU[string, []byte]
+	bytes    int64
+	removing bool
+
+	loads singleflight.Group
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Budget    int64  `json:"budget"`
+}
+
+func New(budget int64) *Cache {
+	c := &Cache{budget: budget}
+	c.lru, _ = simplelru.NewLRU(math.MaxInt, func(_ string, data []byte) {
+		c.bytes -= int64(len(data))
+		if !c.removing {
+			c.evictions.Add(1)
+		}
+	})
+	return c
+}
+
+// Get returns the whole content of the chunk file at path. a miss is a
+// read from disk, callers that waited for someone else's read count as hits
+func (c *Cache) Get(path string) ([]byte, error) {
+	return c.get(path, true)
+}
+
+// Warm loads path into the cache without counting a hit or miss, for
+// reading ahead of what was asked
+func (c *Cache) Warm(path string) error {
+	_, err := c.get(path, false)
+	return err
+}
+
+func (c *Cache) get(path string, count bool) ([]byte, error) {
+	c.mu.Lock()
+	data, ok := c.lru.Get(path)
+	c.mu.Unlock()
+	if ok {
+		if count {
+			c.hits.Add(1)
+		}
+		return data, nil
+	}
+
+	read := false
+	v, err, _ := c.loads.Do(path, func() (interface{}, error) {
+		read = true
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c.add(path, data)
+		return data, nil
+	})
+	if count {
+		if read {
+			c.misses.Add(1)
+		} else {
+			c.hits.Add(1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// Load puts the chunk file at path in the cache after it was sent some
+// other way, it counts as the miss Get would have been. a chunk over the
+// budget would never be kept and isn't read
+func (c *Cache) Load(path string, size int64) error {
+	if size > c.budget {
+		c.misses.Add(1)
+		return nil
+	}
+	_, err := c.get(path, true)
+	return err
+}
+
+// Contains reports whether path is cached without touching its recency
+func (c *Cache) Contains(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Contains(path)
+}
+
+func (c *Cache) Remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Remove goes through the eviction callback, it shouldn't count as one
+	c.removing = true
+	c.lru.Remove(path)
+	c.removing = false
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   c.lru.Len(),
+		Bytes:     c.bytes,
+		Budget:    c.budget,
+	}
+}
+
+func (c *Cache) add(path string, data []byte) {
+	size := int64(len(data))
+	// a chunk bigger than the whole budget would just flush everything else
+	if size > c.budget {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru.Contains(path) {
+		return
+	}
+	c.lru.Add(path, data)
+	c.bytes += size
+	for c.bytes > c.budget {
+		c.lru.RemoveOldest()
+	}
+}
+
+// BindHooks drops a chunk's bytes when its record is deleted
+func BindHooks(app core.App, c *Cache) {
+	app.OnRecordAfterDeleteSuccess("ChunkedFiles").BindFunc(func(e *core.RecordEvent) error {
+		c.Remove(e.Record.GetString("chunk_path"))
+		return e.Next()
+	})
+}
@@ -0,0 +1,91 @@
+package chunkcache
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeChunk(t *testing.T, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCacheCounts(t *testing.T) {
+	c := New(1 << 20)
+	a := writeChunk(t, "a", 100)
+	b := writeChunk(t, "b", 100)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Warm(b); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Contains(b) {
+		t.Error("warmed chunk isn't cached")
+	}
+	c.Get(b)
+
+	stats := c.Stats()
+	if stats.Misses != 1 || stats.Hits != 3 {
+		t.Errorf("hits %d misses %d, want 3 and 1", stats.Hits, stats.Misses)
+	}
+	if stats.Entries != 2 || stats.Bytes != 200 {
+		t.Errorf("%d entries of %d bytes, want 2 of 200", stats.Entries, stats.Bytes)
+	}
+}
+
+func TestCacheConcurrentMiss(t *testing.T) {
+	c := New(1 << 20)
+	path := writeChunk(t, "a", 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.Get(path); err != nil || len(data) != 1000 {
+				t.Errorf("Get = %d bytes, %v", len(data), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// however many waited for the same read, there was one
+	stats := c.Stats()
+	if stats.Misses < 1 || stats.Hits+stats.Misses != 20 {
+		t.Errorf("hits %d misses %d, want 20 gets", stats.Hits, stats.Misses)
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	c := New(250)
+	paths := []string{writeChunk(t, "a", 100), writeChunk(t, "b", 100), writeChunk(t, "c", 100)}
+	for _, path := range paths {
+		c.Get(path)
+	}
+	if c.Contains(paths[0]) || !c.Contains(paths[2]) {
+		t.Error("the least recently used chunk should be evicted first")
+	}
+
+	big := writeChunk(t, "big", 300)
+	if data, err := c.Get(big); err != nil || len(data) != 300 {
+		t.Fatalf("Get = %d bytes, %v", len(data), err)
+	}
+	if c.Contains(big) {
+		t.Error("a chunk over the budget shouldn't be cached")
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Bytes > 250 {
+		t.Errorf("%d evictions, %d bytes", stats.Evictions, stats.Bytes)
+	}
+}
@@ -0,0 +1,148 @@
+package chunkindex
+
+import (
+	"sort"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/chunkio"
+	"github.com/rudyrdx/music-streamer/chunker/helpers"
+)
+
+// Index answers "which chunk holds byte x / sample y" for one track with a
+// binary search over sorted offset arrays, instead of scanning the chunk
+// records on every request. it is built once from ChunkedFiles, kept in
+// the shared cache and dropped by the record hooks whenever chunks change
+
+type Index struct {
+	TrackId string
+
+	ids          []string
+	chunks       []chunkio.Chunk
+	byteStarts   []int64
+	sampleStarts []int64
+	size         int64
+}
+
+func Build(trackId string, records []*core.Record) *Index {
+	sorted := make([]*core.Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetInt("start_byte_offset") < sorted[j].GetInt("start_byte_offset")
+	})
+
+	ix := &Index{
+		TrackId:      trackId,
+		ids:          make([]string, len(sorted)),
+		chunks:       chunkio.ChunksFromRecords(sorted),
+		byteStarts:   make([]int64, len(sorted)),
+		sampleStarts: make([]int64, len(sorted)),
+	}
+	for i, r := range sorted {
+		ix.ids[i] = r.Id
+		ix.byteStarts[i] = int64(r.GetInt("start_byte_offset"))
+		ix.sampleStarts[i] = int64(r.GetInt("start_sample"))
+		// older chunks have no sample offsets, keep the array sorted anyway
+		if i > 0 && ix.sampleStarts[i] < ix.sampleStarts[i-1] {
+			ix.sampleStarts[i] = ix.sampleStarts[i-1]
+		}
+	}
+	if n := len(ix.chunks); n > 0 {
+		ix.size = ix.chunks[n-1].Offset + ix.chunks[n-1].Size
+	}
+	return ix
+}
+
+func cacheKey(trackId string) string {
+	return "ChunkIndex_" + trackId
+}
+
+// Lookup returns the cached index of a track, building it on a miss
+func Lookup(app core.App, c *cache.Cache, trackId string) (*Index, error) {
+	return helpers.LookupFromCacheOrDB(c, cacheKey(trackId), func() (*Index, error) {
+		records, err := app.FindAllRecords("ChunkedFiles", dbx.HashExp{"file": trackId})
+		if err != nil {
+			return nil, err
+		}
+		return Build(trackId, records), nil
+	}, cache.DefaultExpiration)
+}
+
+func Invalidate(c *cache.Cache, trackId string) {
+	c.Delete(cacheKey(trackId))
+}
+
+// BindHooks drops a track's index whenever one of its chunks is created,
+// updated or deleted, or the track itself goes away
+func BindHooks(app core.App, c *cache.Cache) {
+	invalidateChunk := func(e *core.RecordEvent) error {
+		Invalidate(c, e.Record.GetString("file"))
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess("ChunkedFiles").BindFunc(invalidateChunk)
+	app.OnRecordAfterUpdateSuccess("ChunkedFiles").BindFunc(invalidateChunk)
+	app.OnRecordAfterDeleteSuccess("ChunkedFiles").BindFunc(invalidateChunk)
+
+	app.OnRecordAfterDeleteSuccess("UploadedFiles").BindFunc(func(e *core.RecordEvent) error {
+		Invalidate(c, e.Record.Id)
+		return e.Next()
+	})
+}
+
+func (ix *Index) Len() int {
+	return len(ix.chunks)
+}
+
+// Size is the byte size of the whole track
+func (ix *Index) Size() int64 {
+	return ix.size
+}
+
+func (ix *Index) Chunks() []chunkio.Chunk {
+	return ix.chunks
+}
+
+func (ix *Index) Chunk(i int) chunkio.Chunk {
+	return ix.chunks[i]
+}
+
+func (ix *Index) ChunkId(i int) string {
+	return ix.ids[i]
+}
+
+// StartSample is the first sample that can be decoded from chunk i
+func (ix *Index) StartSample(i int) int64 {
+	return ix.sampleStarts[i]
+}
+
+// ChunkAt returns the index of the chunk holding byte offset
+func (ix *Index) ChunkAt(offset int64) (int, bool) {
+	if offset < 0 || offset >= ix.size {
+		return 0, false
+	}
+	i := sort.Search(len(ix.byteStarts), func(i int) bool {
+		return ix.byteStarts[i] > offset
+	}) - 1
+	return i, i >= 0
+}
+
+// ChunkForSample returns the chunk to start decoding from to reach sample,
+// the last chunk whose first decodable sample is not after it
+func (ix *Index) ChunkForSample(sample int64) (int, bool) {
+	if len(ix.sampleStarts) == 0 || sample < 0 {
+		return 0, false
+	}
+	i := sort.Search(len(ix.sampleStarts), func(i int) bool {
+		return ix.sampleStarts[i] > sample
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i, true
+}
+
+// Reader opens the track as one continuous file, source may be nil
+func (ix *Index) Reader(source chunkio.Source) (*chunkio.Reader, error) {
+	return chunkio.NewReader(ix.chunks, source)
+}
@@ -0,0 +1,138 @@
+package chunkindex
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// chunk records in the order given, each is start byte, size and start sample
+func testIndex(chunks ...[3]int) *Index {
+	collection := core.NewBaseCollection("ChunkedFiles")
+	records := make([]*core.Record, len(chunks))
+	for i, c := range chunks {
+		records[i] = core.NewRecord(collection)
+		records[i].Id = fmt.Sprintf("chunk%d", c[0])
+		records[i].Set("chunk_path", fmt.Sprintf("/nonexistent/chunk%d", c[0]))
+		records[i].Set("start_byte_offset", c[0])
+		records[i].Set("chunk_size", c[1])
+		records[i].Set("start_sample", c[2])
+	}
+	return Build("track", records)
+}
+
+// uneven chunks, one of them a single byte, handed over out of order
+func unevenIndex() *Index {
+	return testIndex(
+		[3]int{250, 1, 2500},
+		[3]int{0, 100, 0},
+		[3]int{251, 149, 4000},
+		[3]int{100, 150, 1000},
+	)
+}
+
+func TestBuild(t *testing.T) {
+	ix := unevenIndex()
+	if ix.Len() != 4 || ix.Size() != 400 {
+		t.Fatalf("%d chunks of %d bytes, want 4 of 400", ix.Len(), ix.Size())
+	}
+	for i, want := range []string{"chunk0", "chunk100", "chunk250", "chunk251"} {
+		if ix.ChunkId(i) != want || ix.Chunk(i).Path != "/nonexistent/"+want {
+			t.Errorf("chunk %d is %s, want %s", i, ix.ChunkId(i), want)
+		}
+	}
+}
+
+func TestChunkAt(t *testing.T) {
+	ix := unevenIndex()
+	tests := []struct {
+		offset int64
+		want   int
+		ok     bool
+	}{
+		{math.MinInt64, 0, false},
+		{-1, 0, false},
+		// the first and last byte of the track
+		{0, 0, true},
+		{399, 3, true},
+		// either side of every chunk edge
+		{99, 0, true},
+		{100, 1, true},
+		{249, 1, true},
+		{250, 2, true},
+		{251, 3, true},
+		{50, 0, true},
+		// past the end
+		{400, 0, false},
+		{401, 0, false},
+		{math.MaxInt64, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ix.ChunkAt(tt.offset)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ChunkAt(%d) = %d, %v, want %d, %v", tt.offset, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestChunkForSample(t *testing.T) {
+	ix := unevenIndex()
+	tests := []struct {
+		sample int64
+		want   int
+		ok     bool
+	}{
+		{-1, 0, false},
+		{0, 0, true},
+		{999, 0, true},
+		{1000, 1, true},
+		{2499, 1, true},
+		{2500, 2, true},
+		{2501, 2, true},
+		{3999, 2, true},
+		{4000, 3, true},
+		// past the end the last chunk is where to start looking
+		{math.MaxInt64, 3, true},
+	}
+	for _, tt := range tests {
+		got, ok := ix.ChunkForSample(tt.sample)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ChunkForSample(%d) = %d, %v, want %d, %v", tt.sample, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// a first chunk that starts decoding late is still where to start
+	late := testIndex([3]int{0, 100, 500}, [3]int{100, 100, 1500})
+	if got, ok := late.ChunkForSample(0); got != 0 || !ok {
+		t.Errorf("ChunkForSample(0) before the first sample = %d, %v, want 0, true", got, ok)
+	}
+}
+
+// chunks from before sample offsets have none, they take the one before so
+// a search never lands in front of a chunk it already passed
+func TestMissingSampleOffsets(t *testing.T) {
+	ix := testIndex([3]int{0, 100, 0}, [3]int{100, 100, 1000}, [3]int{200, 100, 0}, [3]int{300, 100, 3000})
+	for i, want := range []int64{0, 1000, 1000, 3000} {
+		if got := ix.StartSample(i); got != want {
+			t.Errorf("StartSample(%d) = %d, want %d", i, got, want)
+		}
+	}
+	if got, _ := ix.ChunkForSample(2000); got != 2 {
+		t.Errorf("ChunkForSample(2000) = %d, want 2", got)
+	}
+}
+
+func TestEmptyIndex(t *testing.T) {
+	ix := Build("track", nil)
+	if ix.Len() != 0 || ix.Size() != 0 {
+		t.Fatalf("%d chunks of %d bytes, want none", ix.Len(), ix.Size())
+	}
+	if _, ok := ix.ChunkAt(0); ok {
+		t.Error("ChunkAt(0) found a chunk in an empty index")
+	}
+	if _, ok := ix.ChunkForSample(0); ok {
+		t.Error("ChunkForSample(0) found a chunk in an empty index")
+	}
+}
@@ -0,0 +1,219 @@
+package chunkio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Reader presents the ordered chunks of a track as one continuous file, so
+// callers can read any byte range without knowing where chunks start and
+// end. it implements io.ReadSeekCloser and io.ReaderAt, ReadAt is safe for
+// concurrent use
+
+type Chunk struct {
+	Path   string
+	Offset int64 // position of the chunk's first byte in the track
+	Size   int64
+}
+
+// Source hands out the whole content of a chunk, e.g. from a memory cache
+type Source interface {
+	Get(path string) ([]byte, error)
+}
+
+type Reader struct {
+	chunks []Chunk
+	size   int64
+	pos    int64
+	source Source
+
+	mu    sync.Mutex
+	files map[int]*os.File
+	// the chunk last taken from source, io.Copy reads a chunk in many
+	// small buffers and each of them shouldn't be a source.Get
+	held     int
+	heldData []byte
+}
+
+var errNegativeOffset = errors.New("chunkio: negative offset")
+
+// ChunksFromRecords converts ChunkedFiles records, in any order
+func ChunksFromRecords(records []*core.Record) []Chunk {
+	chunks := make([]Chunk, 0, len(records))
+	for _, r := range records {
+		chunks = append(chunks, Chunk{
+			Path:   r.GetString("chunk_path"),
+			Offset: int64(r.GetInt("start_byte_offset")),
+			Size:   int64(r.GetInt("chunk_size")),
+		})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Offset < chunks[j].Offset
+	})
+	return chunks
+}
+
+// NewReader expects chunks sorted by offset, starting at 0 and without gaps.
+// with a non nil source chunk bytes come from it instead of the chunk files
+func NewReader(chunks []Chunk, source Source) (*Reader, error) {
+	var size int64
+	for i, c := range chunks {
+		if c.Offset != size || c.Size <= 0 {
+			return nil, fmt.Errorf("chunkio: chunk %d does not continue at offset %d", i, size)
+		}
+		size += c.Size
+	}
+	return &Reader{chunks: chunks, size: size, source: source, files: map[int]*os.File{}, held: -1}, nil
+}
+
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	read := 0
+	i := r.chunkAt(off)
+	for read < len(p) && i < len(r.chunks) {
+		c := r.chunks[i]
+		want := p[read:]
+		if remaining := c.Offset + c.Size - off; int64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+
+		n, err := r.readChunk(i, want, off-c.Offset)
+		read += n
+		off += int64(n)
+		if err != nil && !(err == io.EOF && n == len(want)) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // chunk file shorter than its record says
+			}
+			return read, err
+		}
+		i++
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("chunkio: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for i, f := range r.files {
+		if cErr := f.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		delete(r.files, i)
+	}
+	r.held, r.heldData = -1, nil
+	return err
+}
+
+func (r *Reader) readChunk(i int, p []byte, off int64) (int, error) {
+	if r.source != nil {
+		data, err := r.sourceChunk(i)
+		if err != nil {
+			return 0, err
+		}
+		if off >= int64(len(data)) {
+			return 0, io.EOF
+		}
+		n := copy(p, data[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	f, err := r.file(i)
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, off)
+}
+
+func (r *Reader) sourceChunk(i int) ([]byte, error) {
+	r.mu.Lock()
+	if r.held == i {
+		data := r.heldData
+		r.mu.Unlock()
+		return data, nil
+	}
+	r.mu.Unlock()
+
+	data, err := r.source.Get(r.chunks[i].Path)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.held, r.heldData = i, data
+	r.mu.Unlock()
+	return data, nil
+}
+
+// chunkAt returns the index of the chunk holding off
+func (r *Reader) chunkAt(off int64) int {
+	return sort.Search(len(r.chunks), func(i int) bool {
+		return r.chunks[i].Offset+r.chunks[i].Size > off
+	})
+}
+
+// chunk files stay open until Close, a range usually reads the same chunk
+// many times in small buffers
+func (r *Reader) file(i int) (*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.files[i]; ok {
+		return f, nil
+	}
+	f, err := os.Open(r.chunks[i].Path)
+	if err != nil {
+		return nil, err
+	}
+	r.files[i] = f
+	return f, nil
+}
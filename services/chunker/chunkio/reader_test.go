@@ -0,0 +1,86 @@
+package chunkio
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type countingSource struct {
+	gets map[string]int
+}
+
+func (s *countingSource) Get(path string) ([]byte, error) {
+	s.gets[path]++
+	return os.ReadFile(path)
+}
+
+// writeChunks splits data into chunk files of size bytes
+func writeChunks(t *testing.T, data []byte, size int) []Chunk {
+	t.Helper()
+	dir := t.TempDir()
+	var chunks []Chunk
+	for off := 0; off < len(data); off += size {
+		end := min(off+size, len(data))
+		path := filepath.Join(dir, string(rune('a'+len(chunks))))
+		if err := os.WriteFile(path, data[off:end], 0644); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, Chunk{Path: path, Offset: int64(off), Size: int64(end - off)})
+	}
+	return chunks
+}
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 250_000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	chunks := writeChunks(t, data, 100_000)
+
+	for _, source := range []Source{nil, &countingSource{gets: map[string]int{}}} {
+		r, err := NewReader(chunks, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, r); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Error("whole file read back wrong")
+		}
+		if s, ok := source.(*countingSource); ok {
+			// io.Copy reads in 32KB buffers, each chunk is still one Get
+			for _, c := range chunks {
+				if n := s.gets[c.Path]; n != 1 {
+					t.Errorf("chunk %s taken from the source %d times", c.Path, n)
+				}
+			}
+		}
+
+		// across a chunk boundary and at the end
+		for _, span := range [][2]int{{99_990, 100_010}, {249_990, 250_000}, {0, 1}} {
+			p := make([]byte, span[1]-span[0])
+			if n, err := r.ReadAt(p, int64(span[0])); n != len(p) || err != nil || !bytes.Equal(p, data[span[0]:span[1]]) {
+				t.Errorf("ReadAt(%d) = %d, %v", span[0], n, err)
+			}
+		}
+		if n, err := r.ReadAt(make([]byte, 20), 249_990); n != 10 || err != io.EOF {
+			t.Errorf("ReadAt past the end = %d, %v", n, err)
+		}
+		r.Close()
+	}
+}
+
+func TestReaderGaps(t *testing.T) {
+	if _, err := NewReader([]Chunk{{Path: "a", Offset: 0, Size: 10}, {Path: "b", Offset: 20, Size: 10}}, nil); err == nil {
+		t.Error("a gap between chunks should be rejected")
+	}
+	if _, err := NewReader([]Chunk{{Path: "a", Offset: 5, Size: 10}}, nil); err == nil {
+		t.Error("chunks have to start at 0")
+	}
+}
@@ -0,0 +1,81 @@
+package albums
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("Albums")
+	collection.Id = "ALTable123"
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "title",
+		Required: true,
+		Max:      512,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "title_key",
+		Required: true,
+		Max:      512,
+	})
+
+	// the album artist, compilations have "Various Artists" here and the
+	// real artist on each track
+	collection.Fields.Add(&core.RelationField{
+		Name:         "artist",
+		Required:     true,
+		CollectionId: "ARTable123",
+		MaxSelect:    1,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "year",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "disc_total",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.JSONField{
+		Name: "genres",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "musicbrainz_id",
+	})
+
+	// kept up to date by the favorites package
+	collection.Fields.Add(&core.NumberField{
+		Name:    "favorite_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_sum",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_albums_artist", false, "artist, title_key", "")
+	collection.AddIndex("idx_albums_mbid", true, "musicbrainz_id", "musicbrainz_id != ''")
+
+	return collection
+}
@@ -0,0 +1,60 @@
+package artists
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("Artists")
+	collection.Id = "ARTable123"
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "name",
+		Required: true,
+		Max:      512,
+	})
+
+	// lowercased name with the whitespace folded, what tags are matched on
+	// when there is no musicbrainz id
+	collection.Fields.Add(&core.TextField{
+		Name:     "name_key",
+		Required: true,
+		Max:      512,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "musicbrainz_id",
+	})
+
+	// kept up to date by the favorites package
+	collection.Fields.Add(&core.NumberField{
+		Name:    "favorite_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_sum",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_artists_name_key", false, "name_key", "")
+	collection.AddIndex("idx_artists_mbid", true, "musicbrainz_id", "musicbrainz_id != ''")
+
+	return collection
+}
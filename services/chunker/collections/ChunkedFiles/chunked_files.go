@@ -28,6 +28,10 @@ func CreateCollection() *core.Collection {
 		Name: "end_byte_offset",
 	})
 
+	collection.Fields.Add(&core.NumberField{
+		Name: "start_sample",
+	})
+
 	collection.Fields.Add(&core.NumberField{
 		Name:     "chunk_order",
 		Required: true,
@@ -0,0 +1,85 @@
+package favorites
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+// what a user liked and how they rated it, one row per user and item. the
+// item is a track, an album or an artist and only the relation of its type
+// is set. a row with neither a like nor a rating left is deleted
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("Favorites")
+	collection.Id = "FVTable123"
+
+	collection.ListRule = types.Pointer("user = @request.auth.id")
+	collection.ViewRule = types.Pointer("user = @request.auth.id")
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "user",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "_pb_users_auth_",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "type",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    []string{library.TypeTrack, library.TypeAlbum, library.TypeArtist},
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "track",
+		CascadeDelete: true,
+		CollectionId:  "UFTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "album",
+		CascadeDelete: true,
+		CollectionId:  "ALTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "artist",
+		CascadeDelete: true,
+		CollectionId:  "ARTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.BoolField{
+		Name: "favorite",
+	})
+
+	// 1 to 5, 0 is not rated
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating",
+		OnlyInt: true,
+		Min:     types.Pointer(0.0),
+		Max:     types.Pointer(5.0),
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_favorites_track", true, "user, track", "track != ''")
+	collection.AddIndex("idx_favorites_album", true, "user, album", "album != ''")
+	collection.AddIndex("idx_favorites_artist", true, "user, artist", "artist != ''")
+	collection.AddIndex("idx_favorites_user", false, "user, type, updated", "")
+
+	return collection
+}
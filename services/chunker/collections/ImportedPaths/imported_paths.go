@@ -0,0 +1,35 @@
+package importedpaths
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// paths an import found to hold content we already had. the duplicate's
+// record keeps only its own source_path, without these a resumed import
+// would hash the same files again
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("ImportedPaths")
+	collection.Id = "IPTable123"
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "path",
+		Required: true,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "file",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "UFTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.AddIndex("idx_imported_paths_path", true, "path", "")
+
+	return collection
+}
@@ -0,0 +1,64 @@
+package playevents
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+)
+
+// what users listened to, written by the plays package. plays come from
+// /stream or the client, skips and completes only from the client
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("PlayEvents")
+	collection.Id = "PETable123"
+
+	collection.ListRule = types.Pointer("user = @request.auth.id")
+	collection.ViewRule = types.Pointer("user = @request.auth.id")
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "user",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "_pb_users_auth_",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "track",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "UFTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "type",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    plays.Types,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "source",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    plays.Sources,
+	})
+
+	// seconds into the track when the event happened
+	collection.Fields.Add(&core.NumberField{
+		Name: "position",
+		Min:  types.Pointer(0.0),
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.AddIndex("idx_play_events_user", false, "user, created", "")
+	collection.AddIndex("idx_play_events_track", false, "track, type", "")
+
+	return collection
+}
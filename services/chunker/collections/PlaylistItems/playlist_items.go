@@ -0,0 +1,45 @@
+package playlistitems
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("PlaylistItems")
+	collection.Id = "PITable123"
+
+	collection.ListRule = types.Pointer("playlist.owner = @request.auth.id")
+	collection.ViewRule = types.Pointer("playlist.owner = @request.auth.id")
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "playlist",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "PLTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "track",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "UFTable123",
+		MaxSelect:     1,
+	})
+
+	// 0 based and without gaps, rewritten whenever the order changes
+	collection.Fields.Add(&core.NumberField{
+		Name:    "position",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.AddIndex("idx_playlist_items_order", false, "playlist, position", "")
+
+	return collection
+}
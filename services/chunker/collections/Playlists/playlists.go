@@ -0,0 +1,64 @@
+package playlists
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("Playlists")
+	collection.Id = "PLTable123"
+
+	// the playlist endpoints do all the writing, owners may read their own
+	// playlists (and the cover file) through the regular api
+	collection.ListRule = types.Pointer("owner = @request.auth.id")
+	collection.ViewRule = types.Pointer("owner = @request.auth.id")
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "owner",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "_pb_users_auth_",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "title",
+		Required: true,
+		Max:      200,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "description",
+		Max:  2000,
+	})
+
+	collection.Fields.Add(&core.FileField{
+		Name:      "cover",
+		MaxSelect: 1,
+		MaxSize:   5 << 20,
+		MimeTypes: []string{"image/jpeg", "image/png", "image/webp"},
+	})
+
+	// bumped on every change to the playlist or its items, writers send the
+	// version they saw and get a 409 when someone else got there first
+	collection.Fields.Add(&core.NumberField{
+		Name:    "version",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_playlists_owner", false, "owner", "")
+
+	return collection
+}
@@ -0,0 +1,61 @@
+package scrobbleaccounts
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/scrobbler"
+)
+
+// the services a user forwards plays to. there are no api rules, the
+// tokens are only ever touched through /scrobble
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("ScrobbleAccounts")
+	collection.Id = "SATable123"
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "user",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "_pb_users_auth_",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "service",
+		Required:  true,
+		MaxSelect: 1,
+		Values:    scrobbler.Services,
+	})
+
+	// hidden and without api rules, only superusers can ever read it
+	collection.Fields.Add(&core.TextField{
+		Name:     "token",
+		Required: true,
+		Hidden:   true,
+		Max:      512,
+	})
+
+	// switched off when the service refuses the token
+	collection.Fields.Add(&core.BoolField{
+		Name: "enabled",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "last_error",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_scrobble_accounts_user", true, "user, service", "")
+
+	return collection
+}
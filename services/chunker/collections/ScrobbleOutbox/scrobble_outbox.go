@@ -0,0 +1,51 @@
+package scrobbleoutbox
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// listens waiting to be submitted, a row is deleted once the service took
+// it
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("ScrobbleOutbox")
+	collection.Id = "SOTable123"
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "account",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "SATable123",
+		MaxSelect:     1,
+	})
+
+	// a scrobbler.Listen, the track can change or go away before it's sent
+	collection.Fields.Add(&core.JSONField{
+		Name:     "listen",
+		Required: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "attempts",
+		OnlyInt: true,
+		Min:     types.Pointer(0.0),
+	})
+
+	collection.Fields.Add(&core.DateField{
+		Name: "next_attempt",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "last_error",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.AddIndex("idx_scrobble_outbox_due", false, "account, next_attempt", "")
+
+	return collection
+}
@@ -0,0 +1,110 @@
+package tracks
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// one row per UploadedFiles record, built from the file's tags by the
+// library package
+
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("Tracks")
+	collection.Id = "TRTable123"
+
+	collection.Fields.Add(&core.RelationField{
+		Name:          "file",
+		Required:      true,
+		CascadeDelete: true,
+		CollectionId:  "UFTable123",
+		MaxSelect:     1,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "title",
+		Required: true,
+		Max:      512,
+	})
+
+	// the track artist, can differ from the album's
+	collection.Fields.Add(&core.RelationField{
+		Name:         "artist",
+		Required:     true,
+		CollectionId: "ARTable123",
+		MaxSelect:    1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:         "album",
+		CollectionId: "ALTable123",
+		MaxSelect:    1,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "disc_number",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "track_number",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "year",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.JSONField{
+		Name: "genres",
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name: "duration",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "lyrics",
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "play_count",
+		OnlyInt: true,
+	})
+
+	// kept up to date by the favorites package
+	collection.Fields.Add(&core.NumberField{
+		Name:    "favorite_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_count",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name:    "rating_sum",
+		OnlyInt: true,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "musicbrainz_id",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_tracks_file", true, "file", "")
+	collection.AddIndex("idx_tracks_album_order", false, "album, disc_number, track_number", "")
+	collection.AddIndex("idx_tracks_artist", false, "artist", "")
+
+	return collection
+}
@@ -2,6 +2,8 @@ package uploadedfiles
 
 import (
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/progress"
 )
 
 func CreateCollection() *core.Collection {
@@ -28,11 +30,59 @@ func CreateCollection() *core.Collection {
 		Name: "processed",
 	})
 
+	collection.Fields.Add(&core.SelectField{
+		Name:      "status",
+		Values:    progress.Stages,
+		MaxSelect: 1,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "status_reason",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "source_path",
+	})
+
+	collection.Fields.Add(&core.BoolField{
+		Name: "external",
+	})
+
 	collection.Fields.Add(&core.JSONField{
 		Name:     "file_info",
 		Required: true,
 	})
 
+	collection.Fields.Add(&core.RelationField{
+		Name:         "owner",
+		CollectionId: "_pb_users_auth_",
+		MaxSelect:    1,
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:         "uploaders",
+		CollectionId: "_pb_users_auth_",
+		MaxSelect:    999,
+	})
+
+	collection.Fields.Add(&core.SelectField{
+		Name:      "visibility",
+		Values:    access.Visibilities,
+		MaxSelect: 1,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "content_hash",
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "format",
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name: "duration",
+	})
+
 	collection.Fields.Add(&core.AutodateField{
 		Name:     "created",
 		OnCreate: true,
@@ -44,5 +94,10 @@ func CreateCollection() *core.Collection {
 		OnUpdate: true,
 	})
 
+	collection.AddIndex("idx_uploaded_files_owner", false, "owner", "")
+	collection.AddIndex("idx_uploaded_files_hash", true, "content_hash", "content_hash != ''")
+	collection.AddIndex("idx_uploaded_files_source", false, "source_path", "")
+	collection.AddIndex("idx_uploaded_files_visibility", false, "visibility", "")
+
 	return collection
 }
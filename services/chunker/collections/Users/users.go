@@ -0,0 +1,25 @@
+package users
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+)
+
+// CreateCollection only carries what the service adds to pocketbase's
+// built in users collection, the rest is left as pocketbase made it
+func CreateCollection() *core.Collection {
+	// the id has to be known up front, the default email and tokenKey
+	// indexes are named after it and have to match the ones pocketbase made
+	collection := core.NewAuthCollection("users", "_pb_users_auth_")
+
+	// hidden so only superusers can grant roles, the default users rules
+	// let anyone sign up and edit their own record
+	collection.Fields.Add(&core.SelectField{
+		Name:      "roles",
+		Hidden:    true,
+		Values:    access.Roles,
+		MaxSelect: len(access.Roles),
+	})
+
+	return collection
+}
@@ -0,0 +1,50 @@
+package watchedfiles
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// one record per file seen in a watch folder, so a restart knows what
+// was already picked up
+func CreateCollection() *core.Collection {
+	collection := core.NewBaseCollection("WatchedFiles")
+	collection.Id = "WFTable123"
+
+	collection.Fields.Add(&core.TextField{
+		Name:     "path",
+		Required: true,
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name: "size",
+	})
+
+	collection.Fields.Add(&core.NumberField{
+		Name: "mod_time",
+	})
+
+	collection.Fields.Add(&core.RelationField{
+		Name:         "file",
+		CollectionId: "UFTable123",
+		MaxSelect:    1,
+	})
+
+	collection.Fields.Add(&core.TextField{
+		Name: "error",
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "created",
+		OnCreate: true,
+	})
+
+	collection.Fields.Add(&core.AutodateField{
+		Name:     "updated",
+		OnCreate: true,
+		OnUpdate: true,
+	})
+
+	collection.AddIndex("idx_watched_files_path", true, "path", "")
+
+	return collection
+}
@@ -2,29 +2,141 @@ package collections
 
 import (
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+	albums "github.com/rudyrdx/music-streamer/chunker/collections/Albums"
+	artists "github.com/rudyrdx/music-streamer/chunker/collections/Artists"
 	chunkedfiles "github.com/rudyrdx/music-streamer/chunker/collections/ChunkedFiles"
+	favorites "github.com/rudyrdx/music-streamer/chunker/collections/Favorites"
+	importedpaths "github.com/rudyrdx/music-streamer/chunker/collections/ImportedPaths"
+	playevents "github.com/rudyrdx/music-streamer/chunker/collections/PlayEvents"
+	playlistitems "github.com/rudyrdx/music-streamer/chunker/collections/PlaylistItems"
+	playlists "github.com/rudyrdx/music-streamer/chunker/collections/Playlists"
+	scrobbleaccounts "github.com/rudyrdx/music-streamer/chunker/collections/ScrobbleAccounts"
+	scrobbleoutbox "github.com/rudyrdx/music-streamer/chunker/collections/ScrobbleOutbox"
+	tracks "github.com/rudyrdx/music-streamer/chunker/collections/Tracks"
 	uploadedfiles "github.com/rudyrdx/music-streamer/chunker/collections/UploadedFiles"
+	users "github.com/rudyrdx/music-streamer/chunker/collections/Users"
+	watchedfiles "github.com/rudyrdx/music-streamer/chunker/collections/WatchedFiles"
 )
 
 func SetupCollections(AppInstance *pocketbase.PocketBase) error {
 
-	_, err := AppInstance.FindCollectionByNameOrId("UploadedFiles")
+	if err := ensureCollection(AppInstance, users.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, uploadedfiles.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, chunkedfiles.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, watchedfiles.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, importedpaths.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, playlists.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, playlistitems.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, artists.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, albums.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, tracks.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, playevents.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, scrobbleaccounts.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, scrobbleoutbox.CreateCollection()); err != nil {
+		return err
+	}
+
+	if err := ensureCollection(AppInstance, favorites.CreateCollection()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensureCollection saves the collection when it doesn't exist yet, otherwise
+// it adds whatever fields and indexes the definition gained since the
+// collection was first created so older databases keep up with the code
+func ensureCollection(app core.App, definition *core.Collection) error {
+	existing, err := app.FindCollectionByNameOrId(definition.Name)
 	if err != nil {
-		err := AppInstance.Save(uploadedfiles.CreateCollection())
-		if err != nil {
-			// fmt.Println("Error saving collection UploadedFiles")
-			return err
+		return app.Save(definition)
+	}
+
+	changed := false
+	for _, field := range definition.Fields {
+		current := existing.Fields.GetByName(field.GetName())
+		if current == nil {
+			existing.Fields.Add(field)
+			changed = true
+			continue
+		}
+		// a field that got hidden later has to be hidden on older databases
+		// too, non-superusers can't write hidden fields
+		if field.GetHidden() && !current.GetHidden() {
+			current.SetHidden(true)
+			changed = true
+		}
+	}
+	for _, index := range definition.Indexes {
+		if !hasIndex(existing, index) {
+			existing.Indexes = append(existing.Indexes, index)
+			changed = true
 		}
 	}
 
-	_, err = AppInstance.FindCollectionByNameOrId("ChunkedFiles")
-	if err != nil {
-		err := AppInstance.Save(chunkedfiles.CreateCollection())
-		if err != nil {
-			// fmt.Println("Error saving collection UploadedFiles")
-			return err
+	if !changed {
+		return nil
+	}
+	return app.Save(existing)
+}
+
+// hasIndex compares by name and by definition, pocketbase refuses a second
+// index over the same columns and older databases name theirs differently
+func hasIndex(collection *core.Collection, index string) bool {
+	if collection.GetIndex(dbutils.ParseIndex(index).IndexName) != "" {
+		return true
+	}
+	definition := indexDefinition(index)
+	for _, existing := range collection.Indexes {
+		if indexDefinition(existing) == definition {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil
+// indexDefinition is the index without its names, the way pocketbase
+// compares them
+func indexDefinition(index string) string {
+	parsed := dbutils.ParseIndex(index)
+	parsed.SchemaName, parsed.IndexName, parsed.TableName = "", "index", "table"
+	return parsed.Build()
 }
@@ -0,0 +1,146 @@
+package collections
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	users "github.com/rudyrdx/music-streamer/chunker/collections/Users"
+)
+
+// usersApp is a test app whose users collection went through
+// ensureCollection, with one plain user
+func usersApp(t testing.TB) (*tests.TestApp, *core.Record) {
+	t.Helper()
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureCollection(app, users.CreateCollection()); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := core.NewRecord(collection)
+	user.SetEmail("listener@example.com")
+	user.SetPassword("password123")
+	if err := app.Save(user); err != nil {
+		t.Fatal(err)
+	}
+	return app, user
+}
+
+func userRoles(t testing.TB, app core.App, email string) []string {
+	t.Helper()
+	user, err := app.FindAuthRecordByEmail("users", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.GetStringSlice("roles")
+}
+
+// roles are for superusers to grant, the default users rules would let
+// anyone give themselves the uploader role otherwise
+func TestUsersCannotGrantRoles(t *testing.T) {
+	app, user := usersApp(t)
+	userToken, err := user.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	superuser, err := app.FindFirstRecordByFilter(core.CollectionNameSuperusers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	superToken, err := superuser.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"roles":["` + access.RoleUploader + `"]}`
+	factory := func(testing.TB) *tests.TestApp { return app }
+
+	(&tests.ApiScenario{
+		Name:               "user updating own roles",
+		Method:             http.MethodPatch,
+		URL:                "/api/collections/users/records/" + user.Id,
+		Body:               strings.NewReader(body),
+		Headers:            map[string]string{"Authorization": userToken},
+		ExpectedStatus:     200,
+		NotExpectedContent: []string{access.RoleUploader},
+		TestAppFactory:     factory,
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			if roles := userRoles(t, app, "listener@example.com"); len(roles) != 0 {
+				t.Fatalf("roles %v, a user granted itself a role", roles)
+			}
+		},
+	}).Test(t)
+
+	app, _ = usersApp(t)
+	(&tests.ApiScenario{
+		Name:               "signing up with roles",
+		Method:             http.MethodPost,
+		URL:                "/api/collections/users/records",
+		Body:               strings.NewReader(`{"email":"new@example.com","password":"password123","passwordConfirm":"password123","roles":["` + access.RoleUploader + `"]}`),
+		ExpectedStatus:     200,
+		NotExpectedContent: []string{access.RoleUploader},
+		TestAppFactory:     factory,
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			if roles := userRoles(t, app, "new@example.com"); len(roles) != 0 {
+				t.Fatalf("roles %v, a new user signed up with a role", roles)
+			}
+		},
+	}).Test(t)
+
+	app, user = usersApp(t)
+	(&tests.ApiScenario{
+		Name:            "superuser granting roles",
+		Method:          http.MethodPatch,
+		URL:             "/api/collections/users/records/" + user.Id,
+		Body:            strings.NewReader(body),
+		Headers:         map[string]string{"Authorization": superToken},
+		ExpectedStatus:  200,
+		ExpectedContent: []string{access.RoleUploader},
+		TestAppFactory:  factory,
+		AfterTestFunc: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+			if roles := userRoles(t, app, "listener@example.com"); len(roles) != 1 || roles[0] != access.RoleUploader {
+				t.Fatalf("roles %v, want the uploader role", roles)
+			}
+		},
+	}).Test(t)
+}
+
+// databases from before roles was hidden get it hidden on startup
+func TestEnsureCollectionHidesFields(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+
+	old := users.CreateCollection()
+	old.Fields.GetByName("roles").SetHidden(false)
+	if err := ensureCollection(app, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureCollection(app, users.CreateCollection()); err != nil {
+		t.Fatal(err)
+	}
+
+	collection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !collection.Fields.GetByName("roles").GetHidden() {
+		t.Fatal("roles is still visible")
+	}
+	// the test database names the default indexes its own way
+	for _, index := range users.CreateCollection().Indexes {
+		if !hasIndex(collection, index) {
+			t.Errorf("index %s is gone", index)
+		}
+	}
+}
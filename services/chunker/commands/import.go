@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/collections"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/ingest"
+	"github.com/spf13/cobra"
+)
+
+// the http upload is fine for a handful of files, a whole library on disk
+// goes through this command instead:
+//
+//	chunker import ./music --copy --workers 8
+//
+// runs are idempotent, an interrupted import is resumed by running it again
+
+type importReport struct {
+	mu       sync.Mutex
+	imported int
+	skipped  int
+	failures []string
+}
+
+func (r *importReport) add(path string, result ingest.Result, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err != nil:
+		r.failures = append(r.failures, fmt.Sprintf("%s: %v", path, err))
+	case result.Status == ingest.StatusNew:
+		r.imported++
+	default:
+		r.skipped++
+	}
+
+	if done := r.imported + r.skipped + len(r.failures); done%100 == 0 {
+		fmt.Printf("... %d files processed\n", done)
+	}
+}
+
+func NewImportCommand(app *pocketbase.PocketBase, cfg *config.Config) *cobra.Command {
+	var (
+		copyFiles  bool
+		workers    int
+		owner      string
+		visibility string
+		extensions []string
+	)
+
+	command := &cobra.Command{
+		Use:          "import <dir>",
+		Short:        "Imports every audio file found under dir into UploadedFiles",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := collections.SetupCollections(app); err != nil {
+				return err
+			}
+
+			root := args[0]
+			if info, err := os.Stat(root); err != nil {
+				return err
+			} else if !info.IsDir() {
+				return errors.New(root + " is not a directory")
+			}
+			if !access.IsVisibility(visibility) {
+				return errors.New("invalid visibility " + visibility)
+			}
+			if workers < 1 {
+				workers = 1
+			}
+			exts := make([]string, 0, len(extensions))
+			for _, ext := range extensions {
+				ext = strings.ToLower(ext)
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				exts = append(exts, ext)
+			}
+
+			opts := ingest.Options{Copy: copyFiles, DestDir: cfg.UploadDir, Owner: owner, Visibility: visibility}
+			report := &importReport{}
+			start := time.Now()
+
+			paths := make(chan string)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for path := range paths {
+						result, err := ingest.ImportFile(app, path, opts)
+						report.add(path, result, err)
+					}
+				}()
+			}
+
+			walkErr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					report.add(path, ingest.Result{}, err)
+					return nil
+				}
+				if d.IsDir() || !slices.Contains(exts, strings.ToLower(filepath.Ext(path))) {
+					return nil
+				}
+				paths <- path
+				return nil
+			})
+			close(paths)
+			wg.Wait()
+
+			fmt.Printf("\nimport of %s finished in %s\n", root, time.Since(start).Round(time.Second))
+			fmt.Printf("  imported: %d\n", report.imported)
+			fmt.Printf("  skipped:  %d\n", report.skipped)
+			fmt.Printf("  failed:   %d\n", len(report.failures))
+			for _, failure := range report.failures {
+				fmt.Println("    " + failure)
+			}
+
+			if walkErr != nil {
+				return walkErr
+			}
+			if len(report.failures) > 0 {
+				return fmt.Errorf("%d files failed to import", len(report.failures))
+			}
+			return nil
+		},
+	}
+
+	command.Flags().BoolVar(&copyFiles, "copy", false, "copy files into the upload dir instead of referencing them in place")
+	command.Flags().IntVar(&workers, "workers", 4, "number of files imported concurrently")
+	command.Flags().StringVar(&owner, "owner", "", "id of the user the imported tracks belong to")
+	command.Flags().StringVar(&visibility, "visibility", cfg.DefaultVisibility, "visibility of the imported tracks: private, unlisted or public")
+	command.Flags().StringSliceVar(&extensions, "ext", ingest.AudioExtensions, "file extensions to import")
+
+	return command
+}
@@ -0,0 +1,242 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// all the knobs of the service come from the environment so the same
+// binary can be dropped into any region without a config file
+
+type Config struct {
+	// where accepted uploads are written before the chunk job picks them up
+	UploadDir string
+	// where uploads that fail validation end up, with a .json note next to them
+	QuarantineDir string
+	// visibility new tracks get when the uploader doesn't pick one
+	DefaultVisibility string
+
+	// per user upload quotas, 0 disables the check
+	UserQuotaBytes int64
+	UserQuotaFiles int
+
+	// drop folders polled for new audio, polling instead of inotify so
+	// network filesystems work too
+	WatchDirs     []string
+	WatchInterval time.Duration
+	// how long a file has to stay unchanged before it is picked up
+	WatchSettle time.Duration
+	// copy dropped files into UploadDir instead of referencing them in place
+	WatchCopy bool
+	// id of the user dropped files belong to and the visibility they get,
+	// without an owner only superusers see private tracks
+	WatchOwner      string
+	WatchVisibility string
+
+	// memory budget of the hot chunk cache, 0 disables it
+	ChunkCacheBytes int64
+
+	// chunks read ahead of a listener, 0 disables prefetching. the lookahead
+	// grows with the session's read speed up to PrefetchMaxChunks
+	PrefetchMaxChunks int
+	// concurrent prefetch reads over all sessions
+	PrefetchWorkers int
+	// how much reading time the lookahead should cover
+	PrefetchHorizon time.Duration
+
+	// requests per minute allowed on /stream for each user, ip and api key,
+	// 0 disables the limit
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	// api keys that get a bucket of their own, an X-API-Key header with any
+	// other value is ignored by the limiter
+	RateLimitAPIKeys []string
+	// once a listener is PaceBufferAhead ahead of playback, delivery is held
+	// to PaceMultiple times the track's bitrate. 0 disables pacing
+	PaceMultiple    float64
+	PaceBufferAhead time.Duration
+
+	// secrets the frontend signs its single use request tokens with, as
+	// "kid:base64key,kid:base64key". empty leaves the routes open
+	TOTPSecrets string
+	TOTPStep    time.Duration
+	// how many steps a token may be off from the server clock
+	TOTPSkew int
+
+	// keys stream urls are signed with, same format as TOTPSecrets. empty
+	// disables signed urls
+	SignedURLKeys string
+	// lifetime of a signed url, also the longest one that can be asked for
+	SignedURLTTL time.Duration
+
+	// cors policy for every route. no origins means cross origin requests
+	// are refused, "*" and "https://*.example.com" patterns work
+	CorsOrigins       []string
+	CorsMethods       []string
+	CorsHeaders       []string
+	CorsExposeHeaders []string
+	CorsCredentials   bool
+	CorsMaxAge        time.Duration
+
+	// time /suggest may spend scoring candidates before it answers with
+	// what it has
+	SuggestBudget time.Duration
+
+	// a stream session counts as a play once it fetched PlayMinShare of the
+	// track or PlayMinTime worth of audio, whichever comes first. 0 turns that
+	// check off, both at 0 leaves plays to the client
+	PlayMinShare float64
+	PlayMinTime  time.Duration
+	// listening to a track again after this long is another play
+	PlaySessionTTL time.Duration
+
+	// where ListenBrainz submissions go, any service speaking its api works
+	ListenBrainzURL string
+	// how often the scrobble outbox is checked besides right after a play
+	ScrobbleInterval  time.Duration
+	ScrobbleBatchSize int
+	// failed submissions wait ScrobbleMinBackoff, doubling with every
+	// attempt up to ScrobbleMaxBackoff
+	ScrobbleMinBackoff time.Duration
+	ScrobbleMaxBackoff time.Duration
+
+	// plays further apart than this are different listening sessions to
+	// the radio model
+	RadioSessionGap time.Duration
+	// cron schedule the radio model takes in new plays on
+	RadioSchedule string
+}
+
+func Load() *Config {
+	return &Config{
+		UploadDir:         envString("CHUNKER_UPLOAD_DIR", "./tmp"),
+		QuarantineDir:     envString("CHUNKER_QUARANTINE_DIR", "./quarantine"),
+		DefaultVisibility: envString("CHUNKER_DEFAULT_VISIBILITY", "private"),
+		UserQuotaBytes:    envInt64("CHUNKER_USER_QUOTA_BYTES", 20<<30),
+		UserQuotaFiles:    envInt("CHUNKER_USER_QUOTA_FILES", 5000),
+		WatchDirs:         envList("CHUNKER_WATCH_DIRS", nil),
+		WatchInterval:     envDuration("CHUNKER_WATCH_INTERVAL", 10*time.Second),
+		WatchSettle:       envDuration("CHUNKER_WATCH_SETTLE", 30*time.Second),
+		WatchCopy:         envBool("CHUNKER_WATCH_COPY", true),
+		WatchOwner:        envString("CHUNKER_WATCH_OWNER", ""),
+		WatchVisibility:   envString("CHUNKER_WATCH_VISIBILITY", envString("CHUNKER_DEFAULT_VISIBILITY", "private")),
+
+		ChunkCacheBytes: envInt64("CHUNKER_CHUNK_CACHE_BYTES", 256<<20),
+
+		PrefetchMaxChunks: envInt("CHUNKER_PREFETCH_MAX_CHUNKS", 4),
+		PrefetchWorkers:   envInt("CHUNKER_PREFETCH_WORKERS", 4),
+		PrefetchHorizon:   envDuration("CHUNKER_PREFETCH_HORIZON", 20*time.Second),
+
+		RateLimitPerMinute: envInt("CHUNKER_RATE_LIMIT_PER_MINUTE", 600),
+		RateLimitBurst:     envInt("CHUNKER_RATE_LIMIT_BURST", 60),
+		RateLimitAPIKeys:   envList("CHUNKER_RATE_LIMIT_API_KEYS", nil),
+		PaceMultiple:       envFloat("CHUNKER_PACE_MULTIPLE", 2),
+		PaceBufferAhead:    envDuration("CHUNKER_PACE_BUFFER_AHEAD", 30*time.Second),
+
+		TOTPSecrets: envString("CHUNKER_TOTP_SECRETS", ""),
+		TOTPStep:    envDuration("CHUNKER_TOTP_STEP", 30*time.Second),
+		TOTPSkew:    envInt("CHUNKER_TOTP_SKEW", 1),
+
+		SignedURLKeys: envString("CHUNKER_SIGNED_URL_KEYS", ""),
+		SignedURLTTL:  envDuration("CHUNKER_SIGNED_URL_TTL", time.Hour),
+
+		CorsOrigins:       envList("CHUNKER_CORS_ORIGINS", nil),
+		CorsMethods:       envList("CHUNKER_CORS_METHODS", []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}),
+		CorsHeaders:       envList("CHUNKER_CORS_HEADERS", []string{"Authorization", "Content-Type", "Range", "If-Range", "X-Stream-Token", "X-API-Key"}),
+		CorsExposeHeaders: envList("CHUNKER_CORS_EXPOSE_HEADERS", []string{"Content-Range", "Accept-Ranges", "Content-Length", "ETag"}),
+		CorsCredentials:   envBool("CHUNKER_CORS_CREDENTIALS", false),
+		CorsMaxAge:        envDuration("CHUNKER_CORS_MAX_AGE", 10*time.Minute),
+
+		SuggestBudget: envDuration("CHUNKER_SUGGEST_BUDGET", 20*time.Millisecond),
+
+		PlayMinShare:   envFloat("CHUNKER_PLAY_MIN_SHARE", 0.5),
+		PlayMinTime:    envDuration("CHUNKER_PLAY_MIN_TIME", 4*time.Minute),
+		PlaySessionTTL: envDuration("CHUNKER_PLAY_SESSION_TTL", 30*time.Minute),
+
+		ListenBrainzURL:    envString("CHUNKER_LISTENBRAINZ_URL", "https://api.listenbrainz.org"),
+		ScrobbleInterval:   envDuration("CHUNKER_SCROBBLE_INTERVAL", time.Minute),
+		ScrobbleBatchSize:  envInt("CHUNKER_SCROBBLE_BATCH_SIZE", 100),
+		ScrobbleMinBackoff: envDuration("CHUNKER_SCROBBLE_MIN_BACKOFF", 30*time.Second),
+		ScrobbleMaxBackoff: envDuration("CHUNKER_SCROBBLE_MAX_BACKOFF", 6*time.Hour),
+
+		RadioSessionGap: envDuration("CHUNKER_RADIO_SESSION_GAP", 30*time.Minute),
+		RadioSchedule:   envString("CHUNKER_RADIO_SCHEDULE", "*/5 * * * *"),
+	}
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt64(key string, fallback int64) int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func envInt(key string, fallback int) int {
+	return int(envInt64(key, int64(fallback)))
+}
+
+func envFloat(key string, fallback float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// envList splits a comma separated value, empty entries are dropped. an
+// unset key gives fallback, or an empty list without one
+func envList(key string, fallback []string) []string {
+	v, ok := os.LookupEnv(key)
+	if (!ok || v == "") && fallback != nil {
+		return fallback
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
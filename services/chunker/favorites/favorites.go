@@ -0,0 +1,153 @@
+// Package favorites keeps the likes and ratings users give tracks, albums
+// and artists.
+//
+// every item carries favorite_count, rating_count and rating_sum. they are
+// changed in the same write as the Favorites row, so a row deleted along
+// with its user or item takes its share of the counters with it
+package favorites
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+const MaxRating = 5
+
+var (
+	Types = []string{library.TypeTrack, library.TypeAlbum, library.TypeArtist}
+
+	ErrBadRating = errors.New("rating must be between 1 and 5")
+)
+
+// targets maps a type to the table its counters are on and the column
+// the Favorites relation points at. tracks are liked by their file like
+// everywhere else in the api
+var targets = map[string]struct{ table, column string }{
+	library.TypeTrack:  {"Tracks", "file"},
+	library.TypeAlbum:  {"Albums", "id"},
+	library.TypeArtist: {"Artists", "id"},
+}
+
+// BindHooks keeps the counters in step with the Favorites rows
+func BindHooks(app core.App) {
+	app.OnRecordCreateExecute("Favorites").BindFunc(func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return count(e.App, e.Record, 1)
+	})
+	app.OnRecordUpdateExecute("Favorites").BindFunc(func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if err := count(e.App, e.Record.Original(), -1); err != nil {
+			return err
+		}
+		return count(e.App, e.Record, 1)
+	})
+	app.OnRecordDeleteExecute("Favorites").BindFunc(func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		// Set clears the values before deleting, what was counted is the
+		// stored row
+		return count(e.App, e.Record.Original(), -1)
+	})
+}
+
+// count adds or, with sign -1, takes back what fav contributes to its
+// item's counters
+func count(app core.App, fav *core.Record, sign int) error {
+	kind := fav.GetString("type")
+	target, ok := targets[kind]
+	if !ok {
+		return nil
+	}
+
+	favorite, rated, sum := 0, 0, 0
+	if fav.GetBool("favorite") {
+		favorite = sign
+	}
+	if rating := fav.GetInt("rating"); rating > 0 {
+		rated, sum = sign, sign*rating
+	}
+	if favorite == 0 && rated == 0 {
+		return nil
+	}
+
+	// a plain update, the item's own hooks have nothing to do with counters
+	_, err := app.DB().
+		NewQuery("UPDATE " + target.table + " SET " +
+			"favorite_count = favorite_count + {:favorite}, " +
+			"rating_count = rating_count + {:rated}, " +
+			"rating_sum = rating_sum + {:sum} " +
+			"WHERE " + target.column + " = {:id}").
+		Bind(dbx.Params{"favorite": favorite, "rated": rated, "sum": sum, "id": fav.GetString(kind)}).
+		Execute()
+	return err
+}
+
+// Set changes a user's like and rating of an item, nil leaves either as it
+// was and a rating of 0 clears it. it returns the row, or nil when nothing
+// is left of it
+func Set(app core.App, userId, kind, itemId string, favorite *bool, rating *int) (*core.Record, error) {
+	if rating != nil && (*rating < 0 || *rating > MaxRating) {
+		return nil, ErrBadRating
+	}
+
+	var result *core.Record
+	err := app.RunInTransaction(func(txApp core.App) error {
+		record, err := Find(txApp, userId, kind, itemId)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			collection, err := txApp.FindCollectionByNameOrId("Favorites")
+			if err != nil {
+				return err
+			}
+			record = core.NewRecord(collection)
+			record.Set("user", userId)
+			record.Set("type", kind)
+			record.Set(kind, itemId)
+		}
+
+		if favorite != nil {
+			record.Set("favorite", *favorite)
+		}
+		if rating != nil {
+			record.Set("rating", *rating)
+		}
+
+		if !record.GetBool("favorite") && record.GetInt("rating") == 0 {
+			if record.IsNew() {
+				return nil
+			}
+			return txApp.Delete(record)
+		}
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+		result = record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func Find(app core.App, userId, kind, itemId string) (*core.Record, error) {
+	if _, ok := targets[kind]; !ok {
+		return nil, sql.ErrNoRows
+	}
+	return app.FindFirstRecordByFilter(
+		"Favorites",
+		"user = {:user} && type = {:type} && "+kind+" = {:item}",
+		dbx.Params{"user": userId, "type": kind, "item": itemId},
+	)
+}
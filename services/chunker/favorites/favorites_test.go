@@ -0,0 +1,190 @@
+package favorites_test
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	albums "github.com/rudyrdx/music-streamer/chunker/collections/Albums"
+	artists "github.com/rudyrdx/music-streamer/chunker/collections/Artists"
+	favoritescollection "github.com/rudyrdx/music-streamer/chunker/collections/Favorites"
+	tracks "github.com/rudyrdx/music-streamer/chunker/collections/Tracks"
+	uploadedfiles "github.com/rudyrdx/music-streamer/chunker/collections/UploadedFiles"
+	"github.com/rudyrdx/music-streamer/chunker/favorites"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+type favoritesTest struct {
+	app    *tests.TestApp
+	users  []*core.Record
+	file   *core.Record
+	album  *core.Record
+	artist *core.Record
+}
+
+func newFavoritesTest(t *testing.T) *favoritesTest {
+	t.Helper()
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+	favorites.BindHooks(app)
+
+	for _, c := range []*core.Collection{
+		uploadedfiles.CreateCollection(), artists.CreateCollection(), albums.CreateCollection(),
+		tracks.CreateCollection(), favoritescollection.CreateCollection(),
+	} {
+		if err := app.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ft := &favoritesTest{app: app}
+	for _, email := range []string{"one@example.com", "two@example.com"} {
+		ft.users = append(ft.users, ft.newRecord(t, "users", map[string]any{"email": email, "password": "password123"}))
+	}
+	ft.file = ft.newRecord(t, "UploadedFiles", map[string]any{
+		"file_path": "/nonexistent", "file_name": "track.flac", "file_size": 1,
+		"file_info": map[string]any{"format": "flac"}, "owner": ft.users[0].Id,
+	})
+	ft.artist = ft.newRecord(t, "Artists", map[string]any{"name": "Band", "name_key": "band"})
+	ft.album = ft.newRecord(t, "Albums", map[string]any{"title": "Record", "title_key": "record", "artist": ft.artist.Id})
+	ft.newRecord(t, "Tracks", map[string]any{"file": ft.file.Id, "title": "Song", "artist": ft.artist.Id, "album": ft.album.Id})
+	return ft
+}
+
+func (ft *favoritesTest) newRecord(t *testing.T, collectionName string, data map[string]any) *core.Record {
+	t.Helper()
+	collection, err := ft.app.FindCollectionByNameOrId(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := core.NewRecord(collection)
+	record.Load(data)
+	if v, ok := data["password"]; ok {
+		record.SetPassword(v.(string))
+	}
+	if err := ft.app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func (ft *favoritesTest) itemId(kind string) string {
+	return map[string]string{
+		library.TypeTrack:  ft.file.Id,
+		library.TypeAlbum:  ft.album.Id,
+		library.TypeArtist: ft.artist.Id,
+	}[kind]
+}
+
+func (ft *favoritesTest) set(t *testing.T, user int, kind string, favorite *bool, rating *int) {
+	t.Helper()
+	if _, err := favorites.Set(ft.app, ft.users[user].Id, kind, ft.itemId(kind), favorite, rating); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// counters checks favorite_count, rating_count and rating_sum of the item
+func (ft *favoritesTest) counters(t *testing.T, kind string, want [3]int) {
+	t.Helper()
+	var record *core.Record
+	var err error
+	switch kind {
+	case library.TypeTrack:
+		record, err = ft.app.FindFirstRecordByData("Tracks", "file", ft.file.Id)
+	case library.TypeAlbum:
+		record, err = ft.app.FindRecordById("Albums", ft.album.Id)
+	default:
+		record, err = ft.app.FindRecordById("Artists", ft.artist.Id)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := [3]int{record.GetInt("favorite_count"), record.GetInt("rating_count"), record.GetInt("rating_sum")}
+	if got != want {
+		t.Fatalf("%s favorites, ratings and sum %v, want %v", kind, got, want)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestCounters(t *testing.T) {
+	for _, kind := range favorites.Types {
+		t.Run(kind, func(t *testing.T) {
+			ft := newFavoritesTest(t)
+
+			ft.set(t, 0, kind, ptr(true), nil)
+			ft.counters(t, kind, [3]int{1, 0, 0})
+			// liking twice is still one like
+			ft.set(t, 0, kind, ptr(true), nil)
+			ft.counters(t, kind, [3]int{1, 0, 0})
+
+			ft.set(t, 0, kind, nil, ptr(4))
+			ft.counters(t, kind, [3]int{1, 1, 4})
+			ft.set(t, 0, kind, nil, ptr(2))
+			ft.counters(t, kind, [3]int{1, 1, 2})
+
+			ft.set(t, 1, kind, ptr(true), ptr(5))
+			ft.counters(t, kind, [3]int{2, 2, 7})
+
+			ft.set(t, 0, kind, nil, ptr(0))
+			ft.counters(t, kind, [3]int{2, 1, 5})
+			// nothing is left of the row, it goes with its share
+			ft.set(t, 0, kind, ptr(false), nil)
+			ft.counters(t, kind, [3]int{1, 1, 5})
+			if _, err := favorites.Find(ft.app, ft.users[0].Id, kind, ft.itemId(kind)); err == nil {
+				t.Fatal("empty favorite row was kept")
+			}
+
+			// a rating without a like
+			ft.set(t, 0, kind, nil, ptr(3))
+			ft.counters(t, kind, [3]int{1, 2, 8})
+
+			// a user's rows go with the user
+			if err := ft.app.Delete(ft.users[1]); err != nil {
+				t.Fatal(err)
+			}
+			ft.counters(t, kind, [3]int{0, 1, 3})
+			if err := ft.app.Delete(ft.users[0]); err != nil {
+				t.Fatal(err)
+			}
+			ft.counters(t, kind, [3]int{0, 0, 0})
+		})
+	}
+}
+
+func TestBadRating(t *testing.T) {
+	ft := newFavoritesTest(t)
+	for _, rating := range []int{-1, favorites.MaxRating + 1} {
+		_, err := favorites.Set(ft.app, ft.users[0].Id, library.TypeAlbum, ft.album.Id, nil, &rating)
+		if err != favorites.ErrBadRating {
+			t.Errorf("rating %d: got %v, want ErrBadRating", rating, err)
+		}
+	}
+	ft.counters(t, library.TypeAlbum, [3]int{0, 0, 0})
+}
+
+// deleting an item takes its Favorites rows along, and the delete hook
+// doesn't trip over a track that is already gone
+func TestItemDelete(t *testing.T) {
+	ft := newFavoritesTest(t)
+	ft.set(t, 0, library.TypeTrack, ptr(true), ptr(5))
+	ft.set(t, 0, library.TypeAlbum, ptr(true), ptr(4))
+
+	if err := ft.app.Delete(ft.file); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ft.app.CountRecords("Favorites"); err != nil || n != 1 {
+		t.Fatalf("%d favorites left (%v), want the album's", n, err)
+	}
+
+	if err := ft.app.Delete(ft.album); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ft.app.CountRecords("Favorites"); err != nil || n != 0 {
+		t.Fatalf("%d favorites left (%v), want none", n, err)
+	}
+}
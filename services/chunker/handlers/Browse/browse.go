@@ -0,0 +1,214 @@
+package browse
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+// browsing only ever shows what the caller could find in /listallsongs, an
+// artist or album without a single visible track doesn't show up at all
+
+const (
+	defaultPerPage = 100
+	maxPerPage     = 500
+)
+
+type artistRow struct {
+	Id            string `db:"id" json:"id"`
+	Name          string `db:"name" json:"name"`
+	MusicBrainzId string `db:"musicbrainz_id" json:"musicbrainzId"`
+}
+
+type albumRow struct {
+	Id            string `db:"id"`
+	Title         string `db:"title"`
+	Year          int    `db:"year"`
+	DiscTotal     int    `db:"disc_total"`
+	Genres        string `db:"genres"`
+	MusicBrainzId string `db:"musicbrainz_id"`
+	Tracks        int    `db:"tracks"`
+}
+
+type trackRow struct {
+	Id            string  `db:"id"`
+	File          string  `db:"file"`
+	Title         string  `db:"title"`
+	ArtistId      string  `db:"artist_id"`
+	ArtistName    string  `db:"artist_name"`
+	ArtistMbid    string  `db:"artist_mbid"`
+	DiscNumber    int     `db:"disc_number"`
+	TrackNumber   int     `db:"track_number"`
+	Year          int     `db:"year"`
+	Genres        string  `db:"genres"`
+	Duration      float64 `db:"duration"`
+	MusicBrainzId string  `db:"musicbrainz_id"`
+	NoDisc        bool    `db:"no_disc"`
+	NoTrack       bool    `db:"no_track"`
+}
+
+// visibleTracks selects from Tracks t joined with its file f, limited to
+// processed files auth may list
+func visibleTracks(app *pocketbase.PocketBase, auth *core.Record, columns ...string) *dbx.SelectQuery {
+	return app.DB().
+		Select(columns...).
+		From("Tracks t").
+		InnerJoin("UploadedFiles f", dbx.NewExp("f.id = t.file")).
+		Where(dbx.HashExp{"f.processed": true}).
+		AndWhere(access.FileFilter(auth, "f"))
+}
+
+// Artists lists every artist with a visible track, either their own or on
+// one of their albums
+func Artists(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	limit, offset := pagination(e)
+
+	rows := []artistRow{}
+	err := visibleTracks(app, e.Auth, "a.id", "a.name", "a.musicbrainz_id").
+		Distinct(true).
+		LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+		InnerJoin("Artists a", dbx.NewExp("a.id = t.artist OR a.id = al.artist")).
+		OrderBy("a.name_key ASC", "a.id ASC").
+		Limit(int64(limit)).
+		Offset(int64(offset)).
+		All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch artists")
+	}
+	return e.JSON(200, rows)
+}
+
+// ArtistAlbums lists the albums an artist is the album artist of
+func ArtistAlbums(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	artist, err := app.FindRecordById("Artists", e.Request.PathValue("id"))
+	if err != nil {
+		return e.String(404, "Artist not found")
+	}
+	// the artist may only be on tracks of other album artists, so an empty
+	// album list doesn't say the artist is hidden
+	visible, err := itemVisible(app, e.Auth, library.TypeArtist, artist.Id)
+	if err != nil {
+		return e.String(500, "Failed to find artist")
+	}
+	if !visible {
+		return e.String(404, "Artist not found")
+	}
+
+	rows := []albumRow{}
+	err = visibleTracks(app, e.Auth, "al.id", "al.title", "al.year", "al.disc_total", "al.genres", "al.musicbrainz_id", "COUNT(t.id) AS tracks").
+		InnerJoin("Albums al", dbx.NewExp("al.id = t.album")).
+		AndWhere(dbx.HashExp{"al.artist": artist.Id}).
+		GroupBy("al.id").
+		OrderBy("al.year ASC", "al.title_key ASC").
+		All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch albums")
+	}
+
+	albums := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		albums = append(albums, map[string]interface{}{
+			"id":            r.Id,
+			"title":         r.Title,
+			"year":          r.Year,
+			"discTotal":     r.DiscTotal,
+			"genres":        decodeGenres(r.Genres),
+			"musicbrainzId": r.MusicBrainzId,
+			"tracks":        r.Tracks,
+		})
+	}
+
+	return e.JSON(200, map[string]interface{}{
+		"artist": artistRow{Id: artist.Id, Name: artist.GetString("name"), MusicBrainzId: artist.GetString("musicbrainz_id")},
+		"albums": albums,
+	})
+}
+
+// AlbumTracks lists an album's tracks in disc and track order, files
+// without numbers go last
+func AlbumTracks(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	album, err := app.FindRecordById("Albums", e.Request.PathValue("id"))
+	if err != nil {
+		return e.String(404, "Album not found")
+	}
+
+	rows := []trackRow{}
+	err = visibleTracks(app, e.Auth,
+		"t.id", "t.file", "t.title", "t.disc_number", "t.track_number", "t.year", "t.genres", "t.duration", "t.musicbrainz_id",
+		"a.id AS artist_id", "a.name AS artist_name", "a.musicbrainz_id AS artist_mbid",
+		"(t.disc_number = 0) AS no_disc", "(t.track_number = 0) AS no_track").
+		InnerJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+		AndWhere(dbx.HashExp{"t.album": album.Id}).
+		OrderBy(
+			"no_disc ASC", "t.disc_number ASC",
+			"no_track ASC", "t.track_number ASC",
+			"t.title ASC",
+		).
+		All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch tracks")
+	}
+	// an album with none of its tracks visible doesn't exist for the caller
+	if len(rows) == 0 {
+		return e.String(404, "Album not found")
+	}
+
+	tracks := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		tracks = append(tracks, map[string]interface{}{
+			"id":            r.Id,
+			"file":          r.File,
+			"title":         r.Title,
+			"artist":        artistRow{Id: r.ArtistId, Name: r.ArtistName, MusicBrainzId: r.ArtistMbid},
+			"discNumber":    r.DiscNumber,
+			"trackNumber":   r.TrackNumber,
+			"year":          r.Year,
+			"genres":        decodeGenres(r.Genres),
+			"duration":      r.Duration,
+			"musicbrainzId": r.MusicBrainzId,
+		})
+	}
+
+	albumArtist, _ := app.FindRecordById("Artists", album.GetString("artist"))
+	albumJSON := map[string]interface{}{
+		"id":            album.Id,
+		"title":         album.GetString("title"),
+		"year":          album.GetInt("year"),
+		"discTotal":     album.GetInt("disc_total"),
+		"musicbrainzId": album.GetString("musicbrainz_id"),
+	}
+	if albumArtist != nil {
+		albumJSON["artist"] = artistRow{Id: albumArtist.Id, Name: albumArtist.GetString("name"), MusicBrainzId: albumArtist.GetString("musicbrainz_id")}
+	}
+
+	return e.JSON(200, map[string]interface{}{
+		"album":  albumJSON,
+		"tracks": tracks,
+	})
+}
+
+func pagination(e *core.RequestEvent) (int, int) {
+	query := e.Request.URL.Query()
+	perPage, err := strconv.Atoi(query.Get("perPage"))
+	if err != nil || perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	perPage = min(perPage, maxPerPage)
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return perPage, (page - 1) * perPage
+}
+
+func decodeGenres(raw string) []string {
+	genres := []string{}
+	json.Unmarshal([]byte(raw), &genres)
+	return genres
+}
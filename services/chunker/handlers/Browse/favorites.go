@@ -0,0 +1,319 @@
+package browse
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/favorites"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+// likes and ratings live under /favorites/{type}/{id} and
+// /ratings/{type}/{id}, type being track, album or artist. a track is
+// named by its file id like in /listallsongs and /stream
+
+type favoriteRow struct {
+	Type     string         `db:"type"`
+	Track    string         `db:"track"`
+	Album    string         `db:"album"`
+	Artist   string         `db:"artist"`
+	Favorite bool           `db:"favorite"`
+	Rating   int            `db:"rating"`
+	Updated  types.DateTime `db:"updated"`
+}
+
+type counterRow struct {
+	Id            string  `db:"id"`
+	Title         string  `db:"title"`
+	Duration      float64 `db:"duration"`
+	ArtistId      string  `db:"artist_id"`
+	ArtistName    string  `db:"artist_name"`
+	FavoriteCount int     `db:"favorite_count"`
+	RatingCount   int     `db:"rating_count"`
+	RatingSum     int     `db:"rating_sum"`
+}
+
+type ratingBody struct {
+	Rating int `json:"rating"`
+}
+
+func Like(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	return setFavorite(e, app, types.Pointer(true), nil)
+}
+
+func Unlike(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	return setFavorite(e, app, types.Pointer(false), nil)
+}
+
+func Rate(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var body ratingBody
+	if err := e.BindBody(&body); err != nil {
+		return e.String(400, "Invalid request")
+	}
+	if body.Rating < 1 || body.Rating > favorites.MaxRating {
+		return e.String(400, favorites.ErrBadRating.Error())
+	}
+	return setFavorite(e, app, nil, &body.Rating)
+}
+
+func Unrate(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	return setFavorite(e, app, nil, types.Pointer(0))
+}
+
+func setFavorite(e *core.RequestEvent, app *pocketbase.PocketBase, favorite *bool, rating *int) error {
+	if e.Auth.IsSuperuser() {
+		// favorites belong to users, superusers aren't one
+		return e.String(403, "Forbidden")
+	}
+	kind, id := e.Request.PathValue("type"), e.Request.PathValue("id")
+	if !slices.Contains(favorites.Types, kind) {
+		return e.String(404, "Unknown type")
+	}
+	visible, err := itemVisible(app, e.Auth, kind, id)
+	if err != nil {
+		return e.String(500, "Failed to find item")
+	}
+	if !visible {
+		return e.String(404, "Item not found")
+	}
+
+	record, err := favorites.Set(app, e.Auth.Id, kind, id, favorite, rating)
+	if err != nil {
+		if errors.Is(err, favorites.ErrBadRating) {
+			return e.String(400, err.Error())
+		}
+		return e.String(500, "Failed to save favorite")
+	}
+
+	result := map[string]interface{}{
+		"type":     kind,
+		"id":       id,
+		"favorite": false,
+		"rating":   0,
+	}
+	if record != nil {
+		result["favorite"] = record.GetBool("favorite")
+		result["rating"] = record.GetInt("rating")
+	}
+	return e.JSON(200, result)
+}
+
+// itemVisible tells whether auth may see the item, albums and artists need
+// a visible track like everywhere else in browsing
+func itemVisible(app *pocketbase.PocketBase, auth *core.Record, kind, id string) (bool, error) {
+	q := visibleTracks(app, auth, "t.id")
+	switch kind {
+	case library.TypeTrack:
+		q.AndWhere(dbx.HashExp{"f.id": id})
+	case library.TypeAlbum:
+		q.AndWhere(dbx.HashExp{"t.album": id})
+	case library.TypeArtist:
+		q.LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			AndWhere(dbx.NewExp("(t.artist = {:artist} OR al.artist = {:artist})", dbx.Params{"artist": id}))
+	}
+	var trackId string
+	err := q.Limit(1).Row(&trackId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Favorites lists what the user liked, newest first. ?type= narrows it to
+// tracks, albums or artists
+func Favorites(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	return listFavorites(e, app, dbx.HashExp{"favorite": true})
+}
+
+// Ratings lists what the user rated, newest first. ?min_rating= leaves out
+// the lower ratings
+func Ratings(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	minRating := 1
+	if raw := e.Request.URL.Query().Get("min_rating"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > favorites.MaxRating {
+			return e.String(400, "Invalid min_rating")
+		}
+		minRating = n
+	}
+	return listFavorites(e, app, dbx.NewExp("rating >= {:minRating}", dbx.Params{"minRating": minRating}))
+}
+
+func listFavorites(e *core.RequestEvent, app *pocketbase.PocketBase, filter dbx.Expression) error {
+	limit, offset := pagination(e)
+
+	q := app.DB().
+		Select("type", "track", "album", "artist", "favorite", "rating", "updated").
+		From("Favorites").
+		Where(dbx.HashExp{"user": e.Auth.Id}).
+		AndWhere(filter)
+	if kind := e.Request.URL.Query().Get("type"); kind != "" {
+		if !slices.Contains(favorites.Types, kind) {
+			return e.String(400, "Invalid type")
+		}
+		q.AndWhere(dbx.HashExp{"type": kind})
+	}
+
+	rows := []favoriteRow{}
+	err := q.OrderBy("updated DESC", "id DESC").Limit(int64(limit)).Offset(int64(offset)).All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch favorites")
+	}
+
+	ids := map[string][]interface{}{}
+	for _, r := range rows {
+		ids[r.Type] = append(ids[r.Type], r.itemId())
+	}
+	items, err := favoriteItems(app, e.Auth, ids)
+	if err != nil {
+		return e.String(500, "Failed to fetch favorites")
+	}
+
+	result := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		item, ok := items[r.Type+":"+r.itemId()]
+		if !ok {
+			// no longer visible
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"type":     r.Type,
+			"favorite": r.Favorite,
+			"rating":   r.Rating,
+			"updated":  r.Updated,
+			r.Type:     item,
+		})
+	}
+	return e.JSON(200, result)
+}
+
+func (r favoriteRow) itemId() string {
+	switch r.Type {
+	case library.TypeTrack:
+		return r.Track
+	case library.TypeAlbum:
+		return r.Album
+	default:
+		return r.Artist
+	}
+}
+
+// favoriteItems loads the items by type and id, keyed "type:id"
+func favoriteItems(app *pocketbase.PocketBase, auth *core.Record, ids map[string][]interface{}) (map[string]map[string]interface{}, error) {
+	items := map[string]map[string]interface{}{}
+
+	if len(ids[library.TypeTrack]) > 0 {
+		rows := []counterRow{}
+		err := visibleTracks(app, auth,
+			"f.id AS id", "t.title", "t.duration", "a.id AS artist_id", "a.name AS artist_name",
+			"t.favorite_count", "t.rating_count", "t.rating_sum").
+			InnerJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+			AndWhere(dbx.In("f.id", ids[library.TypeTrack]...)).
+			All(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			item := r.counters()
+			item["id"], item["title"], item["duration"] = r.Id, r.Title, r.Duration
+			item["artist"] = map[string]string{"id": r.ArtistId, "name": r.ArtistName}
+			items[library.TypeTrack+":"+r.Id] = item
+		}
+	}
+
+	for _, kind := range []string{library.TypeAlbum, library.TypeArtist} {
+		if len(ids[kind]) == 0 {
+			continue
+		}
+		visible, err := visibleItems(app, auth, kind, ids[kind])
+		if err != nil {
+			return nil, err
+		}
+		ids[kind] = visible
+	}
+
+	if len(ids[library.TypeAlbum]) > 0 {
+		rows := []counterRow{}
+		err := app.DB().
+			Select("al.id", "al.title", "a.id AS artist_id", "a.name AS artist_name",
+				"al.favorite_count", "al.rating_count", "al.rating_sum").
+			From("Albums al").
+			InnerJoin("Artists a", dbx.NewExp("a.id = al.artist")).
+			Where(dbx.In("al.id", ids[library.TypeAlbum]...)).
+			All(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			item := r.counters()
+			item["id"], item["title"] = r.Id, r.Title
+			item["artist"] = map[string]string{"id": r.ArtistId, "name": r.ArtistName}
+			items[library.TypeAlbum+":"+r.Id] = item
+		}
+	}
+
+	if len(ids[library.TypeArtist]) > 0 {
+		rows := []counterRow{}
+		err := app.DB().
+			Select("id", "name AS title", "favorite_count", "rating_count", "rating_sum").
+			From("Artists").
+			Where(dbx.In("id", ids[library.TypeArtist]...)).
+			All(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			item := r.counters()
+			item["id"], item["name"] = r.Id, r.Title
+			items[library.TypeArtist+":"+r.Id] = item
+		}
+	}
+
+	return items, nil
+}
+
+// visibleItems narrows ids down to the albums or artists auth can see a
+// track of, the check itemVisible does for a single item
+func visibleItems(app *pocketbase.PocketBase, auth *core.Record, kind string, ids []interface{}) ([]interface{}, error) {
+	var q *dbx.SelectQuery
+	switch kind {
+	case library.TypeAlbum:
+		q = visibleTracks(app, auth, "t.album").
+			AndWhere(dbx.In("t.album", ids...))
+	case library.TypeArtist:
+		q = visibleTracks(app, auth, "a.id").
+			LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			InnerJoin("Artists a", dbx.NewExp("a.id = t.artist OR a.id = al.artist")).
+			AndWhere(dbx.In("a.id", ids...))
+	default:
+		return ids, nil
+	}
+
+	found := []string{}
+	if err := q.Distinct(true).Column(&found); err != nil {
+		return nil, err
+	}
+	visible := make([]interface{}, 0, len(found))
+	for _, id := range found {
+		visible = append(visible, id)
+	}
+	return visible, nil
+}
+
+func (r counterRow) counters() map[string]interface{} {
+	average := 0.0
+	if r.RatingCount > 0 {
+		average = float64(r.RatingSum) / float64(r.RatingCount)
+	}
+	return map[string]interface{}{
+		"favorites":     r.FavoriteCount,
+		"ratings":       r.RatingCount,
+		"averageRating": average,
+	}
+}
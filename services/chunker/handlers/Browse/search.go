@@ -0,0 +1,231 @@
+package browse
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+	"github.com/rudyrdx/music-streamer/chunker/suggest"
+)
+
+// search asks the fts index for the best matches of each type and then
+// keeps the ones the caller may see, in the order the index ranked them.
+// the index is asked for more than limit since some of it may be hidden
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+	searchOverfetch    = 5
+)
+
+type searchAlbumRow struct {
+	Id         string `db:"id"`
+	Title      string `db:"title"`
+	Year       int    `db:"year"`
+	ArtistId   string `db:"artist_id"`
+	ArtistName string `db:"artist_name"`
+}
+
+type searchTrackRow struct {
+	Id         string  `db:"id"`
+	File       string  `db:"file"`
+	Title      string  `db:"title"`
+	Duration   float64 `db:"duration"`
+	ArtistId   string  `db:"artist_id"`
+	ArtistName string  `db:"artist_name"`
+	AlbumId    string  `db:"album_id"`
+	AlbumTitle string  `db:"album_title"`
+}
+
+func Search(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	match := library.MatchQuery(e.Request.URL.Query().Get("q"))
+	if match == "" {
+		return e.String(400, "Missing query")
+	}
+	limit, err := strconv.Atoi(e.Request.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	artistIds, err := searchIndex(app, match, library.TypeArtist, limit)
+	if err != nil {
+		return e.String(500, "Failed to search")
+	}
+	albumIds, err := searchIndex(app, match, library.TypeAlbum, limit)
+	if err != nil {
+		return e.String(500, "Failed to search")
+	}
+	trackIds, err := searchIndex(app, match, library.TypeTrack, limit)
+	if err != nil {
+		return e.String(500, "Failed to search")
+	}
+
+	artistRows := []artistRow{}
+	if len(artistIds) > 0 {
+		err = visibleTracks(app, e.Auth, "a.id", "a.name", "a.musicbrainz_id").
+			Distinct(true).
+			LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			InnerJoin("Artists a", dbx.NewExp("a.id = t.artist OR a.id = al.artist")).
+			AndWhere(dbx.In("a.id", toAny(artistIds)...)).
+			All(&artistRows)
+		if err != nil {
+			return e.String(500, "Failed to search artists")
+		}
+	}
+
+	albumRows := []searchAlbumRow{}
+	if len(albumIds) > 0 {
+		err = visibleTracks(app, e.Auth, "al.id", "al.title", "al.year", "a.id AS artist_id", "a.name AS artist_name").
+			InnerJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			InnerJoin("Artists a", dbx.NewExp("a.id = al.artist")).
+			AndWhere(dbx.In("al.id", toAny(albumIds)...)).
+			GroupBy("al.id").
+			All(&albumRows)
+		if err != nil {
+			return e.String(500, "Failed to search albums")
+		}
+	}
+
+	trackRows := []searchTrackRow{}
+	if len(trackIds) > 0 {
+		err = visibleTracks(app, e.Auth,
+			"t.id", "t.file", "t.title", "t.duration",
+			"a.id AS artist_id", "a.name AS artist_name",
+			"COALESCE(al.id, '') AS album_id", "COALESCE(al.title, '') AS album_title").
+			InnerJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+			LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			AndWhere(dbx.In("t.id", toAny(trackIds)...)).
+			All(&trackRows)
+		if err != nil {
+			return e.String(500, "Failed to search tracks")
+		}
+	}
+
+	artists := make([]interface{}, 0, limit)
+	for _, r := range ranked(artistRows, artistIds, func(r artistRow) string { return r.Id }, limit) {
+		artists = append(artists, r)
+	}
+
+	albums := make([]interface{}, 0, limit)
+	for _, r := range ranked(albumRows, albumIds, func(r searchAlbumRow) string { return r.Id }, limit) {
+		albums = append(albums, map[string]interface{}{
+			"id":     r.Id,
+			"title":  r.Title,
+			"year":   r.Year,
+			"artist": artistRow{Id: r.ArtistId, Name: r.ArtistName},
+		})
+	}
+
+	tracks := make([]interface{}, 0, limit)
+	for _, r := range ranked(trackRows, trackIds, func(r searchTrackRow) string { return r.Id }, limit) {
+		track := map[string]interface{}{
+			"id":       r.Id,
+			"file":     r.File,
+			"title":    r.Title,
+			"duration": r.Duration,
+			"artist":   artistRow{Id: r.ArtistId, Name: r.ArtistName},
+		}
+		if r.AlbumId != "" {
+			track["album"] = map[string]interface{}{"id": r.AlbumId, "title": r.AlbumTitle}
+		}
+		tracks = append(tracks, track)
+	}
+
+	return e.JSON(200, map[string]interface{}{
+		"artists": artists,
+		"albums":  albums,
+		"tracks":  tracks,
+	})
+}
+
+// searchIndex returns the ids of the best matches of one type, best first
+func searchIndex(app *pocketbase.PocketBase, match string, kind string, limit int) ([]string, error) {
+	ids := []string{}
+	err := app.DB().
+		Select("ref").
+		From(library.SearchTable).
+		Where(dbx.NewExp(library.SearchTable+" MATCH {:match}", dbx.Params{"match": match})).
+		AndWhere(dbx.HashExp{"type": kind}).
+		OrderBy("rank").
+		Limit(int64(limit * searchOverfetch)).
+		Column(&ids)
+	return ids, err
+}
+
+// ranked puts rows back into the order of ids and keeps the first limit
+func ranked[T any](rows []T, ids []string, id func(T) string, limit int) []T {
+	byId := make(map[string]T, len(rows))
+	for _, r := range rows {
+		byId[id(r)] = r
+	}
+	result := make([]T, 0, min(limit, len(rows)))
+	for _, i := range ids {
+		if r, ok := byId[i]; ok && len(result) < limit {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func toAny(ids []string) []interface{} {
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	return values
+}
+
+// Suggest completes names while typing, see the suggest package
+func Suggest(e *core.RequestEvent, app *pocketbase.PocketBase, sx *suggest.Index, budget time.Duration) error {
+	q := e.Request.URL.Query().Get("q")
+	if suggest.Fold(q) == "" {
+		return e.String(400, "Missing query")
+	}
+	limit, err := strconv.Atoi(e.Request.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	candidates := sx.Suggest(q, limit*searchOverfetch, budget)
+
+	ids := map[string][]interface{}{}
+	for _, s := range candidates {
+		ids[s.Type] = append(ids[s.Type], s.Id)
+	}
+	visible := map[string]bool{}
+	queries := map[string]*dbx.SelectQuery{
+		library.TypeArtist: visibleTracks(app, e.Auth, "a.id").
+			LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+			InnerJoin("Artists a", dbx.NewExp("a.id = t.artist OR a.id = al.artist")).
+			AndWhere(dbx.In("a.id", ids[library.TypeArtist]...)),
+		library.TypeAlbum: visibleTracks(app, e.Auth, "t.album").
+			AndWhere(dbx.In("t.album", ids[library.TypeAlbum]...)),
+		library.TypeTrack: visibleTracks(app, e.Auth, "t.id").
+			AndWhere(dbx.In("t.id", ids[library.TypeTrack]...)),
+	}
+	for kind, query := range queries {
+		if len(ids[kind]) == 0 {
+			continue
+		}
+		found := []string{}
+		if err := query.Distinct(true).Column(&found); err != nil {
+			return e.String(500, "Failed to fetch suggestions")
+		}
+		for _, id := range found {
+			visible[kind+":"+id] = true
+		}
+	}
+
+	suggestions := make([]suggest.Suggestion, 0, limit)
+	for _, s := range candidates {
+		if visible[s.Type+":"+s.Id] && len(suggestions) < limit {
+			suggestions = append(suggestions, s)
+		}
+	}
+	return e.JSON(200, suggestions)
+}
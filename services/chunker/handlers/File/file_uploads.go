@@ -1,12 +1,22 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/audio"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/ingest"
+	"github.com/rudyrdx/music-streamer/chunker/progress"
 )
 
 // once the file is uploaded, it will be added to the database, then it will be sent to processing
@@ -16,22 +26,12 @@ import (
 type FileData struct {
 }
 
-func HandleUpload(re *core.RequestEvent) error {
-
-	headers := re.Request.Header
-	for key, values := range headers {
-		for _, value := range values {
-			fmt.Printf("Header: %s: %s\n", key, value)
-		}
-	}
-	// content_type := re.Request.Header.Get("Content-Type")
-	// check_muiltipart := strings.Split(content_type, ";")[0] == "multipart/form-data"
+var (
+	errQuotaExceeded = errors.New("upload quota exceeded")
+	errInvalidAudio  = errors.New("file is not valid audio")
+)
 
-	//the tmp file path is in the root folder of this main.go file
-	tmp_dir := "./tmp"
-	// if !check_muiltipart {
-	// 	return re.String(400, "Invalid request")
-	// }
+func HandleUpload(re *core.RequestEvent, cfg *config.Config) error {
 
 	files, err := re.FindUploadedFiles("file")
 	if err != nil {
@@ -44,55 +44,195 @@ func HandleUpload(re *core.RequestEvent) error {
 		return re.String(400, "Invalid request")
 	}
 
-	collection, err := re.App.FindCollectionByNameOrId("UploadedFiles")
-	if err != nil {
-		return re.String(500, "Internal server error")
+	// superusers aren't in the users collection, what they upload has no owner
+	owner := ""
+	if re.Auth != nil && !re.Auth.IsSuperuser() {
+		owner = re.Auth.Id
+	}
+
+	visibility := re.Request.FormValue("visibility")
+	if visibility == "" {
+		visibility = cfg.DefaultVisibility
+	}
+	if !access.IsVisibility(visibility) {
+		return re.String(400, "Invalid visibility")
 	}
 
+	status := 200
+	results := make([]uploadResult, 0, file_len)
 	failures := make([]string, 0)
 	for _, file := range files {
-		oName := file.OriginalName
-		uu_id := uuid.New().String()
-		size := file.Size
-		path := fmt.Sprintf("%s/%s.flac", tmp_dir, uu_id)
-		record := core.NewRecord(collection)
-		record.Set("file_path", path)
-		record.Set("file_name", oName)
-		record.Set("file_size", size)
-		record.Set("processed", "false")
-		record.Set("file_info", map[string]interface{}{"key": "value"})
-		err = re.App.Save(record)
+		result, err := storeUpload(re.App, cfg, file, owner, visibility)
 		if err != nil {
-			failures = append(failures, err.Error())
+			failures = append(failures, fmt.Sprintf("%s: %v", file.OriginalName, err))
+			status = failureStatus(status, err)
+			progress.PublishRejected(re.App, re.Auth, file.OriginalName, err.Error())
 			continue
 		}
+		results = append(results, result)
+	}
 
-		fo, err := os.Create(path)
-		if err != nil {
-			failures = append(failures, err.Error())
-			continue
-		}
-		defer fo.Close() // Ensure the file is closed properly after writing
+	return re.JSON(status, map[string]interface{}{
+		"files":    results,
+		"failures": failures,
+	})
+}
 
-		src, err := file.Reader.Open()
-		if err != nil {
-			failures = append(failures, err.Error())
-			continue
+type uploadResult struct {
+	Name   string `json:"name"`
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// storeUpload validates one uploaded file and moves it into the upload
+// directory, the record is only saved once the file is fully on disk.
+// a file we already have is not stored again, the uploader is linked to
+// the existing track instead
+func storeUpload(app core.App, cfg *config.Config, file *filesystem.File, owner string, visibility string) (uploadResult, error) {
+	result := uploadResult{Name: file.OriginalName}
+
+	src, err := file.Reader.Open()
+	if err != nil {
+		return result, err
+	}
+	defer src.Close()
+
+	hash, err := helpers.HashReader(src)
+	if err != nil {
+		return result, err
+	}
+	if existing, err := ingest.LinkDuplicate(app, hash, owner); err != nil {
+		return result, err
+	} else if existing != nil {
+		result.Id = existing.Id
+		result.Status = ingest.StatusDuplicate
+		return result, nil
+	}
+
+	// a cheap early reject, the check that counts is made when saving
+	if err := enforceQuota(app, cfg, owner, file.Size); err != nil {
+		return result, err
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	info, err := audio.Probe(src)
+	if err != nil {
+		if qErr := quarantine(app, cfg, src, file, owner, err); qErr != nil {
+			app.Logger().Error("HandleUpload", "message", "Failed to quarantine upload", "file", file.OriginalName, "error", qErr)
 		}
-		defer src.Close() // Ensure the source file is closed properly
+		return result, fmt.Errorf("%w: %v", errInvalidAudio, err)
+	}
 
-		// Copy the source file directly to the destination file in chunks
-		if _, err := io.Copy(fo, src); err != nil {
-			failures = append(failures, err.Error())
-			continue
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		return result, err
+	}
+	path := filepath.Join(cfg.UploadDir, uuid.New().String()+info.Format.Extension())
+
+	written, err := ingest.WriteFile(path, src)
+	if err != nil {
+		return result, err
+	}
+
+	// the usage is read and the record saved in one transaction, pocketbase
+	// runs those one at a time so concurrent uploads can't all pass the
+	// quota. this checks what was written, the declared size can't be trusted
+	var record *core.Record
+	err = app.RunInTransaction(func(txApp core.App) error {
+		if err := enforceQuota(txApp, cfg, owner, written); err != nil {
+			return err
 		}
+		var err error
+		record, err = ingest.SaveRecord(txApp, ingest.Track{
+			Path:       path,
+			Name:       file.OriginalName,
+			Size:       written,
+			Hash:       hash,
+			Owner:      owner,
+			Visibility: visibility,
+			Info:       info,
+		})
+		return err
+	})
+	if err != nil {
+		os.Remove(path)
+		if errors.Is(err, errQuotaExceeded) {
+			return result, err
+		}
+		// an identical upload may have been saved while we were writing
+		if existing, lErr := ingest.LinkDuplicate(app, hash, owner); lErr == nil && existing != nil {
+			result.Id = existing.Id
+			result.Status = ingest.StatusDuplicate
+			return result, nil
+		}
+		return result, err
+	}
+
+	result.Id = record.Id
+	result.Status = ingest.StatusNew
+	return result, nil
+}
+
+func failureStatus(current int, err error) int {
+	var status int
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		status = 413
+	case errors.Is(err, errInvalidAudio):
+		status = 415
+	default:
+		status = 500
+	}
+	// server side failures win over client side ones
+	if current == 200 || status == 500 {
+		return status
 	}
+	return current
+}
+
+type Usage struct {
+	Bytes int64 `db:"bytes"`
+	Files int   `db:"files"`
+}
 
-	if len(failures) > 0 {
-		return re.String(500, fmt.Sprintf("Failed to save files: %v", failures))
+// enforceQuota checks that size more bytes fit the quota of owner. files
+// without an owner are superuser uploads, imports and watch folder drops,
+// they aren't anybody's quota
+func enforceQuota(app core.App, cfg *config.Config, owner string, size int64) error {
+	if owner == "" {
+		return nil
 	}
+	usage, err := findUsage(app, owner)
+	if err != nil {
+		return err
+	}
+	return checkQuota(cfg, usage, size)
+}
 
-	return re.String(200, "Files uploaded successfully")
+func findUsage(app core.App, owner string) (Usage, error) {
+	usage := Usage{}
+	err := app.DB().
+		Select("COALESCE(SUM(file_size), 0) AS bytes", "COUNT(*) AS files").
+		From("UploadedFiles").
+		Where(dbx.HashExp{"owner": owner}).
+		One(&usage)
+	return usage, err
+}
+
+func checkQuota(cfg *config.Config, usage Usage, size int64) error {
+	if cfg.UserQuotaFiles > 0 && usage.Files+1 > cfg.UserQuotaFiles {
+		return fmt.Errorf("%w: at most %d files", errQuotaExceeded, cfg.UserQuotaFiles)
+	}
+	if cfg.UserQuotaBytes > 0 && usage.Bytes+size > cfg.UserQuotaBytes {
+		return fmt.Errorf("%w: at most %d bytes", errQuotaExceeded, cfg.UserQuotaBytes)
+	}
+	return nil
 }
 
 //any incoming requests to this chunker service will be expected to have
@@ -0,0 +1,60 @@
+package file
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/ingest"
+)
+
+// uploads that fail validation are kept aside instead of being dropped,
+// so a bad encoder or a bug in the probe can be looked at later
+
+type quarantineNote struct {
+	OriginalName string    `json:"original_name"`
+	Owner        string    `json:"owner"`
+	Size         int64     `json:"size"`
+	Reason       string    `json:"reason"`
+	Time         time.Time `json:"time"`
+}
+
+func quarantine(app core.App, cfg *config.Config, src io.ReadSeeker, file *filesystem.File, owner string, reason error) error {
+	if err := os.MkdirAll(cfg.QuarantineDir, 0755); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	name := uuid.New().String()
+	base := filepath.Join(cfg.QuarantineDir, name)
+
+	written, err := ingest.WriteFile(base+filepath.Ext(file.OriginalName), src)
+	if err != nil {
+		return err
+	}
+
+	note, err := json.MarshalIndent(quarantineNote{
+		OriginalName: file.OriginalName,
+		Owner:        owner,
+		Size:         written,
+		Reason:       reason.Error(),
+		Time:         time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".json", note, 0644); err != nil {
+		return err
+	}
+
+	app.Logger().Warn("HandleUpload", "message", "Upload quarantined", "file", file.OriginalName, "quarantineId", name, "reason", reason.Error())
+	return nil
+}
@@ -0,0 +1,150 @@
+package history
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 200
+)
+
+type eventBody struct {
+	Track    string  `json:"track"`
+	Type     string  `json:"type"`
+	Position float64 `json:"position"`
+}
+
+type historyRow struct {
+	Id       string         `db:"id"`
+	Type     string         `db:"type"`
+	Source   string         `db:"source"`
+	Position float64        `db:"position"`
+	Created  types.DateTime `db:"created"`
+	File     string         `db:"file"`
+	FileName string         `db:"file_name"`
+	Title    string         `db:"title"`
+	ArtistId string         `db:"artist_id"`
+	Artist   string         `db:"artist_name"`
+}
+
+// Event takes a play, skip or complete from the client. a play the stream
+// already counted in the same session is dropped with a 204
+func Event(e *core.RequestEvent, app *pocketbase.PocketBase, pt *plays.Tracker) error {
+	if e.Auth.IsSuperuser() {
+		// history belongs to users, superusers aren't one
+		return e.String(403, "Forbidden")
+	}
+
+	var body eventBody
+	if err := e.BindBody(&body); err != nil || body.Track == "" {
+		return e.String(400, "Invalid request")
+	}
+	if !slices.Contains(plays.Types, body.Type) {
+		return e.String(400, "Invalid event type")
+	}
+	if body.Position < 0 {
+		return e.String(400, "Invalid position")
+	}
+
+	file, err := app.FindRecordById("UploadedFiles", body.Track)
+	if err != nil || !access.CanListen(e.Auth, file) {
+		return e.String(400, "Unknown track")
+	}
+
+	event, err := pt.Report(e.Auth, file, body.Type, body.Position)
+	if err != nil {
+		return e.String(500, "Failed to record event")
+	}
+	if event == nil {
+		return e.NoContent(204)
+	}
+	return e.JSON(201, map[string]interface{}{
+		"id":       event.Id,
+		"track":    file.Id,
+		"type":     event.GetString("type"),
+		"source":   event.GetString("source"),
+		"position": event.GetFloat("position"),
+		"created":  event.GetDateTime("created"),
+	})
+}
+
+// History lists the user's events newest first, ?type= narrows it to one
+// kind of event
+func History(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	query := e.Request.URL.Query()
+	perPage, err := strconv.Atoi(query.Get("perPage"))
+	if err != nil || perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	perPage = min(perPage, maxPerPage)
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	q := app.DB().
+		Select(
+			"pe.id", "pe.type", "pe.source", "pe.position", "pe.created",
+			"f.id AS file", "f.file_name",
+			"COALESCE(t.title, '') AS title",
+			"COALESCE(a.id, '') AS artist_id", "COALESCE(a.name, '') AS artist_name",
+		).
+		From("PlayEvents pe").
+		InnerJoin("UploadedFiles f", dbx.NewExp("f.id = pe.track")).
+		LeftJoin("Tracks t", dbx.NewExp("t.file = f.id")).
+		LeftJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+		Where(dbx.HashExp{"pe.user": e.Auth.Id}).
+		// a track made private since doesn't show anymore
+		AndWhere(access.ListenFilter(e.Auth, "f"))
+
+	if kind := query.Get("type"); kind != "" {
+		if !slices.Contains(plays.Types, kind) {
+			return e.String(400, "Invalid event type")
+		}
+		q.AndWhere(dbx.HashExp{"pe.type": kind})
+	}
+
+	rows := []historyRow{}
+	err = q.OrderBy("pe.created DESC", "pe.id DESC").
+		Limit(int64(perPage)).
+		Offset(int64((page - 1) * perPage)).
+		All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch history")
+	}
+
+	items := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		item := map[string]interface{}{
+			"id":       r.Id,
+			"type":     r.Type,
+			"source":   r.Source,
+			"position": r.Position,
+			"created":  r.Created,
+			"track":    r.File,
+			"name":     r.FileName,
+		}
+		if r.Title != "" {
+			item["title"] = r.Title
+		}
+		if r.ArtistId != "" {
+			item["artist"] = map[string]string{"id": r.ArtistId, "name": r.Artist}
+		}
+		items = append(items, item)
+	}
+
+	return e.JSON(200, map[string]interface{}{
+		"page":    page,
+		"perPage": perPage,
+		"items":   items,
+	})
+}
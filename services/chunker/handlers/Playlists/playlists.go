@@ -0,0 +1,431 @@
+package playlists
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+)
+
+// every change to a playlist, its items included, goes through mutate which
+// checks the version the client saw and bumps it in the same transaction.
+// a client working from an old version gets a 409 with the current one and
+// is expected to reload and retry
+
+const (
+	maxBulkInsert = 500
+	maxItems      = 10000
+)
+
+var (
+	errNotFound  = errors.New("playlist not found")
+	errConflict  = errors.New("playlist was changed by someone else")
+	errBadTrack  = errors.New("unknown track")
+	errBadOrder  = errors.New("items must list every item of the playlist exactly once")
+	errTooMany   = errors.New("too many items")
+	errBadPos    = errors.New("position out of range")
+	errNoVersion = errors.New("missing version")
+	errNoTitle   = errors.New("empty title")
+)
+
+type playlistBody struct {
+	Title       *string `json:"title" form:"title"`
+	Description *string `json:"description" form:"description"`
+	RemoveCover bool    `json:"removeCover" form:"removeCover"`
+	Version     int     `json:"version" form:"version"`
+}
+
+type itemsBody struct {
+	Track    string   `json:"track"`
+	Tracks   []string `json:"tracks"`
+	Items    []string `json:"items"`
+	Position *int     `json:"position"`
+	Version  int      `json:"version"`
+}
+
+func List(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	records, err := app.FindRecordsByFilter("Playlists", "owner = {:owner}", "-updated", 0, 0, dbx.Params{"owner": e.Auth.Id})
+	if err != nil {
+		return e.String(500, "Failed to fetch playlists")
+	}
+
+	result := make([]map[string]interface{}, 0, len(records))
+	for _, r := range records {
+		result = append(result, playlistJSON(r, nil))
+	}
+	return e.JSON(200, result)
+}
+
+func Get(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	playlist, err := ownedPlaylist(app, e.Auth, e.Request.PathValue("id"))
+	if err != nil {
+		return respondError(e, err)
+	}
+	items, err := loadItems(app, playlist.Id)
+	if err != nil {
+		return e.String(500, "Failed to fetch playlist items")
+	}
+	return e.JSON(200, playlistJSON(playlist, items))
+}
+
+func Create(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	if e.Auth.IsSuperuser() {
+		// playlists belong to users, superusers aren't one
+		return e.String(403, "Forbidden")
+	}
+
+	body, err := bindPlaylistBody(e)
+	if err != nil || body.Title == nil {
+		return e.String(400, "Invalid request")
+	}
+
+	collection, err := app.FindCollectionByNameOrId("Playlists")
+	if err != nil {
+		return e.String(500, "Failed to find collection")
+	}
+	playlist := core.NewRecord(collection)
+	playlist.Set("owner", e.Auth.Id)
+	playlist.Set("version", 1)
+	if err := applyBody(e, playlist, body); err != nil {
+		return e.String(400, "Invalid request")
+	}
+	if err := app.Save(playlist); err != nil {
+		return e.String(400, err.Error())
+	}
+	return e.JSON(201, playlistJSON(playlist, []*core.Record{}))
+}
+
+// Update renames the playlist and changes its description or cover
+func Update(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	body, err := bindPlaylistBody(e)
+	if err != nil {
+		return e.String(400, "Invalid request")
+	}
+
+	playlist, err := mutate(app, e.Auth, e.Request.PathValue("id"), body.Version, func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error) {
+		if err := applyBody(e, playlist, body); err != nil {
+			return nil, err
+		}
+		return items, nil
+	})
+	return respond(e, app, playlist, err)
+}
+
+func Delete(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	version, err := strconv.Atoi(e.Request.URL.Query().Get("version"))
+	if err != nil {
+		return respondError(e, errNoVersion)
+	}
+
+	_, err = mutate(app, e.Auth, e.Request.PathValue("id"), version, func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error) {
+		// items go with it through the cascade
+		return nil, txApp.Delete(playlist)
+	})
+	if err != nil {
+		return respondError(e, err)
+	}
+	return e.NoContent(204)
+}
+
+// AddItem inserts one track at position, or at the end without one
+func AddItem(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var body itemsBody
+	if err := e.BindBody(&body); err != nil || body.Track == "" {
+		return e.String(400, "Invalid request")
+	}
+	return insert(e, app, []string{body.Track}, body.Position, body.Version)
+}
+
+// AddItems inserts many tracks at once, they keep the order they were sent in
+func AddItems(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var body itemsBody
+	if err := e.BindBody(&body); err != nil || len(body.Tracks) == 0 {
+		return e.String(400, "Invalid request")
+	}
+	if len(body.Tracks) > maxBulkInsert {
+		return respondError(e, errTooMany)
+	}
+	return insert(e, app, body.Tracks, body.Position, body.Version)
+}
+
+func RemoveItem(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	version, err := strconv.Atoi(e.Request.URL.Query().Get("version"))
+	if err != nil {
+		return respondError(e, errNoVersion)
+	}
+	itemId := e.Request.PathValue("item")
+
+	playlist, err := mutate(app, e.Auth, e.Request.PathValue("id"), version, removeItem(itemId))
+	return respond(e, app, playlist, err)
+}
+
+// Reorder takes the ids of all items in their new order
+func Reorder(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var body itemsBody
+	if err := e.BindBody(&body); err != nil {
+		return e.String(400, "Invalid request")
+	}
+
+	playlist, err := mutate(app, e.Auth, e.Request.PathValue("id"), body.Version, reorderItems(body.Items))
+	return respond(e, app, playlist, err)
+}
+
+func insert(e *core.RequestEvent, app *pocketbase.PocketBase, trackIds []string, position *int, version int) error {
+	playlist, err := mutate(app, e.Auth, e.Request.PathValue("id"), version, insertTracks(e.Auth, trackIds, position))
+	return respond(e, app, playlist, err)
+}
+
+// change is the part of a mutation that differs, see mutate
+type change func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error)
+
+// insertTracks puts the tracks auth may listen to at position, or at the
+// end without one
+func insertTracks(auth *core.Record, trackIds []string, position *int) change {
+	return func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error) {
+		at := len(items)
+		if position != nil {
+			at = *position
+		}
+		if at < 0 || at > len(items) {
+			return nil, errBadPos
+		}
+		if len(items)+len(trackIds) > maxItems {
+			return nil, errTooMany
+		}
+
+		collection, err := txApp.FindCollectionByNameOrId("PlaylistItems")
+		if err != nil {
+			return nil, err
+		}
+		added := make([]*core.Record, 0, len(trackIds))
+		for _, trackId := range trackIds {
+			track, err := txApp.FindRecordById("UploadedFiles", trackId)
+			if err != nil || !access.CanListen(auth, track) {
+				return nil, errBadTrack
+			}
+			item := core.NewRecord(collection)
+			item.Set("playlist", playlist.Id)
+			item.Set("track", track.Id)
+			item.Set("position", -1)
+			added = append(added, item)
+		}
+		return slices.Insert(items, at, added...), nil
+	}
+}
+
+func removeItem(itemId string) change {
+	return func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error) {
+		i := slices.IndexFunc(items, func(item *core.Record) bool { return item.Id == itemId })
+		if i < 0 {
+			return nil, errNotFound
+		}
+		if err := txApp.Delete(items[i]); err != nil {
+			return nil, err
+		}
+		return slices.Delete(items, i, i+1), nil
+	}
+}
+
+// reorderItems puts the items in the order of ids, which has to name every
+// item exactly once
+func reorderItems(ids []string) change {
+	return func(txApp core.App, playlist *core.Record, items []*core.Record) ([]*core.Record, error) {
+		if len(ids) != len(items) {
+			return nil, errBadOrder
+		}
+		byId := make(map[string]*core.Record, len(items))
+		for _, item := range items {
+			byId[item.Id] = item
+		}
+		ordered := make([]*core.Record, 0, len(items))
+		for _, id := range ids {
+			item, ok := byId[id]
+			if !ok {
+				return nil, errBadOrder
+			}
+			delete(byId, id)
+			ordered = append(ordered, item)
+		}
+		return ordered, nil
+	}
+}
+
+// mutate runs change inside a transaction once the version check passed.
+// change gets the playlist and its items in order and returns the items
+// in their new order, positions are then rewritten to match. a nil result
+// means the playlist is gone
+func mutate(app core.App, auth *core.Record, id string, version int, change change) (*core.Record, error) {
+	if version <= 0 {
+		return nil, errNoVersion
+	}
+
+	var playlist *core.Record
+	err := app.RunInTransaction(func(txApp core.App) error {
+		var err error
+		if playlist, err = ownedPlaylist(txApp, auth, id); err != nil {
+			return err
+		}
+
+		// a conditional bump takes the write lock first, two writers with
+		// the same version can't both get past it
+		res, err := txApp.DB().NewQuery("UPDATE Playlists SET version = version + 1 WHERE id = {:id} AND version = {:version}").
+			Bind(dbx.Params{"id": id, "version": version}).
+			Execute()
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			return errConflict
+		}
+		playlist.Set("version", version+1)
+
+		items, err := loadItems(txApp, id)
+		if err != nil {
+			return err
+		}
+		items, err = change(txApp, playlist, items)
+		if err != nil {
+			return err
+		}
+		if items == nil {
+			playlist = nil
+			return nil
+		}
+
+		for i, item := range items {
+			if item.IsNew() || item.GetInt("position") != i {
+				item.Set("position", i)
+				if err := txApp.Save(item); err != nil {
+					return err
+				}
+			}
+		}
+		// saves title changes and touches updated
+		return txApp.Save(playlist)
+	})
+	return playlist, err
+}
+
+// ownedPlaylist hides playlists of other users behind errNotFound
+func ownedPlaylist(app core.App, auth *core.Record, id string) (*core.Record, error) {
+	playlist, err := app.FindRecordById("Playlists", id)
+	if err != nil {
+		return nil, errNotFound
+	}
+	if !auth.IsSuperuser() && playlist.GetString("owner") != auth.Id {
+		return nil, errNotFound
+	}
+	return playlist, nil
+}
+
+func loadItems(app core.App, playlistId string) ([]*core.Record, error) {
+	return app.FindRecordsByFilter("PlaylistItems", "playlist = {:playlist}", "position,created", 0, 0, dbx.Params{"playlist": playlistId})
+}
+
+func bindPlaylistBody(e *core.RequestEvent) (playlistBody, error) {
+	var body playlistBody
+	if err := e.BindBody(&body); err != nil {
+		return body, err
+	}
+	// form binding sets every field, only keep the ones that were sent
+	if form := e.Request.MultipartForm; form != nil {
+		if _, ok := form.Value["title"]; !ok {
+			body.Title = nil
+		}
+		if _, ok := form.Value["description"]; !ok {
+			body.Description = nil
+		}
+	}
+	return body, nil
+}
+
+func applyBody(e *core.RequestEvent, playlist *core.Record, body playlistBody) error {
+	if body.Title != nil {
+		if *body.Title == "" {
+			return errNoTitle
+		}
+		playlist.Set("title", *body.Title)
+	}
+	if body.Description != nil {
+		playlist.Set("description", *body.Description)
+	}
+	if body.RemoveCover {
+		playlist.Set("cover", nil)
+	}
+	if files, err := e.FindUploadedFiles("cover"); err == nil && len(files) > 0 {
+		playlist.Set("cover", files[0])
+	}
+	return nil
+}
+
+func respond(e *core.RequestEvent, app core.App, playlist *core.Record, err error) error {
+	if err != nil {
+		return respondError(e, err)
+	}
+	items, err := loadItems(app, playlist.Id)
+	if err != nil {
+		return e.String(500, "Failed to fetch playlist items")
+	}
+	return e.JSON(200, playlistJSON(playlist, items))
+}
+
+func respondError(e *core.RequestEvent, err error) error {
+	switch {
+	case errors.Is(err, errNotFound):
+		return e.String(404, "Not found")
+	case errors.Is(err, errConflict):
+		current := 0
+		if latest, lErr := e.App.FindRecordById("Playlists", e.Request.PathValue("id")); lErr == nil {
+			current = latest.GetInt("version")
+		}
+		return e.JSON(409, map[string]interface{}{
+			"message": err.Error(),
+			"version": current,
+		})
+	case errors.Is(err, errBadTrack), errors.Is(err, errBadOrder), errors.Is(err, errTooMany),
+		errors.Is(err, errBadPos), errors.Is(err, errNoVersion), errors.Is(err, errNoTitle):
+		return e.String(400, err.Error())
+	}
+
+	// a bad title or cover fails the record validation
+	var invalid validation.Errors
+	if errors.As(err, &invalid) {
+		return e.String(400, err.Error())
+	}
+	return e.String(500, "Failed to update playlist")
+}
+
+func playlistJSON(playlist *core.Record, items []*core.Record) map[string]interface{} {
+	cover := ""
+	if name := playlist.GetString("cover"); name != "" {
+		cover = "/api/files/" + playlist.Collection().Id + "/" + playlist.Id + "/" + name
+	}
+
+	result := map[string]interface{}{
+		"id":          playlist.Id,
+		"owner":       playlist.GetString("owner"),
+		"title":       playlist.GetString("title"),
+		"description": playlist.GetString("description"),
+		"cover":       cover,
+		"version":     playlist.GetInt("version"),
+		"createdAt":   playlist.Get("created"),
+		"updatedAt":   playlist.Get("updated"),
+	}
+	if items != nil {
+		list := make([]map[string]interface{}, 0, len(items))
+		for _, item := range items {
+			list = append(list, map[string]interface{}{
+				"id":       item.Id,
+				"track":    item.GetString("track"),
+				"position": item.GetInt("position"),
+			})
+		}
+		result["items"] = list
+	}
+	return result
+}
@@ -0,0 +1,255 @@
+package playlists
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	playlistitems "github.com/rudyrdx/music-streamer/chunker/collections/PlaylistItems"
+	playlistcollection "github.com/rudyrdx/music-streamer/chunker/collections/Playlists"
+	uploadedfiles "github.com/rudyrdx/music-streamer/chunker/collections/UploadedFiles"
+)
+
+type playlistTest struct {
+	app      *tests.TestApp
+	user     *core.Record
+	playlist *core.Record
+	// tracks the user may add, the last one is someone else's and private
+	tracks []string
+}
+
+func newPlaylistTest(t *testing.T, tracks int) *playlistTest {
+	t.Helper()
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+
+	for _, c := range []*core.Collection{uploadedfiles.CreateCollection(), playlistcollection.CreateCollection(), playlistitems.CreateCollection()} {
+		if err := app.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pt := &playlistTest{app: app}
+	pt.user = pt.newUser(t, "listener@example.com")
+	other := pt.newUser(t, "other@example.com")
+
+	files, err := app.FindCollectionByNameOrId("UploadedFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= tracks; i++ {
+		file := core.NewRecord(files)
+		file.Set("file_path", "/nonexistent")
+		file.Set("file_name", "track.flac")
+		file.Set("file_size", 1)
+		file.Set("file_info", map[string]any{"format": "flac"})
+		file.Set("owner", pt.user.Id)
+		file.Set("visibility", access.VisibilityPrivate)
+		if i == tracks {
+			file.Set("owner", other.Id)
+		}
+		if err := app.Save(file); err != nil {
+			t.Fatal(err)
+		}
+		pt.tracks = append(pt.tracks, file.Id)
+	}
+
+	collection, err := app.FindCollectionByNameOrId("Playlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt.playlist = core.NewRecord(collection)
+	pt.playlist.Set("owner", pt.user.Id)
+	pt.playlist.Set("title", "Mix")
+	pt.playlist.Set("version", 1)
+	if err := app.Save(pt.playlist); err != nil {
+		t.Fatal(err)
+	}
+	return pt
+}
+
+func (pt *playlistTest) newUser(t *testing.T, email string) *core.Record {
+	t.Helper()
+	users, err := pt.app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := core.NewRecord(users)
+	user.SetEmail(email)
+	user.SetPassword("password123")
+	if err := pt.app.Save(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func (pt *playlistTest) version(t *testing.T) int {
+	t.Helper()
+	playlist, err := pt.app.FindRecordById("Playlists", pt.playlist.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return playlist.GetInt("version")
+}
+
+func (pt *playlistTest) mutate(t *testing.T, c change) error {
+	t.Helper()
+	_, err := mutate(pt.app, pt.user, pt.playlist.Id, pt.version(t), c)
+	return err
+}
+
+// items returns the item ids in order and fails when the positions aren't
+// 0 to n-1
+func (pt *playlistTest) items(t *testing.T) (ids, tracks []string) {
+	t.Helper()
+	items, err := loadItems(pt.app, pt.playlist.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range items {
+		if pos := item.GetInt("position"); pos != i {
+			t.Fatalf("item %d has position %d", i, pos)
+		}
+		ids = append(ids, item.Id)
+		tracks = append(tracks, item.GetString("track"))
+	}
+	return ids, tracks
+}
+
+func at(i int) *int {
+	return &i
+}
+
+func TestMutateStaleVersion(t *testing.T) {
+	pt := newPlaylistTest(t, 2)
+	if err := pt.mutate(t, insertTracks(pt.user, pt.tracks[:1], nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client that still has version 1
+	_, err := mutate(pt.app, pt.user, pt.playlist.Id, 1, insertTracks(pt.user, pt.tracks[1:2], nil))
+	if !errors.Is(err, errConflict) {
+		t.Fatalf("got %v, want errConflict", err)
+	}
+	if _, tracks := pt.items(t); !slices.Equal(tracks, pt.tracks[:1]) {
+		t.Fatalf("stale change was applied, tracks %v", tracks)
+	}
+
+	rec := httptest.NewRecorder()
+	e := &core.RequestEvent{App: pt.app}
+	e.Response = rec
+	e.Request = httptest.NewRequest("POST", "/playlists/"+pt.playlist.Id+"/items", nil)
+	e.Request.SetPathValue("id", pt.playlist.Id)
+	if err := respondError(e, err); err != nil {
+		t.Fatal(err)
+	}
+	var body struct{ Version int }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != 409 || body.Version != 2 {
+		t.Fatalf("got %d %s, want 409 with version 2", rec.Code, rec.Body)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	pt := newPlaylistTest(t, 3)
+	if err := pt.mutate(t, insertTracks(pt.user, pt.tracks[:3], nil)); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := pt.items(t)
+
+	bad := map[string][]string{
+		"missing":   {ids[0], ids[1]},
+		"duplicate": {ids[0], ids[1], ids[1]},
+		"unknown":   {ids[0], ids[1], "nope"},
+		"extra":     {ids[0], ids[1], ids[2], ids[2]},
+		"empty":     nil,
+	}
+	for name, order := range bad {
+		if err := pt.mutate(t, reorderItems(order)); !errors.Is(err, errBadOrder) {
+			t.Errorf("%s: got %v, want errBadOrder", name, err)
+		}
+	}
+	if got, _ := pt.items(t); !slices.Equal(got, ids) {
+		t.Fatalf("a rejected reorder moved items, %v", got)
+	}
+
+	want := []string{ids[2], ids[0], ids[1]}
+	if err := pt.mutate(t, reorderItems(want)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := pt.items(t); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestInsertPosition(t *testing.T) {
+	pt := newPlaylistTest(t, 4)
+	a, b, c, d := pt.tracks[0], pt.tracks[1], pt.tracks[2], pt.tracks[3]
+	if err := pt.mutate(t, insertTracks(pt.user, []string{a, b}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pos := range []int{-1, 3} {
+		if err := pt.mutate(t, insertTracks(pt.user, []string{c}, at(pos))); !errors.Is(err, errBadPos) {
+			t.Errorf("position %d: got %v, want errBadPos", pos, err)
+		}
+	}
+
+	// the start, the middle and exactly the end are all fine
+	steps := []struct {
+		tracks []string
+		pos    int
+		want   []string
+	}{
+		{[]string{c}, 0, []string{c, a, b}},
+		{[]string{d, d}, 1, []string{c, d, d, a, b}},
+		{[]string{a}, 5, []string{c, d, d, a, b, a}},
+	}
+	for _, step := range steps {
+		if err := pt.mutate(t, insertTracks(pt.user, step.tracks, at(step.pos))); err != nil {
+			t.Fatalf("position %d: %v", step.pos, err)
+		}
+		if _, got := pt.items(t); !slices.Equal(got, step.want) {
+			t.Fatalf("position %d: got %v, want %v", step.pos, got, step.want)
+		}
+	}
+
+	// a track of someone else's fails the whole insert
+	private := pt.tracks[4]
+	if err := pt.mutate(t, insertTracks(pt.user, []string{a, private}, nil)); !errors.Is(err, errBadTrack) {
+		t.Fatalf("got %v, want errBadTrack", err)
+	}
+	if ids, _ := pt.items(t); len(ids) != 6 {
+		t.Fatalf("%d items after a failed insert, want 6", len(ids))
+	}
+}
+
+func TestRemoveKeepsPositionsGapless(t *testing.T) {
+	pt := newPlaylistTest(t, 4)
+	if err := pt.mutate(t, insertTracks(pt.user, pt.tracks[:4], nil)); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := pt.items(t)
+
+	// the middle, then the first, then the last
+	for _, i := range []int{1, 0, 1} {
+		if err := pt.mutate(t, removeItem(ids[i])); err != nil {
+			t.Fatal(err)
+		}
+		ids = slices.Delete(ids, i, i+1)
+		if got, _ := pt.items(t); !slices.Equal(got, ids) {
+			t.Fatalf("got %v, want %v", got, ids)
+		}
+	}
+
+	if err := pt.mutate(t, removeItem("nope")); !errors.Is(err, errNotFound) {
+		t.Fatalf("got %v, want errNotFound", err)
+	}
+}
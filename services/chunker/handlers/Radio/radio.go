@@ -0,0 +1,411 @@
+package radio
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/recommend"
+)
+
+// /radio?seed=<track or artist id> answers with the next tracks of an
+// endless queue and a cursor to ask for the ones after. the cursor keeps
+// what was queued recently so nothing comes back too soon, and the last
+// few of those help pick what follows so the queue drifts along instead of
+// circling the seed.
+//
+// tracks played in the same sessions come first, tracks sharing genres
+// with the seeds fill in for tracks nobody played yet, the most played
+// tracks when even that runs out
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+
+	// how much of the queue the cursor remembers
+	maxRecent = 50
+	// recently queued tracks that seed the next page, the newest weighs most
+	recentSeeds = 5
+	// only the best scored candidates are looked up
+	maxCandidates = 300
+	// genre matches score below co-listening of the same strength
+	genreWeight = 0.3
+	artistScore = 0.05
+
+	reasonCoListening = "co-listening"
+	reasonGenre       = "genre"
+	reasonArtist      = "artist"
+	reasonPopular     = "popular"
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+type radioCursor struct {
+	Seed       string   `json:"s"`
+	Recent     []string `json:"r"`
+	LastArtist string   `json:"a"`
+}
+
+type seedTrack struct {
+	File   string `db:"file"`
+	Artist string `db:"artist"`
+	Genres string `db:"genres"`
+}
+
+type trackRow struct {
+	File       string  `db:"file"`
+	Title      string  `db:"title"`
+	Duration   float64 `db:"duration"`
+	ArtistId   string  `db:"artist_id"`
+	ArtistName string  `db:"artist_name"`
+	AlbumId    string  `db:"album_id"`
+	AlbumTitle string  `db:"album_title"`
+}
+
+func Radio(e *core.RequestEvent, app *pocketbase.PocketBase, model *recommend.Model) error {
+	query := e.Request.URL.Query()
+	seed := query.Get("seed")
+	if seed == "" {
+		return e.String(400, "Missing seed")
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	limit = min(limit, maxLimit)
+
+	cursor := radioCursor{Seed: seed}
+	if raw := query.Get("cursor"); raw != "" {
+		if cursor, err = decodeCursor(raw); err != nil || cursor.Seed != seed {
+			return e.String(400, errBadCursor.Error())
+		}
+	}
+
+	seeds, err := resolveSeed(app, e.Auth, seed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e.String(404, "Seed not found")
+		}
+		return e.String(500, "Failed to resolve seed")
+	}
+
+	var picked []recommend.Candidate
+	var byFile map[string]trackRow
+	for {
+		// the recent tracks carry the queue on, they are seeds with less weight
+		weights := map[string]float64{}
+		for _, s := range seeds {
+			weights[s.File] = 1
+		}
+		w := 0.5
+		for i := len(cursor.Recent) - 1; i >= 0 && i >= len(cursor.Recent)-recentSeeds; i-- {
+			weights[cursor.Recent[i]] += w
+			w /= 2
+		}
+
+		exclude := map[string]bool{}
+		for _, id := range cursor.Recent {
+			exclude[id] = true
+		}
+		if len(seeds) == 1 && seeds[0].File == seed {
+			// the seed track is what is playing now, the first page shouldn't
+			// open with its artist
+			exclude[seed] = true
+			if cursor.LastArtist == "" && len(cursor.Recent) == 0 {
+				cursor.LastArtist = seeds[0].Artist
+			}
+		}
+
+		// the reason shown is whatever added the most to the score
+		scores := map[string]float64{}
+		reasons := map[string]string{}
+		biggest := map[string]float64{}
+		add := func(id string, score float64, reason string) {
+			if exclude[id] || score <= 0 {
+				return
+			}
+			if score > biggest[id] {
+				biggest[id], reasons[id] = score, reason
+			}
+			scores[id] += score
+		}
+
+		for id, weight := range weights {
+			for other, similarity := range model.Similar(id) {
+				add(other, weight*similarity, reasonCoListening)
+			}
+		}
+
+		if err := addSimilarTags(app, e.Auth, seeds, add); err != nil {
+			return e.String(500, "Failed to fetch similar tracks")
+		}
+		if len(scores) < limit*2 {
+			if err := addPopular(app, e.Auth, limit*2+len(exclude), add); err != nil {
+				return e.String(500, "Failed to fetch popular tracks")
+			}
+		}
+
+		rows, err := lookupTracks(app, e.Auth, best(scores, maxCandidates))
+		if err != nil {
+			return e.String(500, "Failed to fetch tracks")
+		}
+
+		candidates := make([]recommend.Candidate, 0, len(rows))
+		byFile = make(map[string]trackRow, len(rows))
+		for _, r := range rows {
+			byFile[r.File] = r
+			candidates = append(candidates, recommend.Candidate{
+				Track:  r.File,
+				Artist: r.ArtistId,
+				Score:  scores[r.File],
+				Reason: reasons[r.File],
+			})
+		}
+		picked = recommend.Diversify(candidates, cursor.LastArtist, limit)
+		if len(picked) > 0 || len(cursor.Recent) == 0 {
+			break
+		}
+		// everything that could come next was queued recently, the oldest
+		// half of it comes around again
+		cursor.Recent = cursor.Recent[max(1, len(cursor.Recent)/2):]
+	}
+
+	items := make([]map[string]interface{}, 0, len(picked))
+	for _, c := range picked {
+		r := byFile[c.Track]
+		item := map[string]interface{}{
+			"id":       r.File,
+			"title":    r.Title,
+			"duration": r.Duration,
+			"artist":   map[string]string{"id": r.ArtistId, "name": r.ArtistName},
+			"score":    c.Score,
+			"reason":   c.Reason,
+		}
+		if r.AlbumId != "" {
+			item["album"] = map[string]string{"id": r.AlbumId, "title": r.AlbumTitle}
+		}
+		items = append(items, item)
+
+		cursor.Recent = append(cursor.Recent, c.Track)
+		cursor.LastArtist = c.Artist
+	}
+	if len(cursor.Recent) > maxRecent {
+		cursor.Recent = cursor.Recent[len(cursor.Recent)-maxRecent:]
+	}
+
+	// an empty page means the library ran dry, a cursor would only repeat it
+	nextCursor := ""
+	if len(items) > 0 {
+		nextCursor = encodeCursor(cursor)
+	}
+	return e.JSON(200, map[string]interface{}{
+		"items":      items,
+		"nextCursor": nextCursor,
+	})
+}
+
+// resolveSeed turns the seed into the tracks the queue starts from, the
+// track itself or the most played tracks of an artist
+func resolveSeed(app *pocketbase.PocketBase, auth *core.Record, seed string) ([]seedTrack, error) {
+	seeds := []seedTrack{}
+	err := app.DB().
+		Select("f.id AS file", "t.artist", "t.genres").
+		From("UploadedFiles f").
+		InnerJoin("Tracks t", dbx.NewExp("t.file = f.id")).
+		Where(dbx.HashExp{"f.id": seed}).
+		AndWhere(access.ListenFilter(auth, "f")).
+		All(&seeds)
+	if err != nil || len(seeds) > 0 {
+		return seeds, err
+	}
+
+	if _, err := app.FindRecordById("Artists", seed); err != nil {
+		return nil, err
+	}
+	err = app.DB().
+		Select("f.id AS file", "t.artist", "t.genres").
+		From("Tracks t").
+		InnerJoin("UploadedFiles f", dbx.NewExp("f.id = t.file")).
+		LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+		Where(dbx.NewExp("(t.artist = {:artist} OR al.artist = {:artist})", dbx.Params{"artist": seed})).
+		AndWhere(dbx.HashExp{"f.processed": true}).
+		AndWhere(access.FileFilter(auth, "f")).
+		OrderBy("t.play_count DESC", "f.id ASC").
+		Limit(10).
+		All(&seeds)
+	if err != nil {
+		return nil, err
+	}
+	if len(seeds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return seeds, nil
+}
+
+// addSimilarTags scores tracks by how many genres they share with the
+// seeds, and tracks by the seeds' artists a little when nothing else is
+// known about them
+func addSimilarTags(app *pocketbase.PocketBase, auth *core.Record, seeds []seedTrack, add func(string, float64, string)) error {
+	genres := map[string]bool{}
+	artists := []interface{}{}
+	for _, s := range seeds {
+		for _, g := range decodeGenres(s.Genres) {
+			genres[g] = true
+		}
+		artists = append(artists, s.Artist)
+	}
+
+	if len(genres) > 0 {
+		placeholders := ""
+		params := dbx.Params{}
+		for g := range genres {
+			name := "genre" + strconv.Itoa(len(params))
+			if placeholders != "" {
+				placeholders += ", "
+			}
+			placeholders += "{:" + name + "}"
+			params[name] = g
+		}
+		rows := []seedTrack{}
+		err := candidateTracks(app, auth).
+			AndWhere(dbx.NewExp("EXISTS (SELECT 1 FROM json_each(t.genres) WHERE LOWER(json_each.value) IN ("+placeholders+"))", params)).
+			Limit(maxCandidates).
+			All(&rows)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			add(r.File, genreWeight*jaccard(genres, decodeGenres(r.Genres)), reasonGenre)
+		}
+	}
+
+	rows := []seedTrack{}
+	err := candidateTracks(app, auth).
+		AndWhere(dbx.In("t.artist", artists...)).
+		Limit(maxCandidates).
+		All(&rows)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		add(r.File, artistScore, reasonArtist)
+	}
+	return nil
+}
+
+func addPopular(app *pocketbase.PocketBase, auth *core.Record, n int, add func(string, float64, string)) error {
+	rows := []seedTrack{}
+	err := candidateTracks(app, auth).Limit(int64(n)).All(&rows)
+	if err != nil {
+		return err
+	}
+	// below everything else, in play count order
+	for i, r := range rows {
+		add(r.File, 0.001/float64(i+1), reasonPopular)
+	}
+	return nil
+}
+
+// candidateTracks are the tracks the user may get in a radio queue, most
+// played first
+func candidateTracks(app *pocketbase.PocketBase, auth *core.Record) *dbx.SelectQuery {
+	return app.DB().
+		Select("f.id AS file", "t.artist", "t.genres").
+		From("Tracks t").
+		InnerJoin("UploadedFiles f", dbx.NewExp("f.id = t.file")).
+		Where(dbx.HashExp{"f.processed": true}).
+		AndWhere(access.FileFilter(auth, "f")).
+		OrderBy("t.play_count DESC", "f.id ASC")
+}
+
+func lookupTracks(app *pocketbase.PocketBase, auth *core.Record, files []string) ([]trackRow, error) {
+	rows := []trackRow{}
+	if len(files) == 0 {
+		return rows, nil
+	}
+	ids := make([]interface{}, 0, len(files))
+	for _, id := range files {
+		ids = append(ids, id)
+	}
+	err := app.DB().
+		Select(
+			"f.id AS file", "t.title", "f.duration",
+			"a.id AS artist_id", "a.name AS artist_name",
+			"COALESCE(al.id, '') AS album_id", "COALESCE(al.title, '') AS album_title",
+		).
+		From("Tracks t").
+		InnerJoin("UploadedFiles f", dbx.NewExp("f.id = t.file")).
+		InnerJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+		LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+		Where(dbx.In("f.id", ids...)).
+		AndWhere(dbx.HashExp{"f.processed": true}).
+		AndWhere(access.FileFilter(auth, "f")).
+		All(&rows)
+	return rows, err
+}
+
+// best returns the n highest scored ids
+func best(scores map[string]float64, n int) []string {
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		switch {
+		case scores[a] > scores[b]:
+			return -1
+		case scores[a] < scores[b]:
+			return 1
+		}
+		return 0
+	})
+	return ids[:min(n, len(ids))]
+}
+
+func jaccard(set map[string]bool, genres []string) float64 {
+	if len(set) == 0 || len(genres) == 0 {
+		return 0
+	}
+	shared := 0
+	for _, g := range genres {
+		if set[g] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(set)+len(genres)-shared)
+}
+
+// decodeGenres lowercases them too, "Rock" and "rock" are the same genre
+func decodeGenres(raw string) []string {
+	genres := []string{}
+	json.Unmarshal([]byte(raw), &genres)
+	for i, g := range genres {
+		genres[i] = strings.ToLower(g)
+	}
+	return genres
+}
+
+func encodeCursor(c radioCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(raw string) (radioCursor, error) {
+	var c radioCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Seed == "" {
+		return c, errBadCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,127 @@
+package scrobble
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/scrobbler"
+)
+
+// the token never comes back out, the client only learns whether the
+// account works and how much is still waiting to be sent
+
+type accountBody struct {
+	Token string `json:"token"`
+}
+
+// Accounts lists the user's linked services
+func Accounts(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	if e.Auth.IsSuperuser() {
+		return e.String(403, "Forbidden")
+	}
+
+	accounts, err := app.FindAllRecords("ScrobbleAccounts", dbx.HashExp{"user": e.Auth.Id})
+	if err != nil {
+		return e.String(500, "Failed to fetch accounts")
+	}
+
+	result := make([]map[string]interface{}, 0, len(accounts))
+	for _, account := range accounts {
+		pending, err := app.CountRecords("ScrobbleOutbox", dbx.HashExp{"account": account.Id})
+		if err != nil {
+			return e.String(500, "Failed to fetch accounts")
+		}
+		result = append(result, accountJSON(account, pending))
+	}
+	return e.JSON(200, map[string]interface{}{
+		"services": scrobbler.Services,
+		"accounts": result,
+	})
+}
+
+// Link stores the token for a service, linking an account again also sends
+// whatever got stuck while the old token was refused
+func Link(e *core.RequestEvent, app *pocketbase.PocketBase, sb *scrobbler.Bridge) error {
+	if e.Auth.IsSuperuser() {
+		return e.String(403, "Forbidden")
+	}
+	service := e.Request.PathValue("service")
+	if !slices.Contains(scrobbler.Services, service) {
+		return e.String(404, "Unknown service")
+	}
+
+	var body accountBody
+	if err := e.BindBody(&body); err != nil {
+		return e.String(400, "Invalid request")
+	}
+	body.Token = strings.TrimSpace(body.Token)
+	if body.Token == "" {
+		return e.String(400, "Missing token")
+	}
+
+	account, err := findAccount(app, e.Auth.Id, service)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return e.String(500, "Failed to fetch account")
+	}
+	if account == nil {
+		collection, err := app.FindCollectionByNameOrId("ScrobbleAccounts")
+		if err != nil {
+			return e.String(500, "Failed to find collection")
+		}
+		account = core.NewRecord(collection)
+		account.Set("user", e.Auth.Id)
+		account.Set("service", service)
+	}
+	account.Set("token", body.Token)
+	account.Set("enabled", true)
+	account.Set("last_error", "")
+	if err := app.Save(account); err != nil {
+		return e.String(400, "Invalid token")
+	}
+
+	if err := sb.Resume(app, account.Id); err != nil {
+		app.Logger().Warn("Scrobbler", "message", "Failed to resume outbox", "account", account.Id, "error", err)
+	}
+
+	pending, _ := app.CountRecords("ScrobbleOutbox", dbx.HashExp{"account": account.Id})
+	return e.JSON(200, accountJSON(account, pending))
+}
+
+// Unlink removes the account, listens still queued for it go with it
+func Unlink(e *core.RequestEvent, app *pocketbase.PocketBase) error {
+	if e.Auth.IsSuperuser() {
+		return e.String(403, "Forbidden")
+	}
+	account, err := findAccount(app, e.Auth.Id, e.Request.PathValue("service"))
+	if err != nil {
+		return e.String(404, "Account not found")
+	}
+	if err := app.Delete(account); err != nil {
+		return e.String(500, "Failed to delete account")
+	}
+	return e.NoContent(204)
+}
+
+func findAccount(app *pocketbase.PocketBase, userId, service string) (*core.Record, error) {
+	return app.FindFirstRecordByFilter(
+		"ScrobbleAccounts",
+		"user = {:user} && service = {:service}",
+		dbx.Params{"user": userId, "service": service},
+	)
+}
+
+func accountJSON(account *core.Record, pending int64) map[string]interface{} {
+	return map[string]interface{}{
+		"service":   account.GetString("service"),
+		"enabled":   account.GetBool("enabled"),
+		"lastError": account.GetString("last_error"),
+		"pending":   pending,
+		"created":   account.GetDateTime("created"),
+		"updated":   account.GetDateTime("updated"),
+	}
+}
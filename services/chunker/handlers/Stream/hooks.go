@@ -0,0 +1,18 @@
+package stream
+
+import (
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// BindHooks keeps the track records cached by the stream handlers in sync,
+// a track that was cached before it finished processing would otherwise
+// stay unplayable until the entry expires
+func BindHooks(app core.App, c *cache.Cache) {
+	invalidate := func(e *core.RecordEvent) error {
+		c.Delete("UploadedFiles_" + e.Record.Id)
+		return e.Next()
+	}
+	app.OnRecordAfterUpdateSuccess("UploadedFiles").BindFunc(invalidate)
+	app.OnRecordAfterDeleteSuccess("UploadedFiles").BindFunc(invalidate)
+}
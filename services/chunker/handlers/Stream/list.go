@@ -0,0 +1,290 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/favorites"
+)
+
+// the listing is paged with a cursor instead of an offset so pages don't
+// shift while tracks are added. the cursor holds the sort value and id of
+// the last item of a page and the next page starts right after them.
+//
+//	?sort=-added|title|plays|duration   "-" sorts descending, default -added
+//	?artist= ?album= ?genre= ?format=
+//	?added_after= ?added_before=        dates, "2024-01-31" or RFC 3339
+//	?min_duration= ?max_duration=       seconds
+//	?favorited=true|false ?min_rating=  the caller's own likes and ratings
+//	?perPage= ?cursor=
+
+const (
+	defaultListPerPage = 50
+	maxListPerPage     = 500
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// sortColumns are sql expressions over UploadedFiles f and Tracks t
+var sortColumns = map[string]string{
+	"title":    "COALESCE(t.title, f.file_name) COLLATE NOCASE",
+	"added":    "f.created",
+	"plays":    "COALESCE(t.play_count, 0)",
+	"duration": "f.duration",
+}
+
+type listCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	Id    string      `json:"i"`
+}
+
+type songRow struct {
+	Id        string         `db:"id"`
+	Name      string         `db:"file_name"`
+	Size      int64          `db:"file_size"`
+	Format    string         `db:"format"`
+	Duration  float64        `db:"duration"`
+	Created   types.DateTime `db:"created"`
+	Title     string         `db:"title"`
+	ArtistId  string         `db:"artist_id"`
+	Artist    string         `db:"artist_name"`
+	AlbumId   string         `db:"album_id"`
+	Album     string         `db:"album_title"`
+	PlayCount int            `db:"play_count"`
+	Favorites int            `db:"favorite_count"`
+	Favorite  bool           `db:"favorite"`
+	Rating    int            `db:"rating"`
+	SortKey   interface{}    `db:"sort_key"`
+}
+
+func ListAllSongs(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache) error {
+	query := e.Request.URL.Query()
+
+	sortParam := query.Get("sort")
+	if sortParam == "" {
+		sortParam = "-added"
+	}
+	desc := strings.HasPrefix(sortParam, "-")
+	sortColumn, ok := sortColumns[strings.TrimPrefix(sortParam, "-")]
+	if !ok {
+		return e.String(400, "Invalid sort")
+	}
+
+	perPage, err := strconv.Atoi(query.Get("perPage"))
+	if err != nil || perPage <= 0 {
+		perPage = defaultListPerPage
+	}
+	perPage = min(perPage, maxListPerPage)
+
+	q := app.DB().
+		Select(
+			"f.id", "f.file_name", "f.file_size", "f.format", "f.duration", "f.created",
+			"COALESCE(t.title, '') AS title",
+			"COALESCE(a.id, '') AS artist_id", "COALESCE(a.name, '') AS artist_name",
+			"COALESCE(al.id, '') AS album_id", "COALESCE(al.title, '') AS album_title",
+			"COALESCE(t.play_count, 0) AS play_count",
+			"COALESCE(t.favorite_count, 0) AS favorite_count",
+			"COALESCE(fv.favorite, FALSE) AS favorite", "COALESCE(fv.rating, 0) AS rating",
+			sortColumn+" AS sort_key",
+		).
+		From("UploadedFiles f").
+		LeftJoin("Tracks t", dbx.NewExp("t.file = f.id")).
+		LeftJoin("Artists a", dbx.NewExp("a.id = t.artist")).
+		LeftJoin("Albums al", dbx.NewExp("al.id = t.album")).
+		LeftJoin("Favorites fv", dbx.NewExp("fv.track = f.id AND fv.user = {:favoriteUser}", dbx.Params{"favoriteUser": e.Auth.Id})).
+		Where(dbx.HashExp{"f.processed": true}).
+		AndWhere(access.FileFilter(e.Auth, "f"))
+
+	filters, err := listFilters(query.Get)
+	if err != nil {
+		return e.String(400, err.Error())
+	}
+	for _, f := range filters {
+		q.AndWhere(f)
+	}
+
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil || cursor.Sort != sortParam {
+			return e.String(400, errBadCursor.Error())
+		}
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		q.AndWhere(dbx.NewExp(
+			"("+sortColumn+" "+op+" {:cursorValue} OR ("+sortColumn+" = {:cursorValue} AND f.id "+op+" {:cursorId}))",
+			dbx.Params{"cursorValue": cursor.Value, "cursorId": cursor.Id},
+		))
+	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	rows := []songRow{}
+	// one extra row tells whether there is a next page
+	err = q.OrderBy("sort_key "+direction, "f.id "+direction).Limit(int64(perPage + 1)).All(&rows)
+	if err != nil {
+		return e.String(500, "Failed to fetch songs")
+	}
+
+	nextCursor := ""
+	if len(rows) > perPage {
+		rows = rows[:perPage]
+		last := rows[len(rows)-1]
+		nextCursor = encodeCursor(listCursor{Sort: sortParam, Value: last.SortKey, Id: last.Id})
+	}
+
+	songs := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		song := map[string]interface{}{
+			"id":        r.Id,
+			"name":      r.Name,
+			"size":      r.Size,
+			"format":    r.Format,
+			"duration":  r.Duration,
+			"createdAt": r.Created,
+			"plays":     r.PlayCount,
+			"favorites": r.Favorites,
+			"favorite":  r.Favorite,
+			"rating":    r.Rating,
+		}
+		if r.Title != "" {
+			song["title"] = r.Title
+		}
+		if r.ArtistId != "" {
+			song["artist"] = map[string]string{"id": r.ArtistId, "name": r.Artist}
+		}
+		if r.AlbumId != "" {
+			song["album"] = map[string]string{"id": r.AlbumId, "title": r.Album}
+		}
+		songs = append(songs, song)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"items":      songs,
+		"nextCursor": nextCursor,
+	})
+	if err != nil {
+		return e.String(500, "Failed to encode songs")
+	}
+
+	// the page is the etag, a client revalidating an unchanged page only
+	// gets the 304
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+	e.Response.Header().Set("ETag", etag)
+	e.Response.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(e.Request.Header.Get("If-None-Match"), etag) {
+		return e.NoContent(304)
+	}
+	return e.Blob(200, "application/json", body)
+}
+
+func listFilters(get func(string) string) ([]dbx.Expression, error) {
+	var filters []dbx.Expression
+
+	if artist := get("artist"); artist != "" {
+		// the track artist or the album artist
+		filters = append(filters, dbx.NewExp("(t.artist = {:artist} OR al.artist = {:artist})", dbx.Params{"artist": artist}))
+	}
+	if album := get("album"); album != "" {
+		filters = append(filters, dbx.HashExp{"t.album": album})
+	}
+	if genre := get("genre"); genre != "" {
+		filters = append(filters, dbx.NewExp(
+			"EXISTS (SELECT 1 FROM json_each(t.genres) WHERE json_each.value = {:genre} COLLATE NOCASE)",
+			dbx.Params{"genre": genre},
+		))
+	}
+	if format := get("format"); format != "" {
+		filters = append(filters, dbx.HashExp{"f.format": strings.ToLower(format)})
+	}
+
+	for param, op := range map[string]string{"added_after": ">=", "added_before": "<"} {
+		value := get(param)
+		if value == "" {
+			continue
+		}
+		date, err := types.ParseDateTime(value)
+		if err != nil || date.IsZero() {
+			return nil, errors.New("invalid " + param)
+		}
+		filters = append(filters, dbx.NewExp("f.created "+op+" {:"+param+"}", dbx.Params{param: date.String()}))
+	}
+
+	for param, op := range map[string]string{"min_duration": ">=", "max_duration": "<="} {
+		value := get(param)
+		if value == "" {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return nil, errors.New("invalid " + param)
+		}
+		filters = append(filters, dbx.NewExp("f.duration "+op+" {:"+param+"}", dbx.Params{param: seconds}))
+	}
+
+	switch get("favorited") {
+	case "":
+	case "true":
+		filters = append(filters, dbx.NewExp("fv.favorite = TRUE"))
+	case "false":
+		filters = append(filters, dbx.NewExp("COALESCE(fv.favorite, FALSE) = FALSE"))
+	default:
+		return nil, errors.New("invalid favorited")
+	}
+	if value := get("min_rating"); value != "" {
+		rating, err := strconv.Atoi(value)
+		if err != nil || rating < 1 || rating > favorites.MaxRating {
+			return nil, errors.New("invalid min_rating")
+		}
+		filters = append(filters, dbx.NewExp("fv.rating >= {:min_rating}", dbx.Params{"min_rating": rating}))
+	}
+
+	return filters, nil
+}
+
+func encodeCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(raw string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Id == "" {
+		return c, errBadCursor
+	}
+	return c, nil
+}
+
+// etagMatches handles "*" and lists of tags in If-None-Match
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// range handling follows RFC 7233, the rules mirror what net/http's
+// ServeContent does so browsers and media players behave the same way
+
+var (
+	errInvalidRange  = errors.New("invalid range")
+	errUnsatisfiable = errors.New("range not satisfiable")
+)
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange returns the ranges of a Range header value for a resource of
+// the given size. no ranges means the whole resource should be sent
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		// a unit we don't understand is ignored, not rejected
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startStr, endStr = textproto.TrimString(startStr), textproto.TrimString(endStr)
+
+		var r byteRange
+		if startStr == "" {
+			// suffix range, the last N bytes
+			if endStr == "" || endStr[0] == '-' {
+				return nil, errInvalidRange
+			}
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+			if endStr == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(endStr, 10, 64)
+				if err != nil || start > end {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errUnsatisfiable
+		}
+		return nil, errInvalidRange
+	}
+
+	// asking for more bytes than the file has in many small ranges is not
+	// something a player does, send the whole file instead
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether a conditional range request still refers
+// to the current representation, when it doesn't the full body is sent
+func ifRangeMatches(ifRange string, etag string, modified time.Time) bool {
+	ifRange = textproto.TrimString(ifRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// If-Range needs a strong comparison, weak tags never match
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return t.Unix() == modified.Unix()
+}
+
+// multipartSize is the Content-Length of a multipart/byteranges body
+func multipartSize(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	mw.SetBoundary(boundary)
+	var total int64
+	for _, r := range ranges {
+		mw.CreatePart(rangePartHeader(r, contentType, size))
+		total += r.length
+	}
+	mw.Close()
+	return total + int64(counter)
+}
+
+func rangePartHeader(r byteRange, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// writeMultipart sends every range as its own part, copyRange fills the body
+func writeMultipart(w io.Writer, ranges []byteRange, contentType string, size int64, boundary string, copyRange func(io.Writer, byteRange) error) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(rangePartHeader(r, contentType, size))
+		if err != nil {
+			return err
+		}
+		if err := copyRange(part, r); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"items=0-5", nil, nil},
+		{"bytes=0-499", []byteRange{{0, 500}}, nil},
+		{"bytes=500-", []byteRange{{500, 500}}, nil},
+		{"bytes=-200", []byteRange{{800, 200}}, nil},
+		{"bytes=-5000", []byteRange{{0, size}}, nil},
+		{"bytes=900-5000", []byteRange{{900, 100}}, nil},
+		{"bytes= 0-9 , 20-29", []byteRange{{0, 10}, {20, 10}}, nil},
+		{"bytes=0-9,5000-", []byteRange{{0, 10}}, nil},
+		// more than the file in total, the whole file goes out instead
+		{"bytes=0-999,0-999", nil, nil},
+
+		{"bytes=1000-", nil, errUnsatisfiable},
+		{"bytes=5000-6000", nil, errUnsatisfiable},
+		{"bytes=-0", nil, errUnsatisfiable},
+
+		{"bytes=", nil, errInvalidRange},
+		{"bytes=abc", nil, errInvalidRange},
+		{"bytes=5-1", nil, errInvalidRange},
+		{"bytes=-", nil, errInvalidRange},
+		{"bytes=--5", nil, errInvalidRange},
+		{"bytes=x-5", nil, errInvalidRange},
+		{"bytes=0-9,x", nil, errInvalidRange},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, size)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parseRange(%q) error = %v, want %v", tt.header, err, tt.err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
+)
+
+// chunk files that aren't in memory are handed to the connection as files,
+// net/http then lets the kernel copy them straight to the socket
+// (sendfile/splice) instead of pushing every byte through a userspace
+// buffer. that only works when nothing between us and the connection looks
+// at the body, any middleware wrapping the writer (gzip and the like) gets
+// the plain io.Copy path instead
+
+// canSendFile reports whether w is net/http's own writer, at most wrapped by
+// pocketbase's status tracking which passes ReadFrom through untouched
+func canSendFile(w http.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case *router.ResponseWriter:
+			w = rw.ResponseWriter
+		case router.RWUnwrapper:
+			// an unknown wrapper, its ReadFrom could skip its own Write
+			return false
+		default:
+			_, ok := w.(io.ReaderFrom)
+			return ok
+		}
+	}
+}
+
+// sendChunks writes r of the track chunk by chunk, cached chunks straight
+// from memory and the rest as files. a chunk sent as a file is read into
+// the cache afterwards, it was just read so that comes from the page cache
+// and the next listener gets it from memory
+func sendChunks(w io.Writer, index *chunkindex.Index, cc *chunkcache.Cache, r byteRange) error {
+	i, ok := index.ChunkAt(r.start)
+	if !ok {
+		return io.ErrUnexpectedEOF
+	}
+
+	off, remaining := r.start, r.length
+	for remaining > 0 {
+		if i >= index.Len() {
+			return io.ErrUnexpectedEOF
+		}
+		chunk := index.Chunk(i)
+		n := min(remaining, chunk.Offset+chunk.Size-off)
+
+		var err error
+		if cc != nil && cc.Contains(chunk.Path) {
+			var data []byte
+			if data, err = cc.Get(chunk.Path); err == nil {
+				_, err = w.Write(data[off-chunk.Offset:][:n])
+			}
+		} else if err = sendFile(w, chunk.Path, off-chunk.Offset, n); err == nil && cc != nil {
+			// the bytes are out already, a failed load only costs the next read
+			cc.Load(chunk.Path, chunk.Size)
+		}
+		if err != nil {
+			return err
+		}
+
+		off += n
+		remaining -= n
+		i++
+	}
+	return nil
+}
+
+// sendFile copies n bytes of the file at path starting at off. the
+// LimitedReader over an *os.File is what net/http's ReadFrom knows how to sendfile
+func sendFile(w io.Writer, path string, off, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := io.Copy(w, io.LimitReader(f, n))
+	if err != nil {
+		return err
+	}
+	if written < n {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+//go:build unix
+
+package stream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+)
+
+// the track goes out over real connections to concurrent clients, the copy
+// benchmark hides ReadFrom so every byte passes through a userspace buffer.
+// cpu-ns/B is the process' user and system time per byte sent, the clients
+// run in the same process and add the same share to every benchmark
+func benchmarkSend(b *testing.B, cc *chunkcache.Cache, sendfile bool) {
+	const size = 16 << 20
+	index := writeChunks(b, b.TempDir(), testData(size), 1<<20)
+	r := byteRange{0, size}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body io.Writer = w
+		if !sendfile {
+			body = struct{ io.Writer }{w}
+		}
+		if err := sendChunks(body, index, cc, r); err != nil {
+			b.Error(err)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+	defer client.CloseIdleConnections()
+
+	b.SetBytes(size)
+	b.SetParallelism(4)
+	start := cpuTime(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil || n != size {
+				b.Errorf("got %d bytes: %v", n, err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime(b)-start)/(float64(b.N)*size), "cpu-ns/B")
+}
+
+// cpuTime is the user and system time the process used so far
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func BenchmarkSendCopy(b *testing.B) {
+	benchmarkSend(b, nil, false)
+}
+
+func BenchmarkSendFile(b *testing.B) {
+	benchmarkSend(b, nil, true)
+}
+
+func BenchmarkSendCached(b *testing.B) {
+	benchmarkSend(b, chunkcache.New(64<<20), true)
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
+)
+
+// writeChunks splits data into chunk files of chunkSize in dir
+func writeChunks(tb testing.TB, dir string, data []byte, chunkSize int) *chunkindex.Index {
+	tb.Helper()
+	collection := core.NewBaseCollection("ChunkedFiles")
+	var records []*core.Record
+	for off := 0; off < len(data); off += chunkSize {
+		part := data[off:min(off+chunkSize, len(data))]
+		path := filepath.Join(dir, fmt.Sprintf("chunk%d", len(records)))
+		if err := os.WriteFile(path, part, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		record := core.NewRecord(collection)
+		record.Id = fmt.Sprintf("chunk%d", len(records))
+		record.Set("chunk_path", path)
+		record.Set("start_byte_offset", off)
+		record.Set("chunk_size", len(part))
+		records = append(records, record)
+	}
+	return chunkindex.Build("track", records)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestSendChunks(t *testing.T) {
+	data := testData(10_000)
+	index := writeChunks(t, t.TempDir(), data, 1000)
+
+	tests := []byteRange{
+		{0, 10_000},
+		{0, 1},
+		{999, 2},
+		{1500, 3000},
+		{9999, 1},
+	}
+	for _, r := range tests {
+		cc := chunkcache.New(1 << 20)
+		// a first pass from the files, a second one from memory
+		for pass := 0; pass < 2; pass++ {
+			var buf bytes.Buffer
+			if err := sendChunks(&buf, index, cc, r); err != nil {
+				t.Fatalf("%v pass %d: %v", r, pass, err)
+			}
+			if !bytes.Equal(buf.Bytes(), data[r.start:r.start+r.length]) {
+				t.Fatalf("%v pass %d: wrong bytes", r, pass)
+			}
+		}
+		first, _ := index.ChunkAt(r.start)
+		last, _ := index.ChunkAt(r.start + r.length - 1)
+		touched := uint64(last - first + 1)
+		if stats := cc.Stats(); stats.Misses != touched || stats.Hits != touched || stats.Entries != int(touched) {
+			t.Errorf("%v: %+v, want %d misses, hits and entries", r, stats, touched)
+		}
+	}
+}
+
+func TestSendChunksOverBudget(t *testing.T) {
+	data := testData(4000)
+	index := writeChunks(t, t.TempDir(), data, 1000)
+	cc := chunkcache.New(500)
+
+	var buf bytes.Buffer
+	if err := sendChunks(&buf, index, cc, byteRange{0, 4000}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("wrong bytes")
+	}
+	if stats := cc.Stats(); stats.Misses != 4 || stats.Entries != 0 {
+		t.Errorf("%+v, want 4 misses and nothing kept", stats)
+	}
+}
@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/signedurl"
+	"github.com/rudyrdx/music-streamer/chunker/totp"
+)
+
+// SignURL hands out a /stream url that works without headers until it
+// expires. query params:
+//
+//	id        track to sign for (required)
+//	user      user the url is bound to, only honoured for the frontend and superusers
+//	ip        only accept the url from this client address
+//	rendition rendition the url may fetch
+//	ttl       lifetime in seconds, capped at maxTTL
+func SignURL(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache, key *totp.Secret, maxTTL time.Duration) error {
+	if key == nil {
+		return e.String(404, "Signed urls are disabled")
+	}
+
+	q := e.Request.URL.Query()
+	_id := q.Get("id")
+	if _id == "" {
+		return e.String(400, "Invalid request")
+	}
+
+	track, err := helpers.LookupFromCacheOrDB(c, "UploadedFiles_"+_id, func() (*core.Record, error) {
+		return app.FindRecordById("UploadedFiles", _id)
+	}, cache.DefaultExpiration)
+	if err != nil || !track.GetBool("processed") {
+		return e.String(400, "Invalid request")
+	}
+	if !supportedRendition(q.Get("rendition")) {
+		return e.String(400, "Unsupported rendition")
+	}
+
+	ttl := maxTTL
+	if v := q.Get("ttl"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return e.String(400, "Invalid ttl")
+		}
+		ttl = min(maxTTL, time.Duration(seconds)*time.Second)
+	}
+
+	// only the frontend (proven by its totp token) and superusers may sign
+	// for someone else, anybody else gets a url bound to themselves
+	var user *core.Record
+	if e.Auth != nil && !e.Auth.IsSuperuser() {
+		user = e.Auth
+	} else if e.Get(totp.Header) == true || e.HasSuperuserAuth() {
+		// listening needs a user, a url without one would never play
+		userId := q.Get("user")
+		if userId == "" {
+			return e.String(400, "Missing user")
+		}
+		if user, err = app.FindRecordById("users", userId); err != nil {
+			return e.String(400, "Unknown user")
+		}
+	} else {
+		return e.String(400, "Missing user")
+	}
+	// the url would be refused on /stream anyway, it isn't handed out
+	if !access.CanListen(user, track) {
+		return e.String(403, "Forbidden")
+	}
+
+	expires := time.Now().Add(ttl)
+	signed := signedurl.Sign(*key, signedurl.Params{
+		TrackId:   track.Id,
+		UserId:    user.Id,
+		Expires:   expires,
+		IP:        q.Get("ip"),
+		Rendition: q.Get("rendition"),
+	})
+
+	return e.JSON(200, map[string]interface{}{
+		"url":     "/stream?" + signed.Encode(),
+		"expires": expires.Unix(),
+	})
+}
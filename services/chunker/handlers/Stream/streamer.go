@@ -1,17 +1,27 @@
 package stream
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/patrickmn/go-cache"
-	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/audio"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
+	"github.com/rudyrdx/music-streamer/chunker/chunkio"
 	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+	"github.com/rudyrdx/music-streamer/chunker/prefetch"
+	"github.com/rudyrdx/music-streamer/chunker/ratelimit"
 )
 
 func GetChunkData(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache) error {
@@ -27,31 +37,30 @@ func GetChunkData(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cac
 		return e.String(500, "Failed to find collection")
 	}
 
-	record, err := helpers.LookupFromCacheOrDB(c, param, func() (*core.Record, error) {
+	record, err := helpers.LookupFromCacheOrDB(c, "UploadedFiles_"+param, func() (*core.Record, error) {
 		return app.FindRecordById(col, param)
 	}, cache.DefaultExpiration)
 	if err != nil {
 		return e.String(400, "Invalid request")
 	}
+	if !access.CanListen(e.Auth, record) {
+		return e.String(403, "Forbidden")
+	}
 
-	chunks, err := helpers.LookupFromCacheOrDB(c, "ChunkedFiles_"+record.Id, func() ([]*core.Record, error) {
-		return app.FindAllRecords("ChunkedFiles", dbx.HashExp{"file": record.Id})
-	}, cache.DefaultExpiration)
+	index, err := chunkindex.Lookup(app, c, record.Id)
 	if err != nil {
 		return e.String(500, "Failed to find chunks")
 	}
 
 	metadataChunks := make(map[int]interface{})
-	for _, chunk := range chunks {
-		order := chunk.GetInt("chunk_order")
-		size := chunk.GetInt("chunk_size")
-		sOffset := float64(chunk.GetInt("start_byte_offset"))
-		eOffset := float64(chunk.GetInt("end_byte_offset"))
-		metadataChunks[order] = map[string]interface{}{
-			"id":          chunk.Id,
-			"size":        size,
-			"startOffset": sOffset,
-			"endOffset":   eOffset,
+	for i := 0; i < index.Len(); i++ {
+		chunk := index.Chunk(i)
+		metadataChunks[i+1] = map[string]interface{}{
+			"id":          index.ChunkId(i),
+			"size":        chunk.Size,
+			"startOffset": float64(chunk.Offset),
+			"endOffset":   float64(chunk.Offset + chunk.Size - 1),
+			"startSample": index.StartSample(i),
 		}
 	}
 
@@ -60,7 +69,6 @@ func GetChunkData(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cac
 		"chunks":   metadataChunks,
 	}
 
-	e.Response.Header().Set("Access-Control-Allow-Origin", "*")
 	return e.JSON(200, metadata)
 }
 
@@ -76,18 +84,33 @@ func HandleChunkRequest(e *core.RequestEvent, app *pocketbase.PocketBase, c *cac
 		return e.String(400, "Invalid request")
 	}
 
-	file, err := os.Open(record.Get("chunk_path").(string))
+	trackId := record.GetString("file")
+	track, err := helpers.LookupFromCacheOrDB(c, "UploadedFiles_"+trackId, func() (*core.Record, error) {
+		return app.FindRecordById("UploadedFiles", trackId)
+	}, cache.DefaultExpiration)
+	if err != nil {
+		return e.String(400, "Invalid request")
+	}
+	if !access.CanListen(e.Auth, track) {
+		return e.String(403, "Forbidden")
+	}
+
+	path := record.GetString("chunk_path")
+	stat, err := os.Stat(path)
 	if err != nil {
 		return e.String(500, "Failed to open file")
 	}
-	defer file.Close()
 
 	e.Response.Header().Set("Content-Type", "audio/flac")
-	e.Response.Header().Set("Access-Control-Allow-Origin", "*")
+	e.Response.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
 	e.Response.WriteHeader(206)
 
-	// Stream FFmpeg output directly to the client
-	if _, err := io.Copy(e.Response, file); err != nil {
+	if canSendFile(e.Response) {
+		err = sendFile(e.Response, path, 0, stat.Size())
+	} else {
+		err = copyFile(e.Response, path)
+	}
+	if err != nil {
 		fmt.Println("Streaming error:", err)
 		e.String(500, "Failed to stream audio")
 	}
@@ -95,130 +118,284 @@ func HandleChunkRequest(e *core.RequestEvent, app *pocketbase.PocketBase, c *cac
 	return nil
 }
 
-func ListAllSongs(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache) error {
-	// Query all records from UploadedFiles
-	col, err := app.FindCollectionByNameOrId("UploadedFiles")
+func copyFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return e.String(500, "Failed to find collection")
+		return err
 	}
+	defer file.Close()
 
-	condition := dbx.HashExp{
-		"processed": true, // Only fetch processed files
-	}
-	records, err := app.FindAllRecords(col.Name, condition)
-	if err != nil {
-		return e.String(500, "Failed to fetch songs")
-	}
-
-	// Prepare a list of song metadata
-	songs := make([]map[string]interface{}, 0, len(records))
-	for _, r := range records {
-		songs = append(songs, map[string]interface{}{
-			"id":        r.Id,
-			"name":      r.Get("file_name"),
-			"size":      r.Get("file_size"),
-			"createdAt": r.Get("created"),
-			// Add more fields as needed
-		})
-	}
-	e.Response.Header().Set("Access-Control-Allow-Origin", "*")
-	return e.JSON(200, songs)
+	// hide WriteTo/ReadFrom so a wrapping writer sees every byte
+	_, err = io.Copy(struct{ io.Writer }{w}, struct{ io.Reader }{file})
+	return err
 }
 
-func Stream(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache) error {
-	// Parse the Range header
-	_range := e.Request.Header.Get("Range")
+func Stream(e *core.RequestEvent, app *pocketbase.PocketBase, c *cache.Cache, cc *chunkcache.Cache, pf *prefetch.Prefetcher, pc *ratelimit.Pacer, pt *plays.Tracker) error {
 	_id := e.Request.URL.Query().Get("id")
 
-	if _range == "" || _id == "" {
+	if _id == "" {
 		return e.String(400, "Invalid request")
 	}
 
-	startPos, err := getRange(_range)
-	if err != nil {
-		return e.String(400, "Invalid range")
+	track, err := helpers.LookupFromCacheOrDB(c, "UploadedFiles_"+_id, func() (*core.Record, error) {
+		return app.FindRecordById("UploadedFiles", _id)
+	}, cache.DefaultExpiration)
+	if err != nil || !track.GetBool("processed") {
+		return e.String(400, "Invalid request")
+	}
+	if !access.CanListen(e.Auth, track) {
+		return e.String(403, "Forbidden")
+	}
+	if !supportedRendition(e.Request.URL.Query().Get("rendition")) {
+		return e.String(400, "Unsupported rendition")
 	}
 
-	// Retrieve the records for the requested file
-	var Records []*core.Record
-	recordsInterface, found := c.Get(_id)
-	if !found {
-		records, err := app.FindAllRecords("ChunkedFiles", dbx.HashExp{"file": _id})
-		if err != nil {
-			return e.String(500, "Failed to find records")
-		}
-		c.Set(_id, records, cache.DefaultExpiration)
-		Records = records
-	} else {
-		Records = recordsInterface.([]*core.Record)
+	// Retrieve the chunk index for the requested file
+	index, err := chunkindex.Lookup(app, c, _id)
+	if err != nil {
+		return e.String(500, "Failed to find records")
 	}
 
-	if len(Records) == 0 {
+	if index.Len() == 0 {
 		return e.String(400, "Invalid request")
 	}
 
-	// Find the chunk containing the requested byte
-	var record *core.Record
-	for _, r := range Records {
-		start := int64(r.GetInt("start_byte_offset"))
-		end := int64(r.GetInt("end_byte_offset"))
-		if startPos >= start && startPos <= end {
-			record = r
-			break
-		}
+	// a disabled cache must stay a nil interface, not a typed nil
+	var source chunkio.Source
+	if cc != nil {
+		source = cc
+	}
+	reader, err := index.Reader(source)
+	if err != nil {
+		return e.String(500, "Failed to read chunks")
+	}
+	defer reader.Close()
+
+	fileSize := reader.Size()
+	etag := trackETag(track, fileSize)
+	modified := track.GetDateTime("created").Time()
+	contentType := trackContentType(track)
+
+	header := e.Response.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	rangeHeader := e.Request.Header.Get("Range")
+	if !ifRangeMatches(e.Request.Header.Get("If-Range"), etag, modified) {
+		rangeHeader = ""
 	}
 
-	if record == nil {
+	// a malformed Range header is ignored and the whole file sent, only a
+	// valid one that misses the file gets 416
+	ranges, err := parseRange(rangeHeader, fileSize)
+	if errors.Is(err, errUnsatisfiable) {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
 		return e.String(416, "Range Not Satisfiable")
 	}
+	if err != nil {
+		ranges = nil
+	}
 
-	// Get the file details
-	fileSize := record.GetInt("file_size")
-	chunkPath := record.Get("chunk_path").(string)
-	rangeStart := int64(record.GetInt("start_byte_offset"))
-	rangeEnd := int64(record.GetInt("end_byte_offset"))
+	isHead := e.Request.Method == http.MethodHead
+	session := sessionKey(e, _id)
+	// warm what the listener will most likely ask for next while this goes out
+	if !isHead {
+		for _, r := range ranges {
+			pf.Touch(session, index, r.start, r.start+r.length-1)
+		}
+		if len(ranges) == 0 {
+			pf.Touch(session, index, 0, fileSize-1)
+		}
+	}
 
-	// Open the file and stream data
-	file, err := os.Open(chunkPath)
-	if err != nil {
-		return e.String(500, "Failed to open file")
+	copyRange := func(w io.Writer, r byteRange) error {
+		_, err := io.Copy(w, io.NewSectionReader(reader, r.start, r.length))
+		return err
+	}
+	// a body that is one range goes to the connection as is and can skip
+	// userspace, multipart parts always take copyRange
+	sendRange := copyRange
+	if canSendFile(e.Response) {
+		sendRange = func(w io.Writer, r byteRange) error {
+			return sendChunks(w, index, cc, r)
+		}
 	}
-	defer file.Close()
 
-	// Set response headers
-	e.Response.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rangeStart, rangeEnd, fileSize))
-	e.Response.Header().Set("Accept-Ranges", "bytes")
-	e.Response.Header().Set("Content-Length", strconv.Itoa(int(rangeEnd-rangeStart+1)))
-	e.Response.Header().Set("Content-Type", "audio/flac")
-	e.Response.Header().Set("Access-Control-Allow-Origin", "*")
-	e.Response.WriteHeader(206)
+	// past the buffer-ahead target the body is held to a multiple of the bitrate
+	body := io.Writer(e.Response)
+	if !isHead {
+		var byteRate float64
+		if duration := track.GetFloat("duration"); duration > 0 {
+			byteRate = float64(fileSize) / duration
+		}
+		bodyStart, bodyLength := int64(0), fileSize
+		if len(ranges) > 0 {
+			bodyStart, bodyLength = ranges[0].start, 0
+			for _, r := range ranges {
+				bodyLength += r.length
+			}
+		}
+		// the read rate the prefetcher sizes its lookahead by is taken from
+		// what goes out, multipart bodies don't map onto track offsets
+		delivered := io.Writer(e.Response)
+		if len(ranges) <= 1 {
+			delivered = &deliveryWriter{w: e.Response, pos: bodyStart, report: func(pos, n int64) {
+				pf.Delivered(session, index, pos, n)
+			}}
+		}
+		body = pc.Writer(e.Request.Context(), session, delivered, bodyStart, byteRate)
+		if d := pc.Duration(bodyLength, byteRate); d > 0 {
+			http.NewResponseController(e.Response).SetWriteDeadline(time.Now().Add(d + time.Minute))
+		}
+	}
+	// what actually went out decides whether this was a play
+	sent := &sentWriter{w: body}
+	body = sent
+
+	var writeErr error
+	switch len(ranges) {
+	case 0:
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.FormatInt(fileSize, 10))
+		e.Response.WriteHeader(200)
+		if !isHead {
+			writeErr = sendRange(body, byteRange{start: 0, length: fileSize})
+		}
+	case 1:
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Range", ranges[0].contentRange(fileSize))
+		header.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		e.Response.WriteHeader(206)
+		if !isHead {
+			writeErr = sendRange(body, ranges[0])
+		}
+	default:
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		header.Set("Content-Length", strconv.FormatInt(multipartSize(ranges, contentType, fileSize, boundary), 10))
+		e.Response.WriteHeader(206)
+		if !isHead {
+			writeErr = writeMultipart(body, ranges, contentType, fileSize, boundary, copyRange)
+		}
+	}
 
-	// Stream the chunk data
-	if _, err := io.Copy(e.Response, file); err != nil {
-		fmt.Println("Streaming error:", err)
-		return e.String(500, "Failed to stream audio")
+	// the headers are already out, all we can do is log it
+	if writeErr != nil {
+		fmt.Println("Streaming error:", writeErr)
+	}
+
+	if !isHead {
+		switch len(ranges) {
+		case 0:
+			pt.Observe(e.Auth, track, fileSize, 0, sent.n)
+		case 1:
+			pt.Observe(e.Auth, track, fileSize, ranges[0].start, sent.n)
+		default:
+			// the count includes the part headers, only a complete body
+			// tells which bytes of the track went out
+			if writeErr == nil {
+				for _, r := range ranges {
+					pt.Observe(e.Auth, track, fileSize, r.start, r.length)
+				}
+			}
+		}
 	}
 
 	return nil
 }
 
-func getRange(r string) (int64, error) {
-	if !strings.HasPrefix(r, "bytes=") {
-		return 0, fmt.Errorf("invalid range format")
+// sentWriter counts what got written through it. ReadFrom is passed on
+// so sendfile keeps working underneath
+type sentWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (sw *sentWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.n += int64(n)
+	return n, err
+}
+
+func (sw *sentWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := sw.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(sw.w, r)
 	}
+	sw.n += n
+	return n, err
+}
+
+// deliveryWriter follows the track offset of a single range body and
+// reports every write, ReadFrom is passed on like in sentWriter
+type deliveryWriter struct {
+	w      io.Writer
+	pos    int64
+	report func(pos, n int64)
+}
+
+func (dw *deliveryWriter) Write(p []byte) (int, error) {
+	n, err := dw.w.Write(p)
+	dw.advance(int64(n))
+	return n, err
+}
 
-	rangeParts := strings.TrimPrefix(r, "bytes=")
-	ranges := strings.Split(rangeParts, "-")
-	if len(ranges) != 2 {
-		return 0, fmt.Errorf("invalid range format")
+func (dw *deliveryWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := dw.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(dw.w, r)
 	}
+	dw.advance(n)
+	return n, err
+}
 
-	start, err := strconv.ParseInt(ranges[0], 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid start value")
+func (dw *deliveryWriter) advance(n int64) {
+	if n > 0 {
+		dw.pos += n
+		dw.report(dw.pos, n)
 	}
+}
 
-	return start, nil
+// only the uploaded file itself is served for now
+func supportedRendition(rendition string) bool {
+	return rendition == "" || rendition == "original"
+}
+
+// sessionKey tells listeners of the same track apart, by user when the
+// request is authenticated and by address otherwise
+func sessionKey(e *core.RequestEvent, trackId string) string {
+	if e.Auth != nil {
+		return e.Auth.Id + "/" + trackId
+	}
+	return e.RealIP() + "/" + trackId
+}
+
+// the content never changes once uploaded, so the hash makes a strong etag
+func trackETag(track *core.Record, size int64) string {
+	if hash := track.GetString("content_hash"); len(hash) >= 32 {
+		return `"` + hash[:32] + `"`
+	}
+	return fmt.Sprintf(`"%s-%d"`, track.Id, size)
+}
+
+func trackContentType(track *core.Record) string {
+	switch audio.Format(track.GetString("format")) {
+	case audio.FormatMP3:
+		return "audio/mpeg"
+	case audio.FormatWAV:
+		return "audio/wav"
+	case audio.FormatOgg:
+		return "audio/ogg"
+	default:
+		return "audio/flac"
+	}
 }
 
 //ok 1 approach that i can think is, we prepare a hashmap for the chunk ranges and ids, and we send the json
@@ -234,3 +411,4 @@ func getRange(r string) (int64, error) {
 //so key is range, for that range awnd that chunk.
 //like a case statement, if range is 0-100, then chunk is 1, if range is 101-200, then chunk is 2
 //but in a datastructure that allows quick lookup like in constant time
+//-> chunkindex keeps the sorted start offsets per track and binary searches them, log n is plenty
@@ -9,14 +9,16 @@ import (
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/audio"
 	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/progress"
 )
 
 func ChunkJob(app *pocketbase.PocketBase, segmentSize int64, deleteOriginalFile bool) {
 	startTime := time.Now()
 
 	// Fetch records to process
-	records, err := app.FindRecordsByFilter("UploadedFiles", "processed = False", "-created", 4, 0)
+	records, err := app.FindRecordsByFilter("UploadedFiles", "processed = False && status != 'failed'", "-created", 4, 0)
 	if err != nil || len(records) == 0 {
 		app.Logger().Info("ChunkJob", "message", "No records to process", "error", err)
 		return
@@ -37,6 +39,9 @@ func ChunkJob(app *pocketbase.PocketBase, segmentSize int64, deleteOriginalFile
 	for _, record := range records {
 		if err := processRecord(app, record, collection, segmentSize, deleteOriginalFile, &chunkIDs, &errors); err != nil {
 			errors = append(errors, fmt.Sprintf("Record %s failed: %v", record.Id, err))
+			if err := progress.SetStage(app, record, progress.StageFailed, err.Error()); err != nil {
+				errors = append(errors, fmt.Sprintf("Record %s failed to save status: %v", record.Id, err))
+			}
 		}
 	}
 
@@ -70,11 +75,22 @@ func processRecord(app *pocketbase.PocketBase, record *core.Record, collection *
 		return fmt.Errorf("error creating directory %s: %w", outputDir, err)
 	}
 
+	if err := progress.SetStage(app, record, progress.StageProbing, ""); err != nil {
+		return fmt.Errorf("error saving status: %w", err)
+	}
+
 	// Open the original file
 	file, err := os.Open(flacFilePath)
 	if err != nil {
 		return fmt.Errorf("error opening file %s: %w", flacFilePath, err)
 	}
+	defer file.Close()
+
+	// the file may have been sitting on disk for a while, make sure it still decodes
+	info, err := audio.Probe(file)
+	if err != nil {
+		return fmt.Errorf("error probing file %s: %w", flacFilePath, err)
+	}
 
 	// Get the file size
 	stat, err := file.Stat()
@@ -86,6 +102,11 @@ func processRecord(app *pocketbase.PocketBase, record *core.Record, collection *
 	// Initialize variables
 	var startByte int64 = 0
 	var segmentIndex int = 0
+	totalSegments := int((fileSize + segmentSize - 1) / segmentSize)
+
+	if err := progress.SetStage(app, record, progress.StageChunking, ""); err != nil {
+		return fmt.Errorf("error saving status: %w", err)
+	}
 
 	// Read and process chunks
 	for startByte < fileSize {
@@ -122,22 +143,24 @@ func processRecord(app *pocketbase.PocketBase, record *core.Record, collection *
 
 		// Save chunk metadata to database
 		endByte := startByte + chunkSize - 1
-		if err := saveChunkRecord(app, collection, recordID, chunkFilePath, segmentIndex, startByte, endByte, chunkSize, chunkIDs, fileSize); err != nil {
+		startSample := chunkStartSample(file, info, startByte)
+		if err := saveChunkRecord(app, collection, recordID, chunkFilePath, segmentIndex, startByte, endByte, startSample, chunkSize, chunkIDs, fileSize); err != nil {
 			*errors = append(*errors, fmt.Sprintf("Chunk %d failed to save: %v", segmentIndex, err))
 		}
 		// Update for the next chunk
 		startByte += chunkSize
 		segmentIndex++
+		progress.Publish(app, record, progress.StageChunking, segmentIndex, totalSegments, "")
 	}
 
 	// Mark the original record as processed
 	record.Set("processed", true)
-	if err := app.Save(record); err != nil {
+	if err := progress.SetStage(app, record, progress.StageReady, ""); err != nil {
 		return fmt.Errorf("error saving record as processed: %w", err)
 	}
 
-	// Optionally delete the original file
-	if deleteOriginalFile {
+	// Optionally delete the original file, imported files are referenced in place and stay
+	if deleteOriginalFile && !record.GetBool("external") {
 		if err := file.Close(); err != nil {
 			*errors = append(*errors, fmt.Sprintf("Error closing original file %s: %v", flacFilePath, err))
 		}
@@ -149,7 +172,7 @@ func processRecord(app *pocketbase.PocketBase, record *core.Record, collection *
 	return nil
 }
 
-func saveChunkRecord(app *pocketbase.PocketBase, collection *core.Collection, recordID, chunkFilePath string, index int, startByte, endByte, chunkSize int64, chunkIDs *[]string, fileSize int64) error {
+func saveChunkRecord(app *pocketbase.PocketBase, collection *core.Collection, recordID, chunkFilePath string, index int, startByte, endByte, startSample, chunkSize int64, chunkIDs *[]string, fileSize int64) error {
 	// Create a new database record for this chunk
 	chunkRecord := core.NewRecord(collection)
 	chunkRecord.Set("file", recordID)
@@ -157,6 +180,7 @@ func saveChunkRecord(app *pocketbase.PocketBase, collection *core.Collection, re
 	chunkRecord.Set("chunk_order", index+1)
 	chunkRecord.Set("start_byte_offset", startByte)
 	chunkRecord.Set("end_byte_offset", endByte)
+	chunkRecord.Set("start_sample", startSample)
 	chunkRecord.Set("chunk_size", chunkSize)
 	chunkRecord.Set("file_size", fileSize)
 
@@ -167,3 +191,11 @@ func saveChunkRecord(app *pocketbase.PocketBase, collection *core.Collection, re
 	*chunkIDs = append(*chunkIDs, chunkRecord.Id)
 	return nil
 }
+
+// chunkStartSample finds the first sample that can be decoded from the
+// chunk starting at startByte, 64kb is more than any flac frame header needs
+func chunkStartSample(file *os.File, info *audio.Info, startByte int64) int64 {
+	buf := make([]byte, 64<<10)
+	n, _ := file.ReadAt(buf, startByte)
+	return audio.SampleAt(info, buf[:n], startByte)
+}
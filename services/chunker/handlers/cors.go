@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+)
+
+// corsPolicy replaces pocketbase's allow everything default. it keeps the
+// default's id and priority so it still runs before every route, preflights
+// included
+func corsPolicy(cfg *config.Config) *hook.Handler[*core.RequestEvent] {
+	policy := apis.CORSConfig{
+		AllowOrigins:     cfg.CorsOrigins,
+		AllowMethods:     cfg.CorsMethods,
+		AllowHeaders:     cfg.CorsHeaders,
+		ExposeHeaders:    cfg.CorsExposeHeaders,
+		AllowCredentials: cfg.CorsCredentials,
+		MaxAge:           int(cfg.CorsMaxAge.Seconds()),
+	}
+	// an empty list would fall back to "*" inside apis.CORS
+	if len(cfg.CorsOrigins) == 0 {
+		policy.AllowOriginFunc = func(string) (bool, error) {
+			return false, nil
+		}
+	}
+	return apis.CORS(policy)
+}
@@ -5,29 +5,165 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	browse "github.com/rudyrdx/music-streamer/chunker/handlers/Browse"
 	file "github.com/rudyrdx/music-streamer/chunker/handlers/File"
+	history "github.com/rudyrdx/music-streamer/chunker/handlers/History"
+	playlists "github.com/rudyrdx/music-streamer/chunker/handlers/Playlists"
+	radio "github.com/rudyrdx/music-streamer/chunker/handlers/Radio"
+	scrobble "github.com/rudyrdx/music-streamer/chunker/handlers/Scrobble"
 	stream "github.com/rudyrdx/music-streamer/chunker/handlers/Stream"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+	"github.com/rudyrdx/music-streamer/chunker/prefetch"
+	"github.com/rudyrdx/music-streamer/chunker/ratelimit"
+	"github.com/rudyrdx/music-streamer/chunker/recommend"
+	"github.com/rudyrdx/music-streamer/chunker/scrobbler"
+	"github.com/rudyrdx/music-streamer/chunker/suggest"
 )
 
-func SetupHandlers(se *core.ServeEvent, app *pocketbase.PocketBase, c *cache.Cache) error {
+func SetupHandlers(se *core.ServeEvent, app *pocketbase.PocketBase, c *cache.Cache, cc *chunkcache.Cache, pf *prefetch.Prefetcher, sx *suggest.Index, sb *scrobbler.Bridge, rm *recommend.Model, cfg *config.Config) error {
 
 	se.Router.Bind(apis.BodyLimit(10 << 30))
 
+	se.Router.Unbind(apis.DefaultCorsMiddlewareId)
+	se.Router.Bind(corsPolicy(cfg))
+
+	verifier, err := newTOTPVerifier(cfg)
+	if err != nil {
+		return err
+	}
+	urls, urlKey, err := newURLSigner(cfg)
+	if err != nil {
+		return err
+	}
+
+	// listening and uploading need a logged in user, superusers can do both
+	listeners := apis.RequireAuth("users", core.CollectionNameSuperusers)
+
 	se.Router.GET("/hello", func(re *core.RequestEvent) error {
 		return re.String(200, "Hello world!")
 	})
 
 	se.Router.POST("/file", func(e *core.RequestEvent) error {
-		return file.HandleUpload(e)
+		return file.HandleUpload(e, cfg)
+	}).BindFunc(requireTOTP(verifier)).Bind(listeners).BindFunc(access.RequireUploader)
+
+	limiter := ratelimit.NewLimiter(cfg.RateLimitPerMinute, cfg.RateLimitBurst, cfg.RateLimitAPIKeys)
+	pacer := ratelimit.NewPacer(cfg.PaceMultiple, cfg.PaceBufferAhead)
+	tracker := plays.NewTracker(app, plays.Options{
+		MinShare:   cfg.PlayMinShare,
+		MinTime:    cfg.PlayMinTime,
+		SessionTTL: cfg.PlaySessionTTL,
 	})
 
 	se.Router.GET("/stream", func(e *core.RequestEvent) error {
-		return stream.Stream(e, app, c)
-	})
+		return stream.Stream(e, app, c, cc, pf, pacer, tracker)
+	}).BindFunc(requireStreamAuth(app, c, urls, verifier)).Bind(listeners).BindFunc(limiter.Middleware)
+
+	se.Router.HEAD("/stream", func(e *core.RequestEvent) error {
+		return stream.Stream(e, app, c, cc, pf, pacer, tracker)
+	}).BindFunc(requireStreamAuth(app, c, urls, verifier)).Bind(listeners).BindFunc(limiter.Middleware)
+
+	se.Router.GET("/stream/sign", func(e *core.RequestEvent) error {
+		return stream.SignURL(e, app, c, urlKey, cfg.SignedURLTTL)
+	}).BindFunc(requireTOTP(verifier))
 
 	se.Router.GET("/listallsongs", func(e *core.RequestEvent) error {
 		return stream.ListAllSongs(e, app, c)
+	}).BindFunc(requireTOTP(verifier)).Bind(listeners)
+
+	se.Router.GET("/search", func(e *core.RequestEvent) error {
+		return browse.Search(e, app)
+	}).Bind(listeners)
+	se.Router.GET("/suggest", func(e *core.RequestEvent) error {
+		return browse.Suggest(e, app, sx, cfg.SuggestBudget)
+	}).Bind(listeners)
+	se.Router.GET("/radio", func(e *core.RequestEvent) error {
+		return radio.Radio(e, app, rm)
+	}).Bind(listeners)
+	se.Router.GET("/favorites", func(e *core.RequestEvent) error {
+		return browse.Favorites(e, app)
+	}).Bind(listeners)
+	se.Router.PUT("/favorites/{type}/{id}", func(e *core.RequestEvent) error {
+		return browse.Like(e, app)
+	}).Bind(listeners)
+	se.Router.DELETE("/favorites/{type}/{id}", func(e *core.RequestEvent) error {
+		return browse.Unlike(e, app)
+	}).Bind(listeners)
+	se.Router.GET("/ratings", func(e *core.RequestEvent) error {
+		return browse.Ratings(e, app)
+	}).Bind(listeners)
+	se.Router.PUT("/ratings/{type}/{id}", func(e *core.RequestEvent) error {
+		return browse.Rate(e, app)
+	}).Bind(listeners)
+	se.Router.DELETE("/ratings/{type}/{id}", func(e *core.RequestEvent) error {
+		return browse.Unrate(e, app)
+	}).Bind(listeners)
+	se.Router.GET("/artists", func(e *core.RequestEvent) error {
+		return browse.Artists(e, app)
+	}).Bind(listeners)
+	se.Router.GET("/artists/{id}/albums", func(e *core.RequestEvent) error {
+		return browse.ArtistAlbums(e, app)
+	}).Bind(listeners)
+	se.Router.GET("/albums/{id}/tracks", func(e *core.RequestEvent) error {
+		return browse.AlbumTracks(e, app)
+	}).Bind(listeners)
+
+	se.Router.POST("/events", func(e *core.RequestEvent) error {
+		return history.Event(e, app, tracker)
+	}).Bind(listeners)
+	se.Router.GET("/history", func(e *core.RequestEvent) error {
+		return history.History(e, app)
+	}).Bind(listeners)
+
+	sc := se.Router.Group("/scrobble/accounts").Bind(listeners)
+	sc.GET("", func(e *core.RequestEvent) error {
+		return scrobble.Accounts(e, app)
+	})
+	sc.PUT("/{service}", func(e *core.RequestEvent) error {
+		return scrobble.Link(e, app, sb)
+	})
+	sc.DELETE("/{service}", func(e *core.RequestEvent) error {
+		return scrobble.Unlink(e, app)
 	})
+
+	pl := se.Router.Group("/playlists").Bind(listeners)
+	pl.GET("", func(e *core.RequestEvent) error {
+		return playlists.List(e, app)
+	})
+	pl.POST("", func(e *core.RequestEvent) error {
+		return playlists.Create(e, app)
+	})
+	pl.GET("/{id}", func(e *core.RequestEvent) error {
+		return playlists.Get(e, app)
+	})
+	pl.PATCH("/{id}", func(e *core.RequestEvent) error {
+		return playlists.Update(e, app)
+	})
+	pl.DELETE("/{id}", func(e *core.RequestEvent) error {
+		return playlists.Delete(e, app)
+	})
+	pl.POST("/{id}/items", func(e *core.RequestEvent) error {
+		return playlists.AddItem(e, app)
+	})
+	pl.POST("/{id}/items/bulk", func(e *core.RequestEvent) error {
+		return playlists.AddItems(e, app)
+	})
+	pl.DELETE("/{id}/items/{item}", func(e *core.RequestEvent) error {
+		return playlists.RemoveItem(e, app)
+	})
+	pl.PUT("/{id}/order", func(e *core.RequestEvent) error {
+		return playlists.Reorder(e, app)
+	})
+
+	if cc != nil {
+		se.Router.GET("/metrics/chunkcache", func(e *core.RequestEvent) error {
+			return e.JSON(200, cc.Stats())
+		}).Bind(apis.RequireSuperuserAuth())
+	}
+
 	// se.Router.GET("/chunk", func(e *core.RequestEvent) error {
 	// 	return stream.HandleChunkRequest(e, app, c)
 	// })
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/signedurl"
+	"github.com/rudyrdx/music-streamer/chunker/totp"
+)
+
+// newURLSigner returns the verifier for signed urls and the key new ones
+// are signed with, both nil when no keys are configured
+func newURLSigner(cfg *config.Config) (*signedurl.Verifier, *totp.Secret, error) {
+	keys, err := totp.ParseSecrets(cfg.SignedURLKeys)
+	if err != nil || len(keys) == 0 {
+		return nil, nil, err
+	}
+	return signedurl.NewVerifier(keys), &keys[0], nil
+}
+
+// requireStreamAuth takes a signed url in place of a totp token, a url
+// signed for a user authenticates the request as that user
+func requireStreamAuth(app *pocketbase.PocketBase, c *cache.Cache, urls *signedurl.Verifier, v *totp.Verifier) func(e *core.RequestEvent) error {
+	checkTOTP := requireTOTP(v)
+	return func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+		if urls == nil || !signedurl.IsSigned(q) {
+			return checkTOTP(e)
+		}
+
+		params, err := urls.Verify(q, e.RealIP(), time.Now())
+		if errors.Is(err, signedurl.ErrExpired) {
+			return e.String(403, "Link expired")
+		}
+		if err != nil {
+			return e.String(401, "Unauthorized")
+		}
+
+		if params.UserId != "" {
+			if e.Auth != nil && e.Auth.Id != params.UserId {
+				return e.String(403, "Forbidden")
+			}
+			user, err := helpers.LookupFromCacheOrDB(c, "Users_"+params.UserId, func() (*core.Record, error) {
+				return app.FindRecordById("users", params.UserId)
+			}, cache.DefaultExpiration)
+			if err != nil {
+				return e.String(401, "Unauthorized")
+			}
+			e.Auth = user
+		}
+		return e.Next()
+	}
+}
@@ -0,0 +1,16 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// HashReader returns the hex sha256 of everything left in r
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,374 @@
+package ingest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/audio"
+	"github.com/rudyrdx/music-streamer/chunker/helpers"
+	"github.com/rudyrdx/music-streamer/chunker/progress"
+)
+
+// everything that brings a file into UploadedFiles goes through here,
+// the http upload, the import command and the watch folders
+
+const (
+	StatusNew       = "new"
+	StatusDuplicate = "duplicate"
+	StatusSkipped   = "skipped"
+	StatusReplaced  = "replaced"
+)
+
+// AudioExtensions are the file types picked up when scanning directories
+var AudioExtensions = []string{".flac", ".mp3", ".wav", ".ogg", ".oga", ".opus"}
+
+func IsAudioFile(path string) bool {
+	return slices.Contains(AudioExtensions, strings.ToLower(filepath.Ext(path)))
+}
+
+type Track struct {
+	Path       string
+	SourcePath string
+	Name       string
+	Size       int64
+	Hash       string
+	Owner      string
+	Visibility string
+	Info       *audio.Info
+	// external files are referenced in place and never deleted by the chunk job
+	External bool
+}
+
+// SaveRecord creates the UploadedFiles record for a file that is already on disk
+func SaveRecord(app core.App, t Track) (*core.Record, error) {
+	collection, err := app.FindCollectionByNameOrId("UploadedFiles")
+	if err != nil {
+		return nil, err
+	}
+
+	record := core.NewRecord(collection)
+	setContent(record, t)
+	record.Set("source_path", t.SourcePath)
+	record.Set("owner", t.Owner)
+	record.Set("visibility", t.Visibility)
+	record.Set("uploaders", t.Owner)
+	if err := app.Save(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReplaceRecord points an existing record at new content, for a source
+// file that changed. the id stays so playlists, favorites and plays keep
+// their track, the old chunks are dropped and the chunk job cuts new ones
+func ReplaceRecord(app core.App, record *core.Record, t Track) error {
+	oldPath, oldExternal := record.GetString("file_path"), record.GetBool("external")
+
+	var chunkPaths []string
+	err := app.RunInTransaction(func(txApp core.App) error {
+		chunks, err := txApp.FindAllRecords("ChunkedFiles", dbx.HashExp{"file": record.Id})
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if err := txApp.Delete(chunk); err != nil {
+				return err
+			}
+			chunkPaths = append(chunkPaths, chunk.GetString("chunk_path"))
+		}
+
+		setContent(record, t)
+		record.Set("status_reason", "")
+		return txApp.Save(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range chunkPaths {
+		os.Remove(path)
+	}
+	// a copy of the old content, the chunk job may have removed it already
+	if oldPath != t.Path && !oldExternal {
+		os.Remove(oldPath)
+	}
+	return nil
+}
+
+func setContent(record *core.Record, t Track) {
+	record.Set("file_path", t.Path)
+	record.Set("file_name", t.Name)
+	record.Set("file_size", t.Size)
+	record.Set("processed", false)
+	record.Set("status", progress.StageQueued)
+	record.Set("external", t.External)
+	record.Set("file_info", t.Info)
+	record.Set("format", string(t.Info.Format))
+	record.Set("duration", t.Info.Duration)
+	record.Set("content_hash", t.Hash)
+}
+
+// LinkDuplicate looks up a track by content hash and adds owner to its
+// uploaders, it returns nil when the hash is unknown
+func LinkDuplicate(app core.App, hash string, owner string) (*core.Record, error) {
+	existing, err := app.FindFirstRecordByData("UploadedFiles", "content_hash", hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if owner != "" && !slices.Contains(existing.GetStringSlice("uploaders"), owner) {
+		existing.Set("uploaders+", owner)
+		if err := app.Save(existing); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// FindBySourcePath returns the record imported from path, or the record
+// of the same content when path turned out to be a duplicate. nil when
+// path wasn't imported
+func FindBySourcePath(app core.App, path string) (*core.Record, error) {
+	record, err := app.FindFirstRecordByData("UploadedFiles", "source_path", path)
+	if err == nil {
+		return record, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	imported, err := app.FindFirstRecordByData("ImportedPaths", "path", path)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	record, err = app.FindRecordById("UploadedFiles", imported.GetString("file"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// rememberPath records that path holds the content of file, so the next
+// run skips it without hashing
+func rememberPath(app core.App, path string, file string) error {
+	record, err := app.FindFirstRecordByData("ImportedPaths", "path", path)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		collection, err := app.FindCollectionByNameOrId("ImportedPaths")
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("path", path)
+	}
+	record.Set("file", file)
+	return app.Save(record)
+}
+
+func forgetPath(app core.App, path string) error {
+	record, err := app.FindFirstRecordByData("ImportedPaths", "path", path)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	return app.Delete(record)
+}
+
+// WriteFile writes to a temporary name first and renames once the data
+// is synced, so a crash never leaves a half written file at path
+func WriteFile(path string, src io.Reader) (int64, error) {
+	partPath := path + ".part"
+	fo, err := os.Create(partPath)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(fo, src)
+	if err == nil {
+		err = fo.Sync()
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partPath, path)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return 0, err
+	}
+
+	return written, nil
+}
+
+type Options struct {
+	// Copy stores a copy in DestDir instead of referencing the file in place
+	Copy    bool
+	DestDir string
+	Owner   string
+	// Visibility of new tracks, see the access package
+	Visibility string
+	// Reimport is for files that changed since they were imported, the
+	// record imported from the path gets the new content. identical
+	// content is still skipped
+	Reimport bool
+}
+
+type Result struct {
+	Id     string
+	Status string
+}
+
+// ImportFile brings a local file into the library. it is idempotent, a
+// path that was imported before or content we already have is skipped
+func ImportFile(app core.App, path string, opts Options) (Result, error) {
+	result := Result{}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return result, err
+	}
+
+	existing, err := FindBySourcePath(app, path)
+	if err != nil {
+		return result, err
+	}
+	if existing != nil && !opts.Reimport {
+		result.Id = existing.Id
+		result.Status = StatusSkipped
+		return result, nil
+	}
+	// only the record made from this path is replaced, not the one a
+	// duplicate path was linked to
+	var previous *core.Record
+	if existing != nil && existing.GetString("source_path") == path {
+		previous = existing
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer src.Close()
+
+	hash, err := helpers.HashReader(src)
+	if err != nil {
+		return result, err
+	}
+	if duplicate, err := LinkDuplicate(app, hash, opts.Owner); err != nil {
+		return result, err
+	} else if duplicate != nil {
+		result.Id = duplicate.Id
+		result.Status = StatusDuplicate
+		if previous != nil && previous.Id == duplicate.Id {
+			// touched but the content is the same
+			result.Status = StatusSkipped
+			return result, nil
+		}
+		if previous != nil {
+			// the file now holds what another track has, its own content is gone
+			if err := app.Delete(previous); err != nil {
+				return result, err
+			}
+		}
+		if err := rememberPath(app, path, duplicate.Id); err != nil {
+			return result, err
+		}
+		return result, nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	info, err := audio.Probe(src)
+	if err != nil {
+		return result, fmt.Errorf("not valid audio: %w", err)
+	}
+
+	track := Track{
+		Path:       path,
+		SourcePath: path,
+		Name:       filepath.Base(path),
+		Size:       info.Size,
+		Hash:       hash,
+		Owner:      opts.Owner,
+		Visibility: opts.Visibility,
+		Info:       info,
+		External:   !opts.Copy,
+	}
+
+	if opts.Copy {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return result, err
+		}
+		if err := os.MkdirAll(opts.DestDir, 0755); err != nil {
+			return result, err
+		}
+		track.Path = filepath.Join(opts.DestDir, uuid.New().String()+info.Format.Extension())
+		if track.Size, err = WriteFile(track.Path, src); err != nil {
+			return result, err
+		}
+	}
+
+	if previous != nil {
+		if err := ReplaceRecord(app, previous, track); err != nil {
+			if opts.Copy {
+				os.Remove(track.Path)
+			}
+			return result, err
+		}
+		result.Id = previous.Id
+		result.Status = StatusReplaced
+		return result, nil
+	}
+
+	record, err := SaveRecord(app, track)
+	if err != nil {
+		if opts.Copy {
+			os.Remove(track.Path)
+		}
+		// the same content may have been saved by another worker meanwhile
+		if existing, lErr := LinkDuplicate(app, hash, opts.Owner); lErr == nil && existing != nil {
+			if err := rememberPath(app, path, existing.Id); err != nil {
+				return result, err
+			}
+			result.Id = existing.Id
+			result.Status = StatusDuplicate
+			return result, nil
+		}
+		return result, err
+	}
+
+	if existing != nil {
+		// the path used to hold a duplicate, now it has its own record
+		if err := forgetPath(app, path); err != nil {
+			app.Logger().Warn("Ingest", "message", "Failed to forget imported path", "path", path, "error", err)
+		}
+	}
+
+	result.Id = record.Id
+	result.Status = StatusNew
+	return result, nil
+}
@@ -0,0 +1,324 @@
+// Package library turns the tags of uploaded files into the normalized
+// Artists, Albums and Tracks collections.
+//
+// artists and albums are matched on their musicbrainz id when the tags
+// have one and on their normalized name otherwise. a name match without an
+// id adopts the id the first time a tagged file brings one. albums belong
+// to the album artist, falling back to the track artist, so compilations
+// stay one album while each track keeps its own artist
+package library
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/audio"
+)
+
+// UnknownArtist is used for files without an artist tag
+const UnknownArtist = "Unknown Artist"
+
+// Key is what names are matched on: lowercase with the whitespace folded
+func Key(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// BindHooks adds every new or changed file to the library, drops artists
+// and albums once their last track is gone and keeps the search index in sync
+func BindHooks(app core.App) {
+	bindSearchHooks(app)
+
+	app.OnRecordAfterCreateSuccess("UploadedFiles").BindFunc(func(e *core.RecordEvent) error {
+		if _, err := AddTrack(e.App, e.Record); err != nil {
+			e.App.Logger().Error("Library", "message", "Failed to add track", "file", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
+
+	// a watched file that changed gets new content under the same record,
+	// its tags may have changed with it
+	app.OnRecordAfterUpdateSuccess("UploadedFiles").BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.GetString("content_hash") != e.Record.Original().GetString("content_hash") {
+			if _, err := AddTrack(e.App, e.Record); err != nil {
+				e.App.Logger().Error("Library", "message", "Failed to update track", "file", e.Record.Id, "error", err)
+			}
+		}
+		return e.Next()
+	})
+
+	app.OnRecordAfterDeleteSuccess("Tracks").BindFunc(func(e *core.RecordEvent) error {
+		if err := prune(e.App, e.Record.GetString("album"), e.Record.GetString("artist")); err != nil {
+			e.App.Logger().Warn("Library", "message", "Failed to prune library", "track", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
+}
+
+// Backfill adds the files that aren't in the library yet, like the ones
+// uploaded before it existed
+func Backfill(app core.App) error {
+	var ids []string
+	err := app.DB().
+		Select("id").
+		From("UploadedFiles").
+		Where(dbx.NewExp("id NOT IN (SELECT file FROM Tracks)")).
+		Column(&ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		file, err := app.FindRecordById("UploadedFiles", id)
+		if err != nil {
+			continue
+		}
+		if _, err := AddTrack(app, file); err != nil {
+			app.Logger().Warn("Library", "message", "Failed to add track", "file", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// AddTrack creates or refreshes the Tracks record of an UploadedFiles
+// record, along with its artist and album
+func AddTrack(app core.App, file *core.Record) (*core.Record, error) {
+	var info audio.Info
+	if err := file.UnmarshalJSONField("file_info", &info); err != nil {
+		return nil, err
+	}
+	tags := audio.Tags{}
+	if info.Tags != nil {
+		tags = *info.Tags
+	}
+
+	title := strings.TrimSpace(tags.Title)
+	if title == "" {
+		name := file.GetString("file_name")
+		title = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	var track *core.Record
+	err := app.RunInTransaction(func(txApp core.App) error {
+		artistName := tags.Artist
+		if strings.TrimSpace(artistName) == "" {
+			artistName = UnknownArtist
+		}
+		artist, err := findOrCreateArtist(txApp, artistName, tags.MusicBrainzArtistId)
+		if err != nil {
+			return err
+		}
+
+		var album *core.Record
+		if strings.TrimSpace(tags.Album) != "" {
+			albumArtist := artist
+			if strings.TrimSpace(tags.AlbumArtist) != "" && Key(tags.AlbumArtist) != Key(artistName) {
+				albumArtist, err = findOrCreateArtist(txApp, tags.AlbumArtist, tags.MusicBrainzAlbumArtistId)
+				if err != nil {
+					return err
+				}
+			}
+			album, err = findOrCreateAlbum(txApp, albumArtist, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		track, err = txApp.FindFirstRecordByData("Tracks", "file", file.Id)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			collection, err := txApp.FindCollectionByNameOrId("Tracks")
+			if err != nil {
+				return err
+			}
+			track = core.NewRecord(collection)
+			track.Set("file", file.Id)
+		}
+
+		track.Set("title", title)
+		track.Set("artist", artist.Id)
+		track.Set("album", "")
+		if album != nil {
+			track.Set("album", album.Id)
+		}
+		track.Set("disc_number", tags.DiscNumber)
+		track.Set("track_number", tags.TrackNumber)
+		track.Set("year", tags.Year)
+		track.Set("genres", genresOrEmpty(tags.Genres))
+		track.Set("duration", info.Duration)
+		track.Set("lyrics", tags.Lyrics)
+		track.Set("musicbrainz_id", tags.MusicBrainzTrackId)
+		if err := txApp.Save(track); err != nil {
+			return err
+		}
+
+		// retagged files can leave their old album and artist behind
+		previous := track.Original()
+		if previous.GetString("album") != track.GetString("album") || previous.GetString("artist") != track.GetString("artist") {
+			return prune(txApp, previous.GetString("album"), previous.GetString("artist"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+func findOrCreateArtist(app core.App, name string, mbid string) (*core.Record, error) {
+	name = strings.TrimSpace(name)
+	mbid = strings.TrimSpace(mbid)
+
+	if mbid != "" {
+		artist, err := app.FindFirstRecordByData("Artists", "musicbrainz_id", mbid)
+		if err == nil {
+			return artist, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	// a same named artist with another id is somebody else
+	artist, err := app.FindFirstRecordByFilter(
+		"Artists",
+		"name_key = {:key} && musicbrainz_id = ''",
+		dbx.Params{"key": Key(name)},
+	)
+	if err == nil {
+		if mbid != "" {
+			artist.Set("musicbrainz_id", mbid)
+			if err := app.Save(artist); err != nil {
+				return nil, err
+			}
+		}
+		return artist, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	collection, err := app.FindCollectionByNameOrId("Artists")
+	if err != nil {
+		return nil, err
+	}
+	artist = core.NewRecord(collection)
+	artist.Set("name", name)
+	artist.Set("name_key", Key(name))
+	artist.Set("musicbrainz_id", mbid)
+	if err := app.Save(artist); err != nil {
+		return nil, err
+	}
+	return artist, nil
+}
+
+func findOrCreateAlbum(app core.App, artist *core.Record, tags audio.Tags) (*core.Record, error) {
+	title := strings.TrimSpace(tags.Album)
+	mbid := strings.TrimSpace(tags.MusicBrainzAlbumId)
+
+	var album *core.Record
+	var err error
+	if mbid != "" {
+		album, err = app.FindFirstRecordByData("Albums", "musicbrainz_id", mbid)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	if album == nil {
+		album, err = app.FindFirstRecordByFilter(
+			"Albums",
+			"artist = {:artist} && title_key = {:key} && musicbrainz_id = ''",
+			dbx.Params{"artist": artist.Id, "key": Key(title)},
+		)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if album == nil {
+		collection, err := app.FindCollectionByNameOrId("Albums")
+		if err != nil {
+			return nil, err
+		}
+		album = core.NewRecord(collection)
+		album.Set("title", title)
+		album.Set("title_key", Key(title))
+		album.Set("artist", artist.Id)
+		album.Set("genres", genresOrEmpty(nil))
+	}
+
+	// whatever the first tracks left out, later ones can fill in
+	changed := album.IsNew()
+	if album.GetString("musicbrainz_id") == "" && mbid != "" {
+		album.Set("musicbrainz_id", mbid)
+		changed = true
+	}
+	if album.GetInt("year") == 0 && tags.Year != 0 {
+		album.Set("year", tags.Year)
+		changed = true
+	}
+	if album.GetInt("disc_total") < tags.DiscTotal {
+		album.Set("disc_total", tags.DiscTotal)
+		changed = true
+	}
+	var genres []string
+	album.UnmarshalJSONField("genres", &genres)
+	if len(genres) == 0 && len(tags.Genres) > 0 {
+		album.Set("genres", tags.Genres)
+		changed = true
+	}
+
+	if changed {
+		if err := app.Save(album); err != nil {
+			return nil, err
+		}
+	}
+	return album, nil
+}
+
+// prune deletes the album and artist when no track refers to them anymore
+func prune(app core.App, albumId string, artistId string) error {
+	if albumId != "" {
+		album, err := app.FindRecordById("Albums", albumId)
+		if err == nil && !referenced(app, "Tracks", "album", albumId) {
+			if err := app.Delete(album); err != nil {
+				return err
+			}
+			if albumArtist := album.GetString("artist"); albumArtist != artistId {
+				if err := pruneArtist(app, albumArtist); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return pruneArtist(app, artistId)
+}
+
+func pruneArtist(app core.App, artistId string) error {
+	if artistId == "" || referenced(app, "Tracks", "artist", artistId) || referenced(app, "Albums", "artist", artistId) {
+		return nil
+	}
+	artist, err := app.FindRecordById("Artists", artistId)
+	if err != nil {
+		return nil
+	}
+	return app.Delete(artist)
+}
+
+func referenced(app core.App, collection string, field string, id string) bool {
+	total, err := app.CountRecords(collection, dbx.HashExp{field: id})
+	// when in doubt keep the record
+	return err != nil || total > 0
+}
+
+func genresOrEmpty(genres []string) []string {
+	if genres == nil {
+		return []string{}
+	}
+	return genres
+}
@@ -0,0 +1,263 @@
+package library
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// the search index is an fts5 table next to the collections, one row per
+// artist, album and track. it is a copy of what is in the collections and
+// is kept up to date by the record hooks, SetupSearch rebuilds it when it
+// comes up empty. unicode61 with remove_diacritics folds "Björk" and
+// "bjork" to the same token. fts5 can only look rows up by rowid, the
+// rowid of every record's row is kept in a plain table next to it so
+// updates and deletes don't scan the whole index
+
+const SearchTable = "library_fts"
+
+const searchRefsTable = "library_fts_refs"
+
+const (
+	TypeArtist = "artist"
+	TypeAlbum  = "album"
+	TypeTrack  = "track"
+)
+
+// SetupSearch creates the index and fills it from the collections when it
+// is empty
+func SetupSearch(app core.App) error {
+	_, err := app.DB().NewQuery(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS ` + SearchTable + ` USING fts5(
+			type UNINDEXED,
+			ref UNINDEXED,
+			title,
+			artist,
+			album,
+			genre,
+			lyrics,
+			tokenize = "unicode61 remove_diacritics 2"
+		)`).Execute()
+	if err != nil {
+		return err
+	}
+	_, err = app.DB().NewQuery(`
+		CREATE TABLE IF NOT EXISTS ` + searchRefsTable + ` (
+			ref TEXT PRIMARY KEY NOT NULL,
+			row INTEGER NOT NULL
+		)`).Execute()
+	if err != nil {
+		return err
+	}
+
+	// titles weigh the most, lyrics the least. rank keeps this for every
+	// query that orders by it
+	_, err = app.DB().NewQuery(
+		"INSERT INTO " + SearchTable + "(" + SearchTable + ", rank) VALUES ('rank', 'bm25(0, 0, 10, 6, 4, 2, 1)')",
+	).Execute()
+	if err != nil {
+		return err
+	}
+
+	// an index from before the refs table has rows nothing points at
+	var total, refs int
+	if err := app.DB().NewQuery("SELECT COUNT(*) FROM " + SearchTable).Row(&total); err != nil {
+		return err
+	}
+	if err := app.DB().NewQuery("SELECT COUNT(*) FROM " + searchRefsTable).Row(&refs); err != nil {
+		return err
+	}
+	if total == 0 || total != refs {
+		return RebuildSearch(app)
+	}
+	return nil
+}
+
+// RebuildSearch drops and refills the whole index
+func RebuildSearch(app core.App) error {
+	return app.RunInTransaction(func(txApp core.App) error {
+		if _, err := txApp.DB().NewQuery("DELETE FROM " + SearchTable).Execute(); err != nil {
+			return err
+		}
+		if _, err := txApp.DB().NewQuery("DELETE FROM " + searchRefsTable).Execute(); err != nil {
+			return err
+		}
+		for _, collection := range []string{"Artists", "Albums", "Tracks"} {
+			records, err := txApp.FindAllRecords(collection)
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				if err := indexRecord(txApp, r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func bindSearchHooks(app core.App) {
+	index := func(e *core.RecordEvent) error {
+		if err := indexRecord(e.App, e.Record); err != nil {
+			e.App.Logger().Warn("Library", "message", "Failed to index record", "id", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	}
+	unindex := func(e *core.RecordEvent) error {
+		if err := removeFromSearch(e.App, e.Record.Id); err != nil {
+			e.App.Logger().Warn("Library", "message", "Failed to unindex record", "id", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	}
+
+	for _, collection := range []string{"Artists", "Albums", "Tracks"} {
+		app.OnRecordAfterCreateSuccess(collection).BindFunc(index)
+		app.OnRecordAfterDeleteSuccess(collection).BindFunc(unindex)
+	}
+	app.OnRecordAfterUpdateSuccess("Tracks").BindFunc(func(e *core.RecordEvent) error {
+		// counters and the like change far more often than what is indexed
+		original := e.Record.Original()
+		for _, field := range []string{"title", "artist", "album", "genres", "lyrics"} {
+			if e.Record.GetString(field) != original.GetString(field) {
+				return index(e)
+			}
+		}
+		return e.Next()
+	})
+
+	// names show up on the rows of everything below them
+	app.OnRecordAfterUpdateSuccess("Artists").BindFunc(func(e *core.RecordEvent) error {
+		if err := reindexRelated(e.App, e.Record, "artist"); err != nil {
+			e.App.Logger().Warn("Library", "message", "Failed to index record", "id", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
+	app.OnRecordAfterUpdateSuccess("Albums").BindFunc(func(e *core.RecordEvent) error {
+		if err := reindexRelated(e.App, e.Record, "album"); err != nil {
+			e.App.Logger().Warn("Library", "message", "Failed to index record", "id", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
+}
+
+func reindexRelated(app core.App, record *core.Record, field string) error {
+	if err := indexRecord(app, record); err != nil {
+		return err
+	}
+	related, err := app.FindAllRecords("Tracks", dbx.HashExp{field: record.Id})
+	if err != nil {
+		return err
+	}
+	if field == "artist" {
+		albums, err := app.FindAllRecords("Albums", dbx.HashExp{"artist": record.Id})
+		if err != nil {
+			return err
+		}
+		related = append(related, albums...)
+	}
+	for _, r := range related {
+		if err := indexRecord(app, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRecord writes the row of an Artists, Albums or Tracks record
+func indexRecord(app core.App, record *core.Record) error {
+	row := dbx.Params{"ref": record.Id, "title": "", "artist": "", "album": "", "genre": "", "lyrics": ""}
+
+	switch record.Collection().Name {
+	case "Artists":
+		row["type"] = TypeArtist
+		row["artist"] = record.GetString("name")
+	case "Albums":
+		row["type"] = TypeAlbum
+		row["album"] = record.GetString("title")
+		row["artist"] = artistName(app, record.GetString("artist"))
+		row["genre"] = genreText(record)
+	case "Tracks":
+		row["type"] = TypeTrack
+		row["title"] = record.GetString("title")
+		row["artist"] = artistName(app, record.GetString("artist"))
+		row["genre"] = genreText(record)
+		row["lyrics"] = record.GetString("lyrics")
+		if album, err := app.FindRecordById("Albums", record.GetString("album")); err == nil {
+			row["album"] = album.GetString("title")
+			// compilations are found by their album artist as well
+			if albumArtist := artistName(app, album.GetString("artist")); albumArtist != row["artist"] {
+				row["artist"] = row["artist"].(string) + " " + albumArtist
+			}
+		}
+	default:
+		return nil
+	}
+
+	if err := removeFromSearch(app, record.Id); err != nil {
+		return err
+	}
+	result, err := app.DB().NewQuery(
+		"INSERT INTO " + SearchTable + " (type, ref, title, artist, album, genre, lyrics) " +
+			"VALUES ({:type}, {:ref}, {:title}, {:artist}, {:album}, {:genre}, {:lyrics})",
+	).Bind(row).Execute()
+	if err != nil {
+		return err
+	}
+	rowId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = app.DB().NewQuery(
+		"INSERT INTO " + searchRefsTable + " (ref, row) VALUES ({:ref}, {:row})",
+	).Bind(dbx.Params{"ref": record.Id, "row": rowId}).Execute()
+	return err
+}
+
+// removeFromSearch deletes the row of id by its rowid, ref is UNINDEXED
+// and a WHERE on it would read every row of the index
+func removeFromSearch(app core.App, id string) error {
+	var rowIds []int64
+	err := app.DB().NewQuery("SELECT row FROM " + searchRefsTable + " WHERE ref = {:ref}").
+		Bind(dbx.Params{"ref": id}).Column(&rowIds)
+	if err != nil || len(rowIds) == 0 {
+		return err
+	}
+	if _, err := app.DB().NewQuery("DELETE FROM " + SearchTable + " WHERE rowid = {:row}").
+		Bind(dbx.Params{"row": rowIds[0]}).Execute(); err != nil {
+		return err
+	}
+	_, err = app.DB().NewQuery("DELETE FROM " + searchRefsTable + " WHERE ref = {:ref}").
+		Bind(dbx.Params{"ref": id}).Execute()
+	return err
+}
+
+func artistName(app core.App, id string) string {
+	artist, err := app.FindRecordById("Artists", id)
+	if err != nil {
+		return ""
+	}
+	return artist.GetString("name")
+}
+
+func genreText(record *core.Record) string {
+	var genres []string
+	record.UnmarshalJSONField("genres", &genres)
+	return strings.Join(genres, " ")
+}
+
+// MatchQuery turns what somebody typed into an fts5 query: every word has
+// to match as a prefix, so results show up while typing. words are quoted
+// so fts5 operators in the input are taken literally
+func MatchQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, `"`+w+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
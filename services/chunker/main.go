@@ -7,37 +7,127 @@ package main
 //tell the orchestrator that the file has been created and chunked
 //then the orchestrator will pull the file and save it in mainDB
 import (
+	"context"
 	"log"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
 	"github.com/rudyrdx/music-streamer/chunker/collections"
+	"github.com/rudyrdx/music-streamer/chunker/commands"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/favorites"
 	"github.com/rudyrdx/music-streamer/chunker/handlers"
+	stream "github.com/rudyrdx/music-streamer/chunker/handlers/Stream"
 	"github.com/rudyrdx/music-streamer/chunker/handlers/chunker"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+	"github.com/rudyrdx/music-streamer/chunker/prefetch"
+	"github.com/rudyrdx/music-streamer/chunker/progress"
+	"github.com/rudyrdx/music-streamer/chunker/recommend"
+	"github.com/rudyrdx/music-streamer/chunker/scrobbler"
+	"github.com/rudyrdx/music-streamer/chunker/suggest"
+	"github.com/rudyrdx/music-streamer/chunker/watcher"
 )
 
 func main() {
 	app := pocketbase.New()
 
 	c := cache.New(5*time.Minute, 10*time.Minute)
+	cfg := config.Load()
+
+	var cc *chunkcache.Cache
+	if cfg.ChunkCacheBytes > 0 {
+		cc = chunkcache.New(cfg.ChunkCacheBytes)
+		chunkcache.BindHooks(app, cc)
+	}
+	pf := prefetch.New(cc, prefetch.Options{
+		MaxAhead: cfg.PrefetchMaxChunks,
+		Workers:  cfg.PrefetchWorkers,
+		Horizon:  cfg.PrefetchHorizon,
+	})
+
+	sx := suggest.New()
+	rm := recommend.NewModel(cfg.RadioSessionGap)
+	sb := scrobbler.NewBridge(app, map[string]scrobbler.ScrobbleSink{
+		scrobbler.ServiceListenBrainz: scrobbler.NewListenBrainz(cfg.ListenBrainzURL),
+	}, scrobbler.Options{
+		Interval:   cfg.ScrobbleInterval,
+		BatchSize:  cfg.ScrobbleBatchSize,
+		MinBackoff: cfg.ScrobbleMinBackoff,
+		MaxBackoff: cfg.ScrobbleMaxBackoff,
+	})
 
 	app.OnServe().BindFunc(func(be *core.ServeEvent) error {
 		collections.SetupCollections(app)
+		if err := library.SetupSearch(app); err != nil {
+			app.Logger().Warn("Library", "message", "Failed to set up search", "error", err)
+		}
+		if err := library.Backfill(app); err != nil {
+			app.Logger().Warn("Library", "message", "Failed to backfill library", "error", err)
+		}
+		if err := suggest.Load(app, sx); err != nil {
+			app.Logger().Warn("Suggest", "message", "Failed to load suggestions", "error", err)
+		}
+		if err := rm.Update(app); err != nil {
+			app.Logger().Warn("Radio", "message", "Failed to build radio model", "error", err)
+		}
 		return be.Next()
 	})
 
+	progress.BindHooks(app)
+	chunkindex.BindHooks(app, c)
+	stream.BindHooks(app, c)
+	library.BindHooks(app)
+	favorites.BindHooks(app)
+	suggest.BindHooks(app, sx)
+	sb.BindHooks(app)
+	rm.BindHooks(app)
+
+	// SetupHandlers continues the serve chain itself, calling e.Next()
+	// here too would run the hooks bound after this one twice
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		return handlers.SetupHandlers(e, app, c, cc, pf, sx, sb, rm, cfg)
+	})
+
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		if len(cfg.WatchDirs) > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			go watcher.New(app, cfg).Run(ctx)
+			app.OnTerminate().BindFunc(func(te *core.TerminateEvent) error {
+				cancel()
+				return te.Next()
+			})
+		}
+		return e.Next()
+	})
+
 	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
-		handlers.SetupHandlers(e, app, c)
+		ctx, cancel := context.WithCancel(context.Background())
+		go sb.Run(ctx)
+		app.OnTerminate().BindFunc(func(te *core.TerminateEvent) error {
+			cancel()
+			return te.Next()
+		})
 		return e.Next()
 	})
 
+	app.RootCmd.AddCommand(commands.NewImportCommand(app, cfg))
+
 	app.Cron().MustAdd("Chunk", "*/1 * * * *", func() {
 		mb_2 := 1024 * 1024 * 1
 		chunker.ChunkJob(app, int64(mb_2), true)
 	})
 
+	// the model only reads the plays since its last run
+	app.Cron().MustAdd("Radio", cfg.RadioSchedule, func() {
+		if err := rm.Update(app); err != nil {
+			app.Logger().Warn("Radio", "message", "Failed to update radio model", "error", err)
+		}
+	})
+
 	if err := app.Start(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,3 @@
+package plays
+
+const BlockSize = blockSize
@@ -0,0 +1,208 @@
+// Package plays records who listened to what.
+//
+// plays are inferred from /stream: every listener session (a user and a
+// track) keeps a map of the blocks of the file it fetched, and once they
+// cover MinShare of the file or MinTime worth of audio the session
+// counts as a play. seeking around or fetching the same bytes twice doesn't
+// add up. clients can also report play, skip and complete events, a play
+// they report is only counted when the stream didn't already count one in
+// the same session. every play bumps the play_count of the Tracks record
+package plays
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	TypePlay     = "play"
+	TypeSkip     = "skip"
+	TypeComplete = "complete"
+
+	SourceStream = "stream"
+	SourceClient = "client"
+
+	blockSize = 64 << 10
+)
+
+var (
+	Types   = []string{TypePlay, TypeSkip, TypeComplete}
+	Sources = []string{SourceStream, SourceClient}
+)
+
+type Options struct {
+	// share of the file, 0.5 is half of it
+	MinShare float64
+	// audio time, whichever of the two comes first counts
+	MinTime time.Duration
+	// a session ends after this long without a request, listening again
+	// after that is another play
+	SessionTTL time.Duration
+}
+
+type session struct {
+	mu      sync.Mutex
+	blocks  []bool
+	covered int64
+	counted bool
+}
+
+type Tracker struct {
+	app      core.App
+	opts     Options
+	sessions *cache.Cache
+}
+
+func NewTracker(app core.App, opts Options) *Tracker {
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = 30 * time.Minute
+	}
+	return &Tracker{
+		app:      app,
+		opts:     opts,
+		sessions: cache.New(opts.SessionTTL, opts.SessionTTL),
+	}
+}
+
+func sessionKey(userId, fileId string) string {
+	return userId + "/" + fileId
+}
+
+func (t *Tracker) session(key string, fileSize int64) *session {
+	if v, ok := t.sessions.Get(key); ok {
+		// touching it again keeps an active session alive
+		t.sessions.SetDefault(key, v)
+		return v.(*session)
+	}
+	s := &session{blocks: make([]bool, (fileSize+blockSize-1)/blockSize)}
+	if err := t.sessions.Add(key, s, cache.DefaultExpiration); err != nil {
+		// somebody else created it first
+		if v, ok := t.sessions.Get(key); ok {
+			return v.(*session)
+		}
+	}
+	return s
+}
+
+// Observe notes that n bytes from offset start of file went out to user,
+// it records a play once the session crossed the threshold
+func (t *Tracker) Observe(user *core.Record, file *core.Record, fileSize int64, start int64, n int64) {
+	if t == nil || user == nil || user.IsSuperuser() || n <= 0 || fileSize <= 0 {
+		return
+	}
+	if t.opts.MinShare <= 0 && t.opts.MinTime <= 0 {
+		return
+	}
+
+	s := t.session(sessionKey(user.Id, file.Id), fileSize)
+	s.mu.Lock()
+	// partial blocks at the edges don't count, a player probing the header
+	// and the last bytes shouldn't add up to much
+	first := (start + blockSize - 1) / blockSize
+	last := (start + n) / blockSize
+	if start+n >= fileSize {
+		last = int64(len(s.blocks))
+	}
+	for b := first; b < last && b < int64(len(s.blocks)); b++ {
+		if !s.blocks[b] {
+			s.blocks[b] = true
+			s.covered += min(blockSize, fileSize-b*blockSize)
+		}
+	}
+	reached := !s.counted && s.covered >= t.threshold(file, fileSize)
+	if reached {
+		s.counted = true
+	}
+	s.mu.Unlock()
+
+	if reached {
+		position := 0.0
+		if duration := file.GetFloat("duration"); duration > 0 {
+			position = float64(start+n) / float64(fileSize) * duration
+		}
+		if _, err := t.save(user.Id, file.Id, TypePlay, SourceStream, position); err != nil {
+			t.app.Logger().Error("Plays", "message", "Failed to record play", "file", file.Id, "error", err)
+		}
+	}
+}
+
+// threshold is the byte count that makes a play
+func (t *Tracker) threshold(file *core.Record, fileSize int64) int64 {
+	threshold := fileSize
+	if t.opts.MinShare > 0 {
+		threshold = min(threshold, int64(t.opts.MinShare*float64(fileSize)))
+	}
+	if duration := file.GetFloat("duration"); t.opts.MinTime > 0 && duration > 0 {
+		byteRate := float64(fileSize) / duration
+		threshold = min(threshold, int64(t.opts.MinTime.Seconds()*byteRate))
+	}
+	return max(threshold, 1)
+}
+
+// Report stores an event sent by a client. it returns the event, or nil
+// for a play the stream had already counted
+func (t *Tracker) Report(user *core.Record, file *core.Record, kind string, position float64) (*core.Record, error) {
+	if kind == TypePlay || kind == TypeComplete {
+		s := t.session(sessionKey(user.Id, file.Id), int64(file.GetInt("file_size")))
+		s.mu.Lock()
+		counted := s.counted
+		s.counted = true
+		s.mu.Unlock()
+
+		// a complete without a play before it still was a play
+		if !counted {
+			played, err := t.save(user.Id, file.Id, TypePlay, SourceClient, position)
+			if err != nil || kind == TypePlay {
+				return played, err
+			}
+		} else if kind == TypePlay {
+			return nil, nil
+		}
+	}
+	return t.save(user.Id, file.Id, kind, SourceClient, position)
+}
+
+// save stores the event and, for plays, bumps the track's play count in
+// the same transaction
+func (t *Tracker) save(userId, fileId, kind, source string, position float64) (*core.Record, error) {
+	var event *core.Record
+	err := t.app.RunInTransaction(func(txApp core.App) error {
+		collection, err := txApp.FindCollectionByNameOrId("PlayEvents")
+		if err != nil {
+			return err
+		}
+		event = core.NewRecord(collection)
+		event.Set("user", userId)
+		event.Set("track", fileId)
+		event.Set("type", kind)
+		event.Set("source", source)
+		event.Set("position", position)
+		if err := txApp.Save(event); err != nil {
+			return err
+		}
+
+		if kind != TypePlay {
+			return nil
+		}
+		// writes go through a single connection, so reading the count and
+		// saving it again inside the transaction can't lose an update
+		track, err := txApp.FindFirstRecordByData("Tracks", "file", fileId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		track.Set("play_count", track.GetInt("play_count")+1)
+		return txApp.Save(track)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
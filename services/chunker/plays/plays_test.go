@@ -0,0 +1,232 @@
+package plays_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	albums "github.com/rudyrdx/music-streamer/chunker/collections/Albums"
+	artists "github.com/rudyrdx/music-streamer/chunker/collections/Artists"
+	playevents "github.com/rudyrdx/music-streamer/chunker/collections/PlayEvents"
+	tracks "github.com/rudyrdx/music-streamer/chunker/collections/Tracks"
+	uploadedfiles "github.com/rudyrdx/music-streamer/chunker/collections/UploadedFiles"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+)
+
+// the test file is ten blocks and 100 seconds long, a block is 10s of audio
+const (
+	testBlocks   = 10
+	testSize     = testBlocks * plays.BlockSize
+	testDuration = 100
+)
+
+type playsTest struct {
+	app  *tests.TestApp
+	user *core.Record
+	file *core.Record
+}
+
+func newPlaysTest(t *testing.T) *playsTest {
+	t.Helper()
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+
+	for _, c := range []*core.Collection{
+		uploadedfiles.CreateCollection(), artists.CreateCollection(), albums.CreateCollection(),
+		tracks.CreateCollection(), playevents.CreateCollection(),
+	} {
+		if err := app.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pt := &playsTest{app: app}
+	pt.user = pt.newRecord(t, "users", map[string]any{"email": "listener@example.com", "password": "password123"})
+	pt.file = pt.newRecord(t, "UploadedFiles", map[string]any{
+		"file_path": "/nonexistent", "file_name": "track.flac", "file_size": testSize,
+		"file_info": map[string]any{"format": "flac"}, "owner": pt.user.Id, "duration": testDuration,
+	})
+	artist := pt.newRecord(t, "Artists", map[string]any{"name": "Band", "name_key": "band"})
+	pt.newRecord(t, "Tracks", map[string]any{"file": pt.file.Id, "title": "Song", "artist": artist.Id})
+	return pt
+}
+
+func (pt *playsTest) newRecord(t *testing.T, collectionName string, data map[string]any) *core.Record {
+	t.Helper()
+	collection, err := pt.app.FindCollectionByNameOrId(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := core.NewRecord(collection)
+	record.Load(data)
+	if v, ok := data["password"]; ok {
+		record.SetPassword(v.(string))
+	}
+	if err := pt.app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// wantPlays checks the number of play events of source and the track's
+// play_count, which has to follow every play whatever its source
+func (pt *playsTest) wantPlays(t *testing.T, source string, want int) {
+	t.Helper()
+	n, err := pt.app.CountRecords("PlayEvents", dbx.HashExp{"type": plays.TypePlay, "source": source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != want {
+		t.Fatalf("%d %s plays, want %d", n, source, want)
+	}
+	all, err := pt.app.CountRecords("PlayEvents", dbx.HashExp{"type": plays.TypePlay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := pt.app.FindFirstRecordByData("Tracks", "file", pt.file.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := track.GetInt("play_count"); count != int(all) {
+		t.Fatalf("play_count %d, %d play events", count, all)
+	}
+}
+
+func (pt *playsTest) blocks(tracker *plays.Tracker, from, to int) {
+	for b := from; b < to; b++ {
+		tracker.Observe(pt.user, pt.file, testSize, int64(b)*plays.BlockSize, plays.BlockSize)
+	}
+}
+
+// players read the header and the last bytes before they play anything
+func TestProbesDontCount(t *testing.T) {
+	pt := newPlaysTest(t)
+	tracker := plays.NewTracker(pt.app, plays.Options{MinShare: 0.1})
+
+	for range 3 {
+		tracker.Observe(pt.user, pt.file, testSize, 0, plays.BlockSize-1)
+		tracker.Observe(pt.user, pt.file, testSize, testSize-plays.BlockSize+1, plays.BlockSize-1)
+		// a range crossing a block edge covers neither block
+		tracker.Observe(pt.user, pt.file, testSize, plays.BlockSize/2, plays.BlockSize)
+	}
+	pt.wantPlays(t, plays.SourceStream, 0)
+
+	// the same probes with a whole block in the middle are one block
+	tracker.Observe(pt.user, pt.file, testSize, plays.BlockSize-1, plays.BlockSize+2)
+	pt.wantPlays(t, plays.SourceStream, 1)
+}
+
+func TestThreshold(t *testing.T) {
+	tests := []struct {
+		name string
+		opts plays.Options
+		// blocks that are still no play, the next one is
+		blocks int
+	}{
+		{"share", plays.Options{MinShare: 0.5}, 4},
+		{"time", plays.Options{MinTime: 30 * time.Second}, 2},
+		{"time first", plays.Options{MinShare: 0.5, MinTime: 30 * time.Second}, 2},
+		{"share first", plays.Options{MinShare: 0.2, MinTime: 60 * time.Second}, 1},
+		{"past the end", plays.Options{MinShare: 2}, testBlocks - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newPlaysTest(t)
+			tracker := plays.NewTracker(pt.app, tt.opts)
+
+			pt.blocks(tracker, 0, tt.blocks)
+			pt.wantPlays(t, plays.SourceStream, 0)
+			pt.blocks(tracker, tt.blocks, tt.blocks+1)
+			pt.wantPlays(t, plays.SourceStream, 1)
+
+			// the rest of the file is the same play
+			pt.blocks(tracker, tt.blocks+1, testBlocks)
+			pt.wantPlays(t, plays.SourceStream, 1)
+		})
+	}
+}
+
+// without a duration only the share is left to go by
+func TestThresholdWithoutDuration(t *testing.T) {
+	pt := newPlaysTest(t)
+	pt.file.Set("duration", 0)
+	tracker := plays.NewTracker(pt.app, plays.Options{MinShare: 0.5, MinTime: 10 * time.Second})
+
+	pt.blocks(tracker, 0, 4)
+	pt.wantPlays(t, plays.SourceStream, 0)
+	pt.blocks(tracker, 4, 5)
+	pt.wantPlays(t, plays.SourceStream, 1)
+}
+
+func TestRepeatedRangesDontAddUp(t *testing.T) {
+	pt := newPlaysTest(t)
+	tracker := plays.NewTracker(pt.app, plays.Options{MinShare: 0.5})
+
+	for range 10 {
+		pt.blocks(tracker, 0, 4)
+		// seeking back and forth over the same stretch
+		tracker.Observe(pt.user, pt.file, testSize, plays.BlockSize, 3*plays.BlockSize)
+	}
+	pt.wantPlays(t, plays.SourceStream, 0)
+
+	pt.blocks(tracker, 7, 8)
+	pt.wantPlays(t, plays.SourceStream, 1)
+}
+
+func TestReport(t *testing.T) {
+	pt := newPlaysTest(t)
+	tracker := plays.NewTracker(pt.app, plays.Options{MinShare: 0.5})
+
+	pt.blocks(tracker, 0, 5)
+	pt.wantPlays(t, plays.SourceStream, 1)
+
+	// the client tells about the play the stream already counted
+	event, err := tracker.Report(pt.user, pt.file, plays.TypePlay, 50)
+	if err != nil || event != nil {
+		t.Fatalf("got %v %v, want no event", event, err)
+	}
+	pt.wantPlays(t, plays.SourceClient, 0)
+
+	// a complete is still stored, without another play
+	event, err = tracker.Report(pt.user, pt.file, plays.TypeComplete, 100)
+	if err != nil || event == nil || event.GetString("type") != plays.TypeComplete {
+		t.Fatalf("got %v %v, want the complete", event, err)
+	}
+	pt.wantPlays(t, plays.SourceClient, 0)
+	pt.wantPlays(t, plays.SourceStream, 1)
+}
+
+func TestReportBeforeStream(t *testing.T) {
+	pt := newPlaysTest(t)
+	tracker := plays.NewTracker(pt.app, plays.Options{MinShare: 0.5})
+
+	// a complete with no play before it brings the play along
+	event, err := tracker.Report(pt.user, pt.file, plays.TypeComplete, 100)
+	if err != nil || event == nil || event.GetString("type") != plays.TypeComplete {
+		t.Fatalf("got %v %v, want the complete", event, err)
+	}
+	pt.wantPlays(t, plays.SourceClient, 1)
+
+	// and the stream doesn't count the same session again
+	pt.blocks(tracker, 0, testBlocks)
+	pt.wantPlays(t, plays.SourceStream, 0)
+	pt.wantPlays(t, plays.SourceClient, 1)
+}
+
+func TestObserveIgnores(t *testing.T) {
+	pt := newPlaysTest(t)
+	superuser, err := pt.app.FindFirstRecordByFilter(core.CollectionNameSuperusers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plays.NewTracker(pt.app, plays.Options{}).Observe(pt.user, pt.file, testSize, 0, testSize)
+	plays.NewTracker(pt.app, plays.Options{MinShare: 0.5}).Observe(superuser, pt.file, testSize, 0, testSize)
+	var tracker *plays.Tracker
+	tracker.Observe(pt.user, pt.file, testSize, 0, testSize)
+	pt.wantPlays(t, plays.SourceStream, 0)
+}
@@ -0,0 +1,218 @@
+package prefetch
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkcache"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
+)
+
+// a listener that just asked for chunk k is going to ask for k+1 next, so
+// after every stream request the following chunks are read in the
+// background, into the chunk cache when there is one or otherwise just
+// through the OS page cache.
+//
+// how far ahead depends on how fast the session reads: a player pulling
+// at playback speed needs a chunk or two, one that is buffering gets
+// more. the speed is measured on the bytes delivered, a browser sends one
+// open ended range and then reads it at its own pace, and the lookahead
+// moves along as the range goes out. warm reads share a fixed number of
+// slots and never wait for one, when all slots are busy the prefetch is
+// dropped so it can't starve the requests that are actually being served
+
+// how much a new rate sample moves the session's average
+const rateWeight = 0.3
+
+// how long a session has to be delivering before its bytes make a rate
+// sample, shorter stretches are mostly socket buffers filling up
+const sampleWindow = time.Second
+
+type Options struct {
+	// upper bound of chunks read ahead of a session
+	MaxAhead int
+	// concurrent warm reads across all sessions
+	Workers int
+	// how many seconds of reading the lookahead should cover
+	Horizon time.Duration
+}
+
+type Prefetcher struct {
+	cache *chunkcache.Cache
+	opts  Options
+
+	slots    chan struct{}
+	sessions *cache.Cache
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+type session struct {
+	mu sync.Mutex
+	// delivery since the last rate sample, the time between requests
+	// isn't counted as the listener waiting for data
+	last   time.Time
+	active time.Duration
+	sent   int64
+	rate   float64 // bytes per second
+
+	// the chunk being delivered and the last one warmed for it
+	chunk  int
+	warmed int
+}
+
+// New returns nil when prefetching is disabled, a nil Prefetcher is safe to use
+func New(cc *chunkcache.Cache, opts Options) *Prefetcher {
+	if opts.MaxAhead <= 0 || opts.Workers <= 0 {
+		return nil
+	}
+	return &Prefetcher{
+		cache:    cc,
+		opts:     opts,
+		slots:    make(chan struct{}, opts.Workers),
+		sessions: cache.New(5*time.Minute, 10*time.Minute),
+		inflight: map[string]bool{},
+	}
+}
+
+// Touch is called when the session asks for bytes start to end (inclusive)
+// of the track, it warms the chunks that follow before anything is sent
+func (p *Prefetcher) Touch(sessionKey string, index *chunkindex.Index, start, end int64) {
+	if p == nil || index.Len() == 0 {
+		return
+	}
+
+	// browsers ask for "bytes=0-" and read as far as they need, for an open
+	// ended range the chunks after the start are the ones coming up
+	pivot := end
+	if end >= index.Size()-1 {
+		pivot = start
+	}
+	current, ok := index.ChunkAt(pivot)
+	if !ok {
+		return
+	}
+
+	s := p.session(sessionKey)
+	s.mu.Lock()
+	s.last = time.Now()
+	s.chunk, s.warmed = current, current
+	p.warmAhead(s, index)
+	s.mu.Unlock()
+}
+
+// Delivered is called as the bytes of the track before pos go out, n of
+// them since the last call. the read rate comes from what the listener
+// actually takes, and the lookahead moves along with the delivery
+func (p *Prefetcher) Delivered(sessionKey string, index *chunkindex.Index, pos, n int64) {
+	if p == nil || index.Len() == 0 || n <= 0 {
+		return
+	}
+
+	s := p.session(sessionKey)
+	s.mu.Lock()
+	now := time.Now()
+	if !s.last.IsZero() {
+		s.active += now.Sub(s.last)
+	}
+	s.last = now
+	s.sent += n
+	if s.active >= sampleWindow {
+		sample := float64(s.sent) / s.active.Seconds()
+		if s.rate == 0 {
+			s.rate = sample
+		} else {
+			s.rate = rateWeight*sample + (1-rateWeight)*s.rate
+		}
+		s.active, s.sent = 0, 0
+	}
+
+	if current, ok := index.ChunkAt(pos - 1); ok {
+		s.chunk = current
+		p.warmAhead(s, index)
+	}
+	s.mu.Unlock()
+}
+
+func (p *Prefetcher) session(key string) *session {
+	if v, ok := p.sessions.Get(key); ok {
+		return v.(*session)
+	}
+	s := &session{}
+	p.sessions.SetDefault(key, s)
+	return s
+}
+
+// warmAhead starts reading the chunks ahead of s.chunk that aren't warm
+// yet. s.warmed only moves past chunks that got a slot, when all slots are
+// taken the rest is tried again on the next call. expects s.mu to be held
+func (p *Prefetcher) warmAhead(s *session, index *chunkindex.Index) {
+	chunkSize := index.Size() / int64(index.Len())
+	to := min(s.chunk+p.lookahead(s.rate, chunkSize), index.Len()-1)
+	for i := max(s.warmed, s.chunk) + 1; i <= to; i++ {
+		path := index.Chunk(i).Path
+		if p.cache == nil || !p.cache.Contains(path) {
+			claimed, full := p.claim(path)
+			if full {
+				return
+			}
+			if claimed {
+				go p.warm(path)
+			}
+		}
+		s.warmed = i
+	}
+}
+
+// lookahead turns a read rate into a number of chunks
+func (p *Prefetcher) lookahead(rate float64, chunkSize int64) int {
+	if rate == 0 || chunkSize <= 0 {
+		return 1
+	}
+	ahead := int(math.Ceil(rate * p.opts.Horizon.Seconds() / float64(chunkSize)))
+	return max(1, min(ahead, p.opts.MaxAhead))
+}
+
+// claim takes a slot for path, full means every slot is taken and nothing
+// else should be queued. a path that is already being read isn't claimed twice
+func (p *Prefetcher) claim(path string) (claimed, full bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inflight[path] {
+		return false, false
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false, true
+	}
+	p.inflight[path] = true
+	return true, false
+}
+
+func (p *Prefetcher) warm(path string) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, path)
+		p.mu.Unlock()
+		<-p.slots
+	}()
+
+	if p.cache != nil {
+		p.cache.Warm(path)
+		return
+	}
+
+	// reading the file is enough to get it into the page cache
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.Copy(io.Discard, f)
+}
@@ -0,0 +1,149 @@
+package prefetch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/chunkindex"
+)
+
+const testChunkSize = 1000
+
+func testIndex(chunks int) *chunkindex.Index {
+	collection := core.NewBaseCollection("ChunkedFiles")
+	records := make([]*core.Record, chunks)
+	for i := range records {
+		records[i] = core.NewRecord(collection)
+		records[i].Id = fmt.Sprintf("chunk%d", i)
+		records[i].Set("chunk_path", fmt.Sprintf("/nonexistent/chunk%d", i))
+		records[i].Set("start_byte_offset", i*testChunkSize)
+		records[i].Set("chunk_size", testChunkSize)
+	}
+	return chunkindex.Build("track", records)
+}
+
+func testPrefetcher() *Prefetcher {
+	return New(nil, Options{MaxAhead: 8, Workers: 64, Horizon: 10 * time.Second})
+}
+
+// an open ended request is one Touch, the rate has to come from the delivery
+func TestDeliveredSamplesRate(t *testing.T) {
+	p := testPrefetcher()
+	index := testIndex(100)
+
+	p.Touch("s", index, 0, index.Size()-1)
+	s := p.session("s")
+	if s.rate != 0 || s.warmed != 1 {
+		t.Fatalf("after touch rate %v warmed %d, want 0 and 1", s.rate, s.warmed)
+	}
+
+	// 400 bytes a second over two seconds
+	s.mu.Lock()
+	s.last = time.Now().Add(-2 * time.Second)
+	s.mu.Unlock()
+	p.Delivered("s", index, 800, 800)
+	if s.rate < 390 || s.rate > 410 {
+		t.Fatalf("rate %v, want about 400", s.rate)
+	}
+	// 10s of 400 B/s is 4 chunks ahead of chunk 0
+	if s.warmed != 4 {
+		t.Fatalf("warmed %d, want 4", s.warmed)
+	}
+
+	// a faster sample moves the average, not replaces it
+	s.mu.Lock()
+	s.last = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	p.Delivered("s", index, 2800, 2000)
+	want := rateWeight*2000 + (1-rateWeight)*400
+	if s.rate < want-10 || s.rate > want+10 {
+		t.Fatalf("rate %v, want about %v", s.rate, want)
+	}
+	// chunk 2 is going out now, 10s of ~880 B/s is capped at MaxAhead
+	if s.chunk != 2 || s.warmed != 10 {
+		t.Fatalf("chunk %d warmed %d, want 2 and 10", s.chunk, s.warmed)
+	}
+}
+
+func TestDeliveredShortStretch(t *testing.T) {
+	p := testPrefetcher()
+	index := testIndex(100)
+
+	p.Touch("s", index, 0, index.Size()-1)
+	// a burst that fills the socket buffers is no rate sample
+	p.Delivered("s", index, 500, 500)
+	s := p.session("s")
+	if s.rate != 0 {
+		t.Fatalf("rate %v after a short burst, want 0", s.rate)
+	}
+	if s.sent != 500 {
+		t.Fatalf("sent %d, want 500 kept for the next sample", s.sent)
+	}
+}
+
+// the time between two requests isn't time spent delivering
+func TestTouchResetsClock(t *testing.T) {
+	p := testPrefetcher()
+	index := testIndex(100)
+
+	p.Touch("s", index, 0, 999)
+	s := p.session("s")
+	s.mu.Lock()
+	s.last = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+
+	p.Touch("s", index, 1000, 1999)
+	p.Delivered("s", index, 2000, 1000)
+	if s.rate != 0 || s.active >= sampleWindow {
+		t.Fatalf("rate %v active %v, the idle minute was counted", s.rate, s.active)
+	}
+}
+
+// chunks that found every slot taken are warmed on a later call
+func TestWarmRetriesWhenFull(t *testing.T) {
+	p := New(nil, Options{MaxAhead: 8, Workers: 1, Horizon: 10 * time.Second})
+	index := testIndex(100)
+
+	// the only slot is busy
+	p.slots <- struct{}{}
+	p.Touch("s", index, 0, index.Size()-1)
+	s := p.session("s")
+	if s.warmed != 0 {
+		t.Fatalf("warmed %d with no slot free, want 0", s.warmed)
+	}
+
+	<-p.slots
+	p.Delivered("s", index, 10, 10)
+	if s.warmed != 1 {
+		t.Fatalf("warmed %d once a slot was free, want 1", s.warmed)
+	}
+}
+
+func TestLookahead(t *testing.T) {
+	p := testPrefetcher()
+	tests := []struct {
+		rate float64
+		want int
+	}{
+		{0, 1},
+		{50, 1},
+		{100, 1},
+		{101, 2},
+		{350, 4},
+		{1e6, 8},
+	}
+	for _, tt := range tests {
+		if got := p.lookahead(tt.rate, testChunkSize); got != tt.want {
+			t.Errorf("lookahead(%v) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestNilPrefetcher(t *testing.T) {
+	var p *Prefetcher
+	index := testIndex(3)
+	p.Touch("s", index, 0, 10)
+	p.Delivered("s", index, 10, 10)
+}
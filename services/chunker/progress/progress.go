@@ -0,0 +1,109 @@
+package progress
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/subscriptions"
+)
+
+// ingest progress is pushed over pocketbase's realtime connection, the
+// frontend subscribes with the js sdk:
+//
+//	pb.realtime.subscribe("ingest", e => ...)          every upload of the user
+//	pb.realtime.subscribe("ingest/" + id, e => ...)    a single upload of the user
+//
+// the current stage is also stored on the UploadedFiles record so a page
+// opened later can show it without waiting for the next event
+
+const Topic = "ingest"
+
+const (
+	StageQueued   = "queued"
+	StageProbing  = "probing"
+	StageChunking = "chunking"
+	StageReady    = "ready"
+	StageFailed   = "failed"
+)
+
+var Stages = []string{StageQueued, StageProbing, StageChunking, StageReady, StageFailed}
+
+type Event struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Stage  string `json:"stage"`
+	Done   int    `json:"done,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BindHooks announces every new UploadedFiles record as queued, whichever
+// way it came in
+func BindHooks(app core.App) {
+	app.OnRecordAfterCreateSuccess("UploadedFiles").BindFunc(func(e *core.RecordEvent) error {
+		Publish(e.App, e.Record, StageQueued, 0, 0, "")
+		return e.Next()
+	})
+}
+
+// SetStage stores the stage on the record and publishes it
+func SetStage(app core.App, record *core.Record, stage string, reason string) error {
+	record.Set("status", stage)
+	record.Set("status_reason", reason)
+	if err := app.Save(record); err != nil {
+		return err
+	}
+	Publish(app, record, stage, 0, 0, reason)
+	return nil
+}
+
+// Publish only notifies clients, use it for in between updates like chunk n/N
+func Publish(app core.App, record *core.Record, stage string, done int, total int, reason string) {
+	broadcast(app, Event{
+		Id:     record.Id,
+		Name:   record.GetString("file_name"),
+		Stage:  stage,
+		Done:   done,
+		Total:  total,
+		Reason: reason,
+	}, Topic+"/"+record.Id, func(auth *core.Record) bool {
+		return auth.IsSuperuser() || record.GetString("owner") == auth.Id || slices.Contains(record.GetStringSlice("uploaders"), auth.Id)
+	})
+}
+
+// PublishRejected reports an upload turned away before it got a record, so
+// the event has no id and only goes out on the topic of every upload
+func PublishRejected(app core.App, uploader *core.Record, name string, reason string) {
+	if uploader == nil {
+		return
+	}
+	broadcast(app, Event{Name: name, Stage: StageFailed, Reason: reason}, "", func(auth *core.Record) bool {
+		return auth.IsSuperuser() || auth.Id == uploader.Id
+	})
+}
+
+// both topics only carry uploads of the subscribed user, knowing an id
+// doesn't get anyone else's file names
+func broadcast(app core.App, event Event, recordTopic string, canSee func(auth *core.Record) bool) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	for _, chunk := range app.SubscriptionsBroker().ChunkedClients(300) {
+		for _, client := range chunk {
+			auth, _ := client.Get(apis.RealtimeClientAuthKey).(*core.Record)
+			if auth == nil || !canSee(auth) {
+				continue
+			}
+			switch {
+			case recordTopic != "" && client.HasSubscription(recordTopic):
+				client.Send(subscriptions.Message{Name: recordTopic, Data: data})
+			case client.HasSubscription(Topic):
+				client.Send(subscriptions.Message{Name: Topic, Data: data})
+			}
+		}
+	}
+}
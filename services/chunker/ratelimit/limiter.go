@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// token buckets per user, per ip and per api key. a request has to find a
+// token in every bucket that applies to it, so logging in doesn't lift the
+// limit of an address and rotating addresses doesn't lift the limit of a user.
+// only keys the limiter was given get a bucket, anyone can make up keys
+// and a bucket for each would just fill memory
+
+type Limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	apiKeys map[string]bool
+
+	mu      sync.Mutex
+	buckets *cache.Cache
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns nil when perMinute is 0, a nil Limiter allows everything
+func NewLimiter(perMinute int, burst int, apiKeys []string) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	known := make(map[string]bool, len(apiKeys))
+	for _, key := range apiKeys {
+		known[key] = true
+	}
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		apiKeys: known,
+		// an idle bucket refills completely long before it expires
+		buckets: cache.New(10*time.Minute, 10*time.Minute),
+	}
+}
+
+// Allow takes a token from every bucket in keys, or from none of them. when
+// it refuses it also says how long until a token is available everywhere
+func (l *Limiter) Allow(keys ...string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	buckets := make([]*bucket, 0, len(keys))
+	var wait time.Duration
+	for _, key := range keys {
+		b := l.bucket(key, now)
+		if b.tokens < 1 {
+			missing := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+			wait = max(wait, missing)
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// bucket returns the refilled bucket of key, callers hold l.mu
+func (l *Limiter) bucket(key string, now time.Time) *bucket {
+	if v, ok := l.buckets.Get(key); ok {
+		b := v.(*bucket)
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		l.buckets.SetDefault(key, b)
+		return b
+	}
+	b := &bucket{tokens: l.burst, last: now}
+	l.buckets.SetDefault(key, b)
+	return b
+}
+
+// Middleware rejects a request with 429 once any of its buckets is empty
+func (l *Limiter) Middleware(e *core.RequestEvent) error {
+	keys := []string{"ip:" + e.RealIP()}
+	if e.Auth != nil {
+		keys = append(keys, "user:"+e.Auth.Id)
+	}
+	if key := e.Request.Header.Get("X-API-Key"); l != nil && l.apiKeys[key] {
+		keys = append(keys, "key:"+key)
+	}
+
+	if ok, wait := l.Allow(keys...); !ok {
+		e.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return e.String(429, "Too Many Requests")
+	}
+	return e.Next()
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	l := NewLimiter(60, 2, nil)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a", "b"); !ok {
+			t.Fatalf("request %d refused inside the burst", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait <= 0 || wait > 1100*time.Millisecond {
+		t.Fatalf("got %v %v, want a refusal for about a second", ok, wait)
+	}
+	// a refused request takes no token from the other buckets
+	if ok, _ := l.Allow("c", "a"); ok {
+		t.Fatal("empty bucket a was ignored")
+	}
+	if ok, _ := l.Allow("c"); !ok {
+		t.Fatal("bucket c lost a token to a refused request")
+	}
+}
+
+func TestLimiterAPIKeys(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+	l := NewLimiter(60, 1, []string{"known"})
+
+	request := func(key string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/stream", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-API-Key", key)
+		e := &core.RequestEvent{App: app}
+		e.Request, e.Response = req, rec
+		if err := l.Middleware(e); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	request("made-up-1")
+	request("made-up-2")
+	if n := l.buckets.ItemCount(); n != 1 {
+		t.Fatalf("%d buckets, unknown keys must not get one", n)
+	}
+	request("known")
+	if _, ok := l.buckets.Get("key:known"); !ok {
+		t.Fatal("known key has no bucket")
+	}
+}
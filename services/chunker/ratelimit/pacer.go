@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// pacing keeps one listener from pulling a whole track as fast as the disk
+// allows. every session may run BufferAhead of playback ahead at full speed,
+// past that delivery is held to Multiple times the track's byte rate. a
+// session is a listener on one track, a request that doesn't continue where
+// the previous one stopped is a seek and starts the clock over
+
+// writes are paced in steps of this size
+const paceStep = 64 << 10
+
+type Pacer struct {
+	multiple    float64
+	bufferAhead time.Duration
+
+	sessions *cache.Cache
+}
+
+type paceSession struct {
+	mu    sync.Mutex
+	start time.Time
+	next  int64 // track offset the session continues from
+	sent  int64 // bytes sent since start
+}
+
+// NewPacer returns nil when multiple is 0, a nil Pacer doesn't pace
+func NewPacer(multiple float64, bufferAhead time.Duration) *Pacer {
+	if multiple <= 0 {
+		return nil
+	}
+	return &Pacer{
+		multiple:    multiple,
+		bufferAhead: bufferAhead,
+		sessions:    cache.New(5*time.Minute, 10*time.Minute),
+	}
+}
+
+// Writer paces what is written to w as part of session, offset is where in
+// the track the response starts and byteRate the track's bytes per second.
+// a wait ends early with ctx's error once the request is gone
+func (p *Pacer) Writer(ctx context.Context, session string, w io.Writer, offset int64, byteRate float64) io.Writer {
+	if p == nil || byteRate <= 0 {
+		return w
+	}
+
+	var s *paceSession
+	if v, ok := p.sessions.Get(session); ok {
+		s = v.(*paceSession)
+	} else {
+		s = &paceSession{}
+		p.sessions.SetDefault(session, s)
+	}
+
+	s.mu.Lock()
+	if s.start.IsZero() || offset != s.next {
+		s.start = time.Now()
+		s.sent = 0
+	}
+	s.next = offset
+	s.mu.Unlock()
+
+	return &pacedWriter{
+		ctx:     ctx,
+		w:       w,
+		session: s,
+		ahead:   int64(byteRate * p.bufferAhead.Seconds()),
+		rate:    byteRate * p.multiple,
+	}
+}
+
+// Duration is the longest sending n bytes of a session can take when paced
+func (p *Pacer) Duration(n int64, byteRate float64) time.Duration {
+	if p == nil || byteRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / (byteRate * p.multiple) * float64(time.Second))
+}
+
+type pacedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	session *paceSession
+	ahead   int64   // bytes allowed before pacing kicks in
+	rate    float64 // bytes per second after that
+}
+
+func (pw *pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, paceStep)
+		if err := pw.wait(int64(n)); err != nil {
+			return written, err
+		}
+		m, err := pw.w.Write(p[written : written+n])
+		pw.done(int64(m))
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom keeps the destination's ReadFrom (and with it sendfile) usable,
+// a LimitedReader is copied step by step by narrowing its limit
+func (pw *pacedWriter) ReadFrom(r io.Reader) (int64, error) {
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{pw}, r)
+	}
+
+	var total int64
+	for lr.N > 0 {
+		n := min(lr.N, paceStep)
+		if err := pw.wait(n); err != nil {
+			return total, err
+		}
+		m, err := io.Copy(pw.w, &io.LimitedReader{R: lr.R, N: n})
+		lr.N -= m
+		pw.done(m)
+		total += m
+		if err != nil {
+			return total, err
+		}
+		if m < n {
+			break
+		}
+	}
+	return total, nil
+}
+
+// wait sleeps until n more bytes fit the session's allowance, a listener
+// that hangs up doesn't keep the handler around until then
+func (pw *pacedWriter) wait(n int64) error {
+	s := pw.session
+	s.mu.Lock()
+	over := s.sent + n - pw.ahead
+	start := s.start
+	s.mu.Unlock()
+	if over <= 0 {
+		return nil
+	}
+
+	due := start.Add(time.Duration(float64(over) / pw.rate * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-pw.ctx.Done():
+		return pw.ctx.Err()
+	}
+}
+
+func (pw *pacedWriter) done(n int64) {
+	s := pw.session
+	s.mu.Lock()
+	s.sent += n
+	s.next += n
+	s.mu.Unlock()
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPacerCancel(t *testing.T) {
+	// 1 KiB/s with nothing ahead, the second step would wait about a minute
+	p := NewPacer(1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf bytes.Buffer
+	w := p.Writer(ctx, "s", &buf, 0, 1024)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 2*paceStep))
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write kept waiting after the request was canceled")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written past the allowance", buf.Len())
+	}
+}
+
+func TestPacerAhead(t *testing.T) {
+	// the buffer ahead goes out without waiting
+	p := NewPacer(1, time.Minute)
+	var buf bytes.Buffer
+	w := p.Writer(context.Background(), "s", &buf, 0, 10*paceStep)
+
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 4*paceStep)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("write took %v inside the buffer ahead", d)
+	}
+}
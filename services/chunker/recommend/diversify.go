@@ -0,0 +1,47 @@
+package recommend
+
+import (
+	"slices"
+)
+
+type Candidate struct {
+	Track  string
+	Artist string
+	Score  float64
+	Reason string
+}
+
+// Diversify picks up to n candidates best first, skipping ahead whenever
+// the next best is by the artist that was just picked. lastArtist is the
+// artist that played right before. when only tracks of the previous
+// artist are left the best of them is taken anyway, a repeat is better
+// than a queue that ends
+func Diversify(candidates []Candidate, lastArtist string, n int) []Candidate {
+	left := slices.Clone(candidates)
+	slices.SortStableFunc(left, func(a, b Candidate) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+
+	picked := make([]Candidate, 0, n)
+	for len(picked) < n {
+		i := slices.IndexFunc(left, func(c Candidate) bool {
+			return c.Artist == "" || c.Artist != lastArtist
+		})
+		if i < 0 {
+			if len(left) == 0 {
+				break
+			}
+			i = 0
+		}
+		picked = append(picked, left[i])
+		lastArtist = left[i].Artist
+		left = slices.Delete(left, i, i+1)
+	}
+	return picked
+}
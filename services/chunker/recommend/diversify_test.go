@@ -0,0 +1,43 @@
+package recommend
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiversify(t *testing.T) {
+	c := func(track, artist string, score float64) Candidate {
+		return Candidate{Track: track, Artist: artist, Score: score}
+	}
+	tests := []struct {
+		name       string
+		candidates []Candidate
+		lastArtist string
+		n          int
+		want       []string
+	}{
+		{"best first", []Candidate{c("a", "x", 1), c("b", "y", 3), c("c", "z", 2)}, "", 3, []string{"b", "c", "a"}},
+		{"no artist twice in a row", []Candidate{c("a1", "a", 3), c("a2", "a", 2), c("b1", "b", 1)}, "", 3, []string{"a1", "b1", "a2"}},
+		{"not after the last artist", []Candidate{c("a1", "a", 3), c("b1", "b", 1)}, "a", 2, []string{"b1", "a1"}},
+		// only the previous artist is left, repeating beats stopping
+		{"repeats when nothing else is left", []Candidate{c("a1", "a", 3), c("a2", "a", 2), c("a3", "a", 1), c("b1", "b", 0.5)}, "", 4, []string{"a1", "b1", "a2", "a3"}},
+		{"only the last artist", []Candidate{c("a1", "a", 2), c("a2", "a", 1)}, "a", 5, []string{"a1", "a2"}},
+		{"unknown artists never clash", []Candidate{c("u1", "", 2), c("u2", "", 1)}, "", 2, []string{"u1", "u2"}},
+		{"n caps the page", []Candidate{c("a", "x", 3), c("b", "y", 2), c("c", "z", 1)}, "", 2, []string{"a", "b"}},
+		{"nothing to pick", nil, "a", 3, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range Diversify(tt.candidates, tt.lastArtist, tt.n) {
+				got = append(got, p.Track)
+			}
+			if got == nil {
+				got = []string{}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
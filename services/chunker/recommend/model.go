@@ -0,0 +1,183 @@
+// Package recommend finds tracks that go with other tracks.
+//
+// the model counts how often two tracks were played in the same listening
+// session, a session being one user's plays without a gap longer than
+// SessionGap. the similarity of two tracks is their co-occurrence over the
+// geometric mean of the sessions each was in, so hits that show up
+// everywhere don't drown out the rest.
+//
+// Update reads only the PlayEvents that came in since the last run, the
+// sessions still open are kept so a session spanning two runs counts as
+// one. the model lives in memory and is rebuilt from the events on startup
+package recommend
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+)
+
+const (
+	// tracks of a session paired with each new one, older ones drop out
+	maxSessionTracks = 50
+	updateBatch      = 5000
+)
+
+type session struct {
+	last   time.Time
+	tracks []string
+}
+
+type eventRow struct {
+	Id      string         `db:"id"`
+	User    string         `db:"user"`
+	Track   string         `db:"track"`
+	Created types.DateTime `db:"created"`
+}
+
+type Model struct {
+	mu       sync.RWMutex
+	pairs    map[string]map[string]float64
+	sessions map[string]float64 // sessions each track was in
+
+	// only touched by Update
+	updating    sync.Mutex
+	open        map[string]*session
+	sessionGap  time.Duration
+	lastCreated string
+	lastId      string
+}
+
+func NewModel(sessionGap time.Duration) *Model {
+	if sessionGap <= 0 {
+		sessionGap = 30 * time.Minute
+	}
+	return &Model{
+		pairs:      map[string]map[string]float64{},
+		sessions:   map[string]float64{},
+		open:       map[string]*session{},
+		sessionGap: sessionGap,
+	}
+}
+
+// Update adds the plays since the last call to the model
+func (m *Model) Update(app core.App) error {
+	m.updating.Lock()
+	defer m.updating.Unlock()
+
+	for {
+		rows := []eventRow{}
+		err := app.DB().
+			Select("id", "user", "track", "created").
+			From("PlayEvents").
+			Where(dbx.HashExp{"type": plays.TypePlay}).
+			AndWhere(dbx.NewExp(
+				"(created > {:created} OR (created = {:created} AND id > {:id}))",
+				dbx.Params{"created": m.lastCreated, "id": m.lastId},
+			)).
+			OrderBy("created ASC", "id ASC").
+			Limit(updateBatch).
+			All(&rows)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		for _, r := range rows {
+			m.add(r)
+		}
+		m.mu.Unlock()
+
+		if len(rows) > 0 {
+			last := rows[len(rows)-1]
+			m.lastCreated, m.lastId = last.Created.String(), last.Id
+		}
+		if len(rows) < updateBatch {
+			break
+		}
+	}
+
+	// sessions that ended can't get new tracks anymore
+	now := time.Now()
+	for user, s := range m.open {
+		if now.Sub(s.last) > m.sessionGap {
+			delete(m.open, user)
+		}
+	}
+	return nil
+}
+
+// add expects m.mu to be held
+func (m *Model) add(r eventRow) {
+	at := r.Created.Time()
+	s, ok := m.open[r.User]
+	if !ok || at.Sub(s.last) > m.sessionGap {
+		s = &session{}
+		m.open[r.User] = s
+	}
+	s.last = at
+
+	for _, t := range s.tracks {
+		if t == r.Track {
+			// a repeat in the same session adds nothing
+			return
+		}
+	}
+	for _, t := range s.tracks {
+		m.pair(t, r.Track)
+		m.pair(r.Track, t)
+	}
+	m.sessions[r.Track]++
+
+	s.tracks = append(s.tracks, r.Track)
+	if len(s.tracks) > maxSessionTracks {
+		s.tracks = s.tracks[1:]
+	}
+}
+
+func (m *Model) pair(a, b string) {
+	row, ok := m.pairs[a]
+	if !ok {
+		row = map[string]float64{}
+		m.pairs[a] = row
+	}
+	row[b]++
+}
+
+// Remove forgets a track, for when its file is deleted
+func (m *Model) Remove(track string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for other := range m.pairs[track] {
+		delete(m.pairs[other], track)
+	}
+	delete(m.pairs, track)
+	delete(m.sessions, track)
+}
+
+// Similar returns the tracks played together with track and how similar
+// they are, from 0 to 1
+func (m *Model) Similar(track string) map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	similar := make(map[string]float64, len(m.pairs[track]))
+	for other, together := range m.pairs[track] {
+		similar[other] = together / math.Sqrt(m.sessions[track]*m.sessions[other])
+	}
+	return similar
+}
+
+// BindHooks keeps deleted tracks out of the model
+func (m *Model) BindHooks(app core.App) {
+	app.OnRecordAfterDeleteSuccess("UploadedFiles").BindFunc(func(e *core.RecordEvent) error {
+		m.Remove(e.Record.Id)
+		return e.Next()
+	})
+}
@@ -0,0 +1,312 @@
+package scrobbler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/rudyrdx/music-streamer/chunker/plays"
+)
+
+type Options struct {
+	// how often the outbox is checked when no new plays come in
+	Interval time.Duration
+	// listens per request
+	BatchSize int
+	// the delay before a retry starts at MinBackoff and doubles with every
+	// failed attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type Bridge struct {
+	app   core.App
+	sinks map[string]ScrobbleSink
+	opts  Options
+	wake  chan struct{}
+}
+
+func NewBridge(app core.App, sinks map[string]ScrobbleSink, opts Options) *Bridge {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 30 * time.Second
+	}
+	opts.MaxBackoff = max(opts.MaxBackoff, opts.MinBackoff)
+	return &Bridge{
+		app:   app,
+		sinks: sinks,
+		opts:  opts,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// BindHooks queues every play for the user's linked accounts
+func (b *Bridge) BindHooks(app core.App) {
+	app.OnRecordAfterCreateSuccess("PlayEvents").BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.GetString("type") != plays.TypePlay {
+			return e.Next()
+		}
+		queued, err := Enqueue(e.App, e.Record)
+		if err != nil {
+			e.App.Logger().Error("Scrobbler", "message", "Failed to queue listen", "event", e.Record.Id, "error", err)
+		} else if queued > 0 {
+			b.Wake()
+		}
+		return e.Next()
+	})
+}
+
+// Wake has Run look at the outbox now instead of at the next tick
+func (b *Bridge) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Resume makes everything queued for account due again, for when the user
+// linked it again after the token was refused
+func (b *Bridge) Resume(app core.App, accountId string) error {
+	_, err := app.DB().
+		Update("ScrobbleOutbox", dbx.Params{"next_attempt": ""}, dbx.HashExp{"account": accountId}).
+		Execute()
+	if err != nil {
+		return err
+	}
+	b.Wake()
+	return nil
+}
+
+// Enqueue puts a play event into the outbox of every account of its user
+// and returns how many rows it added. accounts with a refused token queue
+// too, linking them again sends what was played in the meantime
+func Enqueue(app core.App, event *core.Record) (int, error) {
+	accounts, err := app.FindAllRecords("ScrobbleAccounts", dbx.HashExp{"user": event.GetString("user")})
+	if err != nil || len(accounts) == 0 {
+		return 0, err
+	}
+
+	listen, err := listenFor(app, event)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// not in the library, there is nothing to name the listen by
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	collection, err := app.FindCollectionByNameOrId("ScrobbleOutbox")
+	if err != nil {
+		return 0, err
+	}
+	for _, account := range accounts {
+		item := core.NewRecord(collection)
+		item.Set("account", account.Id)
+		item.Set("listen", listen)
+		item.Set("next_attempt", types.NowDateTime())
+		if err := app.Save(item); err != nil {
+			return 0, err
+		}
+	}
+	return len(accounts), nil
+}
+
+func listenFor(app core.App, event *core.Record) (Listen, error) {
+	track, err := app.FindFirstRecordByData("Tracks", "file", event.GetString("track"))
+	if err != nil {
+		return Listen{}, err
+	}
+	artist, err := app.FindRecordById("Artists", track.GetString("artist"))
+	if err != nil {
+		return Listen{}, err
+	}
+
+	// a play is counted partway through, the listen started before that
+	started := event.GetDateTime("created").Time().Add(-time.Duration(event.GetFloat("position") * float64(time.Second)))
+	listen := Listen{
+		ListenedAt:         started.Unix(),
+		Track:              track.GetString("title"),
+		Artist:             artist.GetString("name"),
+		Duration:           track.GetFloat("duration"),
+		TrackNumber:        track.GetInt("track_number"),
+		MusicBrainzTrackId: track.GetString("musicbrainz_id"),
+		MusicBrainzArtist:  artist.GetString("musicbrainz_id"),
+	}
+	if albumId := track.GetString("album"); albumId != "" {
+		if album, err := app.FindRecordById("Albums", albumId); err == nil {
+			listen.Album = album.GetString("title")
+			listen.MusicBrainzAlbumId = album.GetString("musicbrainz_id")
+		}
+	}
+	return listen, nil
+}
+
+func (b *Bridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		b.flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// flush submits what is due, account by account
+func (b *Bridge) flush(ctx context.Context) {
+	var accountIds []string
+	err := b.app.DB().
+		Select("o.account").
+		Distinct(true).
+		From("ScrobbleOutbox o").
+		InnerJoin("ScrobbleAccounts a", dbx.NewExp("a.id = o.account")).
+		Where(dbx.HashExp{"a.enabled": true}).
+		AndWhere(dbx.NewExp("o.next_attempt <= {:now}", dbx.Params{"now": types.NowDateTime().String()})).
+		Column(&accountIds)
+	if err != nil {
+		b.app.Logger().Error("Scrobbler", "message", "Failed to read outbox", "error", err)
+		return
+	}
+
+	for _, id := range accountIds {
+		account, err := b.app.FindRecordById("ScrobbleAccounts", id)
+		if err != nil {
+			continue
+		}
+		// a full batch means there may be more
+		for ctx.Err() == nil && b.flushAccount(ctx, account) {
+		}
+	}
+}
+
+// flushAccount sends one batch and reports whether another one could follow
+func (b *Bridge) flushAccount(ctx context.Context, account *core.Record) bool {
+	sink, ok := b.sinks[account.GetString("service")]
+	if !ok {
+		return false
+	}
+
+	items, err := b.app.FindRecordsByFilter(
+		"ScrobbleOutbox",
+		"account = {:account} && next_attempt <= {:now}",
+		"created",
+		b.opts.BatchSize,
+		0,
+		dbx.Params{"account": account.Id, "now": types.NowDateTime().String()},
+	)
+	if err != nil || len(items) == 0 {
+		return false
+	}
+
+	token := account.GetString("token")
+	err = sink.Submit(ctx, token, decodeListens(items))
+	switch {
+	case err == nil:
+		b.delete(items)
+		b.setAccountError(account, "")
+		return len(items) == b.opts.BatchSize
+	case errors.Is(err, ErrUnauthorized):
+		account.Set("enabled", false)
+		b.setAccountError(account, err.Error())
+		return false
+	case errors.Is(err, ErrRejected):
+		// one bad listen fails the whole batch, sending them one at a time
+		// finds it and lets the others through
+		for _, item := range items {
+			err := sink.Submit(ctx, token, decodeListens([]*core.Record{item}))
+			switch {
+			case err == nil:
+				b.delete([]*core.Record{item})
+			case errors.Is(err, ErrRejected):
+				b.app.Logger().Warn("Scrobbler", "message", "Dropped rejected listen", "account", account.Id, "error", err)
+				b.delete([]*core.Record{item})
+			default:
+				b.retry([]*core.Record{item}, err)
+			}
+		}
+		return false
+	case ctx.Err() != nil:
+		// shutting down, not the service's fault
+		return false
+	default:
+		b.retry(items, err)
+		b.setAccountError(account, err.Error())
+		return false
+	}
+}
+
+func decodeListens(items []*core.Record) []Listen {
+	listens := make([]Listen, 0, len(items))
+	for _, item := range items {
+		var l Listen
+		item.UnmarshalJSONField("listen", &l)
+		listens = append(listens, l)
+	}
+	return listens
+}
+
+func (b *Bridge) delete(items []*core.Record) {
+	err := b.app.RunInTransaction(func(txApp core.App) error {
+		for _, item := range items {
+			if err := txApp.Delete(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.app.Logger().Error("Scrobbler", "message", "Failed to clear outbox", "error", err)
+	}
+}
+
+func (b *Bridge) retry(items []*core.Record, cause error) {
+	for _, item := range items {
+		attempts := item.GetInt("attempts") + 1
+		item.Set("attempts", attempts)
+		item.Set("next_attempt", types.NowDateTime().Add(b.backoff(attempts)))
+		item.Set("last_error", cause.Error())
+		if err := b.app.Save(item); err != nil {
+			b.app.Logger().Error("Scrobbler", "message", "Failed to reschedule listen", "item", item.Id, "error", err)
+		}
+	}
+}
+
+// backoff doubles with every attempt, the jitter keeps a batch of failed
+// accounts from all coming back in the same second
+func (b *Bridge) backoff(attempts int) time.Duration {
+	// doubling stops at MaxBackoff, shifting further would overflow
+	d := b.opts.MinBackoff
+	for i := 1; i < attempts && d < b.opts.MaxBackoff; i++ {
+		if d > b.opts.MaxBackoff/2 {
+			d = b.opts.MaxBackoff
+		} else {
+			d *= 2
+		}
+	}
+	return d - time.Duration(rand.Int64N(int64(d)/5+1))
+}
+
+func (b *Bridge) setAccountError(account *core.Record, message string) {
+	if account.GetString("last_error") == message && account.GetBool("enabled") == account.Original().GetBool("enabled") {
+		return
+	}
+	account.Set("last_error", message)
+	if err := b.app.Save(account); err != nil {
+		b.app.Logger().Error("Scrobbler", "message", "Failed to update account", "account", account.Id, "error", err)
+	}
+}
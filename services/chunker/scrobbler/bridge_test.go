@@ -0,0 +1,298 @@
+package scrobbler_test
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/types"
+	scrobbleaccounts "github.com/rudyrdx/music-streamer/chunker/collections/ScrobbleAccounts"
+	scrobbleoutbox "github.com/rudyrdx/music-streamer/chunker/collections/ScrobbleOutbox"
+	"github.com/rudyrdx/music-streamer/chunker/scrobbler"
+)
+
+const minBackoff = time.Minute
+
+// fakeListenBrainz answers every submission with what status returns for
+// its track names and keeps what it was sent
+type fakeListenBrainz struct {
+	mu          sync.Mutex
+	status      func(tracks []string) int
+	submissions [][]string
+	types       []string
+}
+
+func (f *fakeListenBrainz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/1/submit-listens" || r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, "bad request", 500)
+		return
+	}
+	var body struct {
+		ListenType string `json:"listen_type"`
+		Payload    []struct {
+			TrackMetadata struct {
+				TrackName string `json:"track_name"`
+			} `json:"track_metadata"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var tracks []string
+	for _, l := range body.Payload {
+		tracks = append(tracks, l.TrackMetadata.TrackName)
+	}
+
+	f.mu.Lock()
+	f.submissions = append(f.submissions, tracks)
+	f.types = append(f.types, body.ListenType)
+	status := f.status(tracks)
+	f.mu.Unlock()
+
+	w.WriteHeader(status)
+	w.Write([]byte(`{"status":"whatever"}`))
+}
+
+type bridgeTest struct {
+	app     *tests.TestApp
+	bridge  *scrobbler.Bridge
+	account *core.Record
+	lb      *fakeListenBrainz
+}
+
+func newBridgeTest(t *testing.T, status func(tracks []string) int) *bridgeTest {
+	t.Helper()
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+
+	for _, c := range []*core.Collection{scrobbleaccounts.CreateCollection(), scrobbleoutbox.CreateCollection()} {
+		if err := app.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := core.NewRecord(users)
+	user.SetEmail("listener@example.com")
+	user.SetPassword("password123")
+	if err := app.Save(user); err != nil {
+		t.Fatal(err)
+	}
+	accounts, _ := app.FindCollectionByNameOrId("ScrobbleAccounts")
+	account := core.NewRecord(accounts)
+	account.Set("user", user.Id)
+	account.Set("service", scrobbler.ServiceListenBrainz)
+	account.Set("token", "secret")
+	account.Set("enabled", true)
+	if err := app.Save(account); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := &fakeListenBrainz{status: status}
+	server := httptest.NewServer(lb)
+	t.Cleanup(server.Close)
+
+	bridge := scrobbler.NewBridge(app, map[string]scrobbler.ScrobbleSink{
+		scrobbler.ServiceListenBrainz: scrobbler.NewListenBrainz(server.URL),
+	}, scrobbler.Options{BatchSize: 10, MinBackoff: minBackoff, MaxBackoff: time.Hour})
+
+	return &bridgeTest{app: app, bridge: bridge, account: account, lb: lb}
+}
+
+func (bt *bridgeTest) queue(t *testing.T, tracks ...string) {
+	t.Helper()
+	outbox, _ := bt.app.FindCollectionByNameOrId("ScrobbleOutbox")
+	for i, track := range tracks {
+		item := core.NewRecord(outbox)
+		item.Set("account", bt.account.Id)
+		item.Set("listen", scrobbler.Listen{ListenedAt: int64(1700000000 + i), Track: track, Artist: "Artist"})
+		item.Set("next_attempt", types.NowDateTime().Add(-time.Second))
+		if err := bt.app.Save(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (bt *bridgeTest) outbox(t *testing.T) []*core.Record {
+	t.Helper()
+	items, err := bt.app.FindAllRecords("ScrobbleOutbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func (bt *bridgeTest) reloadAccount(t *testing.T) *core.Record {
+	t.Helper()
+	account, err := bt.app.FindRecordById("ScrobbleAccounts", bt.account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func TestBridgeSubmits(t *testing.T) {
+	bt := newBridgeTest(t, func([]string) int { return http.StatusOK })
+	bt.queue(t, "a", "b", "c")
+
+	bt.bridge.Flush(context.Background())
+
+	if len(bt.lb.submissions) != 1 || len(bt.lb.submissions[0]) != 3 || bt.lb.types[0] != "import" {
+		t.Fatalf("submissions %v %v, want one import of 3", bt.lb.submissions, bt.lb.types)
+	}
+	if items := bt.outbox(t); len(items) != 0 {
+		t.Fatalf("%d listens left in the outbox", len(items))
+	}
+
+	bt.queue(t, "d")
+	bt.bridge.Flush(context.Background())
+	if len(bt.lb.submissions) != 2 || bt.lb.types[1] != "single" {
+		t.Fatalf("submissions %v %v, want a single listen", bt.lb.submissions, bt.lb.types)
+	}
+}
+
+func TestBridgeSplitsRejectedBatch(t *testing.T) {
+	bt := newBridgeTest(t, func(tracks []string) int {
+		for _, track := range tracks {
+			if track == "bad" {
+				return http.StatusBadRequest
+			}
+		}
+		return http.StatusOK
+	})
+	bt.queue(t, "a", "bad", "c")
+
+	bt.bridge.Flush(context.Background())
+
+	// the batch, then every listen on its own
+	if len(bt.lb.submissions) != 4 {
+		t.Fatalf("submissions %v, want the batch and 3 single listens", bt.lb.submissions)
+	}
+	for i, s := range bt.lb.submissions[1:] {
+		if len(s) != 1 || bt.lb.types[i+1] != "single" {
+			t.Fatalf("submission %v is not a single listen", s)
+		}
+	}
+	// the good ones went through, the bad one is dropped
+	if items := bt.outbox(t); len(items) != 0 {
+		t.Fatalf("%d listens left in the outbox", len(items))
+	}
+	if account := bt.reloadAccount(t); !account.GetBool("enabled") {
+		t.Fatal("a rejected listen disabled the account")
+	}
+}
+
+func TestBridgeDisablesOnUnauthorized(t *testing.T) {
+	bt := newBridgeTest(t, func([]string) int { return http.StatusUnauthorized })
+	bt.queue(t, "a", "b")
+
+	bt.bridge.Flush(context.Background())
+
+	account := bt.reloadAccount(t)
+	if account.GetBool("enabled") || account.GetString("last_error") == "" {
+		t.Fatalf("account enabled %v last_error %q, want disabled with an error", account.GetBool("enabled"), account.GetString("last_error"))
+	}
+	// the listens wait for the account to be linked again
+	if items := bt.outbox(t); len(items) != 2 {
+		t.Fatalf("%d listens in the outbox, want 2", len(items))
+	}
+
+	bt.bridge.Flush(context.Background())
+	if len(bt.lb.submissions) != 1 {
+		t.Fatalf("%d submissions, a disabled account was flushed again", len(bt.lb.submissions))
+	}
+}
+
+func TestBridgeBacksOff(t *testing.T) {
+	bt := newBridgeTest(t, func([]string) int { return http.StatusServiceUnavailable })
+	bt.queue(t, "a", "b")
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		before := time.Now()
+		bt.bridge.Flush(context.Background())
+
+		items := bt.outbox(t)
+		if len(items) != 2 {
+			t.Fatalf("attempt %d: %d listens in the outbox, want 2", attempt, len(items))
+		}
+		// MinBackoff doubling, less up to a fifth of jitter
+		backoff := minBackoff << (attempt - 1)
+		for _, item := range items {
+			if item.GetInt("attempts") != attempt || item.GetString("last_error") == "" {
+				t.Fatalf("attempt %d: attempts %d last_error %q", attempt, item.GetInt("attempts"), item.GetString("last_error"))
+			}
+			wait := item.GetDateTime("next_attempt").Time().Sub(before)
+			if wait < backoff*4/5-time.Second || wait > backoff+time.Second {
+				t.Fatalf("attempt %d: retry in %v, want about %v", attempt, wait, backoff)
+			}
+		}
+		if account := bt.reloadAccount(t); !account.GetBool("enabled") || account.GetString("last_error") == "" {
+			t.Fatalf("attempt %d: account should stay enabled with the error noted", attempt)
+		}
+
+		// nothing is due until the backoff is over
+		bt.bridge.Flush(context.Background())
+		if len(bt.lb.submissions) != attempt {
+			t.Fatalf("attempt %d: %d submissions, the backoff was ignored", attempt, len(bt.lb.submissions))
+		}
+		for _, item := range items {
+			item.Set("next_attempt", types.NowDateTime().Add(-time.Second))
+			if err := bt.app.Save(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// once the service is back everything goes through and the error clears
+	bt.lb.mu.Lock()
+	bt.lb.status = func([]string) int { return http.StatusOK }
+	bt.lb.mu.Unlock()
+	bt.bridge.Flush(context.Background())
+	if items := bt.outbox(t); len(items) != 0 {
+		t.Fatalf("%d listens left after the service came back", len(items))
+	}
+	if account := bt.reloadAccount(t); account.GetString("last_error") != "" {
+		t.Fatalf("last_error %q kept after a successful submission", account.GetString("last_error"))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+	}{
+		{"defaults", 30 * time.Second, 6 * time.Hour},
+		{"min is max", time.Minute, time.Minute},
+		{"huge max", time.Second, time.Duration(math.MaxInt64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := scrobbler.NewBridge(nil, nil, scrobbler.Options{MinBackoff: tt.min, MaxBackoff: tt.max})
+			// the attempts count is kept in the outbox, it can get far past
+			// where shifting MinBackoff overflows
+			for attempts := 1; attempts <= 100; attempts++ {
+				want := tt.max
+				if doubled := float64(tt.min) * math.Pow(2, float64(attempts-1)); doubled < float64(tt.max) {
+					want = time.Duration(doubled)
+				}
+				d := b.Backoff(attempts)
+				if d <= 0 || d > want || d < want-want/5 {
+					t.Fatalf("backoff(%d) = %v, want %v less up to a fifth", attempts, d, want)
+				}
+			}
+		})
+	}
+}
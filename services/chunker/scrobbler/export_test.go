@@ -0,0 +1,15 @@
+package scrobbler
+
+import (
+	"context"
+	"time"
+)
+
+// Flush runs one pass over the outbox, the way Run does on every tick
+func (b *Bridge) Flush(ctx context.Context) {
+	b.flush(ctx)
+}
+
+func (b *Bridge) Backoff(attempts int) time.Duration {
+	return b.backoff(attempts)
+}
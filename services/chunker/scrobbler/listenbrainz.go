@@ -0,0 +1,127 @@
+package scrobbler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ServiceListenBrainz = "listenbrainz"
+
+	DefaultListenBrainzURL = "https://api.listenbrainz.org"
+
+	submissionClient = "music-streamer"
+)
+
+// ListenBrainz talks the ListenBrainz api, which other services like
+// Maloja or Koito speak too, so BaseURL can point at any of them
+type ListenBrainz struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewListenBrainz(baseURL string) *ListenBrainz {
+	if baseURL == "" {
+		baseURL = DefaultListenBrainzURL
+	}
+	return &ListenBrainz{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type lbSubmission struct {
+	ListenType string     `json:"listen_type"`
+	Payload    []lbListen `json:"payload"`
+}
+
+type lbListen struct {
+	ListenedAt    int64           `json:"listened_at"`
+	TrackMetadata lbTrackMetadata `json:"track_metadata"`
+}
+
+type lbTrackMetadata struct {
+	ArtistName     string            `json:"artist_name"`
+	TrackName      string            `json:"track_name"`
+	ReleaseName    string            `json:"release_name,omitempty"`
+	AdditionalInfo *lbAdditionalInfo `json:"additional_info,omitempty"`
+}
+
+type lbAdditionalInfo struct {
+	DurationMs       int64    `json:"duration_ms,omitempty"`
+	TrackNumber      int      `json:"tracknumber,omitempty"`
+	RecordingMbid    string   `json:"recording_mbid,omitempty"`
+	ReleaseMbid      string   `json:"release_mbid,omitempty"`
+	ArtistMbids      []string `json:"artist_mbids,omitempty"`
+	SubmissionClient string   `json:"submission_client"`
+}
+
+func (lb *ListenBrainz) Submit(ctx context.Context, token string, listens []Listen) error {
+	if len(listens) == 0 {
+		return nil
+	}
+
+	// "single" is for a listen that just happened, anything batched up is
+	// an import
+	submission := lbSubmission{ListenType: "import"}
+	if len(listens) == 1 {
+		submission.ListenType = "single"
+	}
+	for _, l := range listens {
+		info := &lbAdditionalInfo{
+			DurationMs:       int64(l.Duration * 1000),
+			TrackNumber:      l.TrackNumber,
+			RecordingMbid:    l.MusicBrainzTrackId,
+			ReleaseMbid:      l.MusicBrainzAlbumId,
+			SubmissionClient: submissionClient,
+		}
+		if l.MusicBrainzArtist != "" {
+			info.ArtistMbids = []string{l.MusicBrainzArtist}
+		}
+		submission.Payload = append(submission.Payload, lbListen{
+			ListenedAt: l.ListenedAt,
+			TrackMetadata: lbTrackMetadata{
+				ArtistName:     l.Artist,
+				TrackName:      l.Track,
+				ReleaseName:    l.Album,
+				AdditionalInfo: info,
+			},
+		})
+	}
+
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lb.BaseURL+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := lb.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case res.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("%w: %s", ErrRejected, bytes.TrimSpace(message))
+	default:
+		// 429 and 5xx, try again later
+		return fmt.Errorf("listenbrainz answered %d: %s", res.StatusCode, bytes.TrimSpace(message))
+	}
+}
@@ -0,0 +1,43 @@
+// Package scrobbler forwards plays to outside services like ListenBrainz.
+//
+// every play of a user with a linked account goes into the ScrobbleOutbox
+// collection first, the Bridge then submits what is due in batches. when
+// the service can't be reached the listens stay queued and are retried
+// with a growing delay, a restart doesn't lose them
+package scrobbler
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	Services = []string{ServiceListenBrainz}
+
+	// the service refused the token, nothing gets through until the user
+	// links the account again
+	ErrUnauthorized = errors.New("token rejected")
+	// the service refused the listens themselves, sending them again won't
+	// help
+	ErrRejected = errors.New("listens rejected")
+)
+
+type Listen struct {
+	ListenedAt int64   `json:"listenedAt"` // unix seconds
+	Track      string  `json:"track"`
+	Artist     string  `json:"artist"`
+	Album      string  `json:"album,omitempty"`
+	Duration   float64 `json:"duration,omitempty"` // seconds
+
+	TrackNumber        int    `json:"trackNumber,omitempty"`
+	MusicBrainzTrackId string `json:"musicbrainzTrackId,omitempty"`
+	MusicBrainzAlbumId string `json:"musicbrainzAlbumId,omitempty"`
+	MusicBrainzArtist  string `json:"musicbrainzArtistId,omitempty"`
+}
+
+// ScrobbleSink is a service listens can be sent to. errors other than
+// ErrUnauthorized and ErrRejected are taken as the service being
+// unreachable for now
+type ScrobbleSink interface {
+	Submit(ctx context.Context, token string, listens []Listen) error
+}
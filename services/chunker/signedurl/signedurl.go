@@ -0,0 +1,132 @@
+// Package signedurl issues and checks expiring /stream urls for places that
+// can't send headers, like the src of an <audio> tag.
+//
+// the signature is an HMAC-SHA256 over the track id, expiry, user, client
+// ip and rendition, so none of them can be changed without breaking it. ip
+// and rendition are optional, an empty value in the signature means any.
+// keys rotate the same way as the totp secrets, every url names the key it
+// was signed with and the verifier accepts all configured keys
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rudyrdx/music-streamer/chunker/totp"
+)
+
+var (
+	ErrMalformed  = errors.New("malformed signed url")
+	ErrUnknownKey = errors.New("unknown key id")
+	ErrSignature  = errors.New("invalid signature")
+	ErrExpired    = errors.New("signed url expired")
+	ErrWrongIP    = errors.New("signed url is bound to another address")
+)
+
+type Params struct {
+	TrackId   string
+	UserId    string
+	Expires   time.Time
+	IP        string
+	Rendition string
+}
+
+// Sign returns the query parameters that make up the signed url, they go
+// next to nothing else on /stream
+func Sign(secret totp.Secret, p Params) url.Values {
+	q := url.Values{}
+	q.Set("id", p.TrackId)
+	q.Set("exp", strconv.FormatInt(p.Expires.Unix(), 10))
+	if p.UserId != "" {
+		q.Set("uid", p.UserId)
+	}
+	if p.IP != "" {
+		q.Set("ip", p.IP)
+	}
+	if p.Rendition != "" {
+		q.Set("rendition", p.Rendition)
+	}
+	q.Set("kid", secret.Id)
+	q.Set("sig", signature(secret.Key, q))
+	return q
+}
+
+// IsSigned tells a signed url apart from a plain request
+func IsSigned(q url.Values) bool {
+	return q.Has("sig")
+}
+
+type Verifier struct {
+	keys map[string][]byte
+}
+
+func NewVerifier(secrets []totp.Secret) *Verifier {
+	keys := make(map[string][]byte, len(secrets))
+	for _, s := range secrets {
+		keys[s.Id] = s.Key
+	}
+	return &Verifier{keys: keys}
+}
+
+// Verify checks the signature of q and returns what it was signed for,
+// clientIP is compared against the bound ip when there is one
+func (v *Verifier) Verify(q url.Values, clientIP string, now time.Time) (Params, error) {
+	var p Params
+	for _, name := range []string{"id", "exp", "uid", "ip", "rendition", "kid", "sig"} {
+		if len(q[name]) > 1 || strings.Contains(q.Get(name), "\n") {
+			return p, ErrMalformed
+		}
+	}
+	if q.Get("id") == "" || q.Get("sig") == "" {
+		return p, ErrMalformed
+	}
+
+	key, ok := v.keys[q.Get("kid")]
+	if !ok {
+		return p, ErrUnknownKey
+	}
+	if !hmac.Equal([]byte(signature(key, q)), []byte(q.Get("sig"))) {
+		return p, ErrSignature
+	}
+
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return p, ErrMalformed
+	}
+	p = Params{
+		TrackId:   q.Get("id"),
+		UserId:    q.Get("uid"),
+		Expires:   time.Unix(exp, 0),
+		IP:        q.Get("ip"),
+		Rendition: q.Get("rendition"),
+	}
+	if now.After(p.Expires) {
+		return p, ErrExpired
+	}
+	if p.IP != "" && p.IP != clientIP {
+		return p, ErrWrongIP
+	}
+	return p, nil
+}
+
+func signature(key []byte, q url.Values) string {
+	canonical := strings.Join([]string{
+		"v1",
+		q.Get("id"),
+		q.Get("exp"),
+		q.Get("uid"),
+		q.Get("ip"),
+		q.Get("rendition"),
+		q.Get("kid"),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
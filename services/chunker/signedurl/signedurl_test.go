@@ -0,0 +1,134 @@
+package signedurl
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rudyrdx/music-streamer/chunker/totp"
+)
+
+var (
+	oldKey = totp.Secret{Id: "k1", Key: []byte("0123456789abcdef0123456789abcdef")}
+	newKey = totp.Secret{Id: "k2", Key: []byte("fedcba9876543210fedcba9876543210")}
+)
+
+var now = time.Unix(1700000000, 0)
+
+func signed(secret totp.Secret, p Params) url.Values {
+	if p.TrackId == "" {
+		p.TrackId = "track"
+	}
+	if p.Expires.IsZero() {
+		p.Expires = now.Add(time.Hour)
+	}
+	return Sign(secret, p)
+}
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier([]totp.Secret{oldKey})
+
+	q := signed(oldKey, Params{UserId: "user", Rendition: "original"})
+	p, err := v.Verify(q, "10.0.0.1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Params{TrackId: "track", UserId: "user", Expires: now.Add(time.Hour), Rendition: "original"}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if !IsSigned(q) || IsSigned(url.Values{"id": {"track"}}) {
+		t.Fatal("IsSigned can't tell signed urls apart")
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	v := NewVerifier([]totp.Secret{oldKey})
+
+	tests := []struct {
+		name   string
+		change func(q url.Values)
+		err    error
+	}{
+		{"other track", func(q url.Values) { q.Set("id", "other") }, ErrSignature},
+		{"other user", func(q url.Values) { q.Set("uid", "other") }, ErrSignature},
+		{"user dropped", func(q url.Values) { q.Del("uid") }, ErrSignature},
+		{"later expiry", func(q url.Values) { q.Set("exp", "9999999999") }, ErrSignature},
+		{"ip dropped", func(q url.Values) { q.Del("ip") }, ErrSignature},
+		{"other rendition", func(q url.Values) { q.Set("rendition", "other") }, ErrSignature},
+		{"signature changed", func(q url.Values) { q.Set("sig", q.Get("sig")[1:]+"A") }, ErrSignature},
+		{"signature missing", func(q url.Values) { q.Del("sig") }, ErrMalformed},
+		{"id missing", func(q url.Values) { q.Del("id") }, ErrMalformed},
+		{"id twice", func(q url.Values) { q.Add("id", "other") }, ErrMalformed},
+		{"newline smuggled in", func(q url.Values) { q.Set("uid", "user\nother") }, ErrMalformed},
+		{"unknown kid", func(q url.Values) { q.Set("kid", "nope") }, ErrUnknownKey},
+		{"kid of another key", func(q url.Values) { q.Set("kid", newKey.Id) }, ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := signed(oldKey, Params{UserId: "user", IP: "10.0.0.1", Rendition: "original"})
+			tt.change(q)
+			if _, err := v.Verify(q, "10.0.0.1", now); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	v := NewVerifier([]totp.Secret{oldKey})
+	expires := now.Add(time.Minute)
+	q := signed(oldKey, Params{Expires: expires})
+
+	if _, err := v.Verify(q, "", expires); err != nil {
+		t.Fatalf("at the expiry second: %v", err)
+	}
+	if _, err := v.Verify(q, "", expires.Add(time.Second)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("after expiry: got %v, want ErrExpired", err)
+	}
+}
+
+func TestVerifyIP(t *testing.T) {
+	v := NewVerifier([]totp.Secret{oldKey})
+
+	bound := signed(oldKey, Params{IP: "10.0.0.1"})
+	if _, err := v.Verify(bound, "10.0.0.1", now); err != nil {
+		t.Fatalf("from the bound address: %v", err)
+	}
+	if _, err := v.Verify(bound, "10.0.0.2", now); !errors.Is(err, ErrWrongIP) {
+		t.Fatalf("from another address: got %v, want ErrWrongIP", err)
+	}
+
+	unbound := signed(oldKey, Params{})
+	if _, err := v.Verify(unbound, "10.0.0.2", now); err != nil {
+		t.Fatalf("unbound url: %v", err)
+	}
+}
+
+// urls signed with the old key keep working while both are configured
+func TestVerifyKeyRotation(t *testing.T) {
+	before := signed(oldKey, Params{})
+	after := signed(newKey, Params{})
+
+	during := NewVerifier([]totp.Secret{newKey, oldKey})
+	for name, q := range map[string]url.Values{"old key": before, "new key": after} {
+		if _, err := during.Verify(q, "", now); err != nil {
+			t.Errorf("%s during rotation: %v", name, err)
+		}
+	}
+
+	done := NewVerifier([]totp.Secret{newKey})
+	if _, err := done.Verify(before, "", now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old key after rotation: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := done.Verify(after, "", now); err != nil {
+		t.Errorf("new key after rotation: %v", err)
+	}
+
+	// a key id that now names a different key doesn't carry old urls over
+	reused := NewVerifier([]totp.Secret{{Id: oldKey.Id, Key: newKey.Key}})
+	if _, err := reused.Verify(before, "", now); !errors.Is(err, ErrSignature) {
+		t.Errorf("reused key id: got %v, want ErrSignature", err)
+	}
+}
@@ -0,0 +1,119 @@
+package suggest
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/library"
+)
+
+// an album or artist is as popular as the plays of its tracks put together
+
+type popularityRow struct {
+	Id    string  `db:"id"`
+	Name  string  `db:"name"`
+	Plays float64 `db:"plays"`
+}
+
+// Load fills the index from the library, replacing what was in it
+func Load(app core.App, ix *Index) error {
+	var artists, albums, tracks []popularityRow
+
+	err := app.DB().
+		Select("a.id", "a.name", "COALESCE(SUM(t.play_count), 0) AS plays").
+		From("Artists a").
+		LeftJoin("Tracks t", dbx.NewExp("t.artist = a.id")).
+		GroupBy("a.id").
+		All(&artists)
+	if err != nil {
+		return err
+	}
+	err = app.DB().
+		Select("al.id", "al.title AS name", "COALESCE(SUM(t.play_count), 0) AS plays").
+		From("Albums al").
+		LeftJoin("Tracks t", dbx.NewExp("t.album = al.id")).
+		GroupBy("al.id").
+		All(&albums)
+	if err != nil {
+		return err
+	}
+	err = app.DB().
+		Select("id", "title AS name", "play_count AS plays").
+		From("Tracks").
+		All(&tracks)
+	if err != nil {
+		return err
+	}
+
+	ix.Reset()
+	for kind, rows := range map[string][]popularityRow{
+		library.TypeArtist: artists,
+		library.TypeAlbum:  albums,
+		library.TypeTrack:  tracks,
+	} {
+		for _, r := range rows {
+			ix.Put(kind, r.Id, r.Name)
+			ix.AddPopularity(kind, r.Id, r.Plays)
+		}
+	}
+	return nil
+}
+
+// BindHooks keeps the index in step with the library
+func BindHooks(app core.App, ix *Index) {
+	app.OnRecordAfterCreateSuccess("Artists").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeArtist, e.Record.Id, e.Record.GetString("name"))
+		return e.Next()
+	})
+	app.OnRecordAfterUpdateSuccess("Artists").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeArtist, e.Record.Id, e.Record.GetString("name"))
+		return e.Next()
+	})
+	app.OnRecordAfterDeleteSuccess("Artists").BindFunc(func(e *core.RecordEvent) error {
+		ix.Remove(library.TypeArtist, e.Record.Id)
+		return e.Next()
+	})
+
+	app.OnRecordAfterCreateSuccess("Albums").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeAlbum, e.Record.Id, e.Record.GetString("title"))
+		return e.Next()
+	})
+	app.OnRecordAfterUpdateSuccess("Albums").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeAlbum, e.Record.Id, e.Record.GetString("title"))
+		return e.Next()
+	})
+	app.OnRecordAfterDeleteSuccess("Albums").BindFunc(func(e *core.RecordEvent) error {
+		ix.Remove(library.TypeAlbum, e.Record.Id)
+		return e.Next()
+	})
+
+	app.OnRecordAfterCreateSuccess("Tracks").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeTrack, e.Record.Id, e.Record.GetString("title"))
+		addPlays(ix, e.Record, 1)
+		return e.Next()
+	})
+	app.OnRecordAfterUpdateSuccess("Tracks").BindFunc(func(e *core.RecordEvent) error {
+		ix.Put(library.TypeTrack, e.Record.Id, e.Record.GetString("title"))
+		// moving the plays from the old state to the new one covers play
+		// count changes as well as a track moving to another album
+		addPlays(ix, e.Record.Original(), -1)
+		addPlays(ix, e.Record, 1)
+		return e.Next()
+	})
+	app.OnRecordAfterDeleteSuccess("Tracks").BindFunc(func(e *core.RecordEvent) error {
+		addPlays(ix, e.Record, -1)
+		ix.Remove(library.TypeTrack, e.Record.Id)
+		return e.Next()
+	})
+}
+
+func addPlays(ix *Index, track *core.Record, sign float64) {
+	plays := sign * track.GetFloat("play_count")
+	if plays == 0 {
+		return
+	}
+	ix.AddPopularity(library.TypeTrack, track.Id, plays)
+	ix.AddPopularity(library.TypeArtist, track.GetString("artist"), plays)
+	if album := track.GetString("album"); album != "" {
+		ix.AddPopularity(library.TypeAlbum, album, plays)
+	}
+}
@@ -0,0 +1,309 @@
+// Package suggest completes what somebody is typing into artist, album and
+// track names, typos included.
+//
+// every name is folded (lowercase, no diacritics, punctuation as spaces)
+// and its words are put into a trigram index, padded in front so even one
+// or two letters make a trigram. a query looks up candidates sharing enough
+// trigrams with it and scores them with the prefix edit distance:
+// the fewest edits that turn the query into the beginning of one of the
+// candidate's words. a few typos are allowed depending on the query length.
+// ties go to the more popular entry.
+//
+// the index lives in memory and is changed entry by entry, nothing is ever
+// rebuilt as a whole except on startup
+package suggest
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Suggestion struct {
+	Type       string  `json:"type"`
+	Id         string  `json:"id"`
+	Text       string  `json:"text"`
+	Popularity float64 `json:"popularity"`
+	Distance   int     `json:"distance"`
+}
+
+type entry struct {
+	kind       string
+	id         string
+	text       string
+	folded     []rune
+	starts     []int // where each word of folded begins
+	popularity float64
+}
+
+type Index struct {
+	mu      sync.RWMutex
+	entries map[string]*entry
+	grams   map[string]map[string]struct{}
+}
+
+func New() *Index {
+	return &Index{
+		entries: map[string]*entry{},
+		grams:   map[string]map[string]struct{}{},
+	}
+}
+
+func key(kind, id string) string {
+	return kind + ":" + id
+}
+
+// Put adds an entry or renames it, the popularity of an existing entry is kept
+func (ix *Index) Put(kind, id, text string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	k := key(kind, id)
+	popularity := 0.0
+	if old, ok := ix.entries[k]; ok {
+		if old.text == text {
+			return
+		}
+		popularity = old.popularity
+		ix.unlink(k, old)
+	}
+
+	folded := []rune(Fold(text))
+	e := &entry{kind: kind, id: id, text: text, folded: folded, popularity: popularity}
+	for i := range folded {
+		if folded[i] != ' ' && (i == 0 || folded[i-1] == ' ') {
+			e.starts = append(e.starts, i)
+		}
+	}
+	ix.entries[k] = e
+	for _, g := range wordTrigrams(folded) {
+		link(ix.grams, g, k)
+	}
+}
+
+// AddPopularity changes the popularity of an entry by delta
+func (ix *Index) AddPopularity(kind, id string, delta float64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if e, ok := ix.entries[key(kind, id)]; ok {
+		e.popularity += delta
+	}
+}
+
+func (ix *Index) Remove(kind, id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	k := key(kind, id)
+	if e, ok := ix.entries[k]; ok {
+		ix.unlink(k, e)
+		delete(ix.entries, k)
+	}
+}
+
+// Reset empties the index
+func (ix *Index) Reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.entries = map[string]*entry{}
+	ix.grams = map[string]map[string]struct{}{}
+}
+
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.entries)
+}
+
+func (ix *Index) unlink(k string, e *entry) {
+	for _, g := range wordTrigrams(e.folded) {
+		unlinkKey(ix.grams, g, k)
+	}
+}
+
+// Suggest returns up to limit completions of q, best first. scoring stops
+// once budget is used up and whatever was scored by then is returned
+func (ix *Index) Suggest(q string, limit int, budget time.Duration) []Suggestion {
+	deadline := time.Now().Add(budget)
+	query := []rune(Fold(q))
+	if len(query) == 0 || limit <= 0 {
+		return nil
+	}
+	typos := maxTypos(len(query))
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// a typo spoils up to three trigrams of the query, swapping two
+	// letters up to four
+	qgrams := wordTrigrams(query)
+	hits := map[string]int{}
+	for _, g := range qgrams {
+		for k := range ix.grams[g] {
+			hits[k]++
+		}
+	}
+	need := max(1, len(qgrams)-4*typos)
+	var candidates []string
+	for k, n := range hits {
+		if n >= need {
+			candidates = append(candidates, k)
+		}
+	}
+
+	type scored struct {
+		e      *entry
+		dist   int
+		atHead bool
+	}
+	var results []scored
+	for i, k := range candidates {
+		if i%256 == 255 && time.Now().After(deadline) {
+			break
+		}
+		e := ix.entries[k]
+		best, bestStart := typos+1, -1
+		for _, start := range e.starts {
+			if d := prefixDistance(query, e.folded[start:], typos); d < best {
+				best, bestStart = d, start
+			}
+		}
+		if best <= typos {
+			results = append(results, scored{e: e, dist: best, atHead: bestStart == 0})
+		}
+	}
+
+	slices.SortFunc(results, func(a, b scored) int {
+		switch {
+		case a.dist != b.dist:
+			return a.dist - b.dist
+		case a.atHead != b.atHead:
+			if a.atHead {
+				return -1
+			}
+			return 1
+		case a.e.popularity != b.e.popularity:
+			if a.e.popularity > b.e.popularity {
+				return -1
+			}
+			return 1
+		case len(a.e.folded) != len(b.e.folded):
+			return len(a.e.folded) - len(b.e.folded)
+		default:
+			return strings.Compare(a.e.text, b.e.text)
+		}
+	})
+
+	suggestions := make([]Suggestion, 0, min(limit, len(results)))
+	for _, r := range results[:min(limit, len(results))] {
+		suggestions = append(suggestions, Suggestion{
+			Type:       r.e.kind,
+			Id:         r.e.id,
+			Text:       r.e.text,
+			Popularity: r.e.popularity,
+			Distance:   r.dist,
+		})
+	}
+	return suggestions
+}
+
+// wordTrigrams are the trigrams of every word of folded
+func wordTrigrams(folded []rune) []string {
+	var grams []string
+	for _, word := range strings.Fields(string(folded)) {
+		grams = append(grams, trigrams([]rune(word))...)
+	}
+	return grams
+}
+
+func trigrams(word []rune) []string {
+	padded := append([]rune{' ', ' '}, word...)
+	grams := make([]string, 0, len(word))
+	for i := 0; i+3 <= len(padded); i++ {
+		if padded[i+2] == ' ' {
+			continue
+		}
+		grams = append(grams, string(padded[i:i+3]))
+	}
+	return grams
+}
+
+// prefixDistance is the edit distance between q and the closest prefix of
+// text, swapping two neighbouring letters counts as one edit. anything
+// above limit is reported as limit+1
+func prefixDistance(q []rune, text []rune, limit int) int {
+	text = text[:min(len(text), len(q)+limit)]
+	before := make([]int, len(text)+1)
+	prev := make([]int, len(text)+1)
+	cur := make([]int, len(text)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(q); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(text); j++ {
+			cost := 1
+			if q[i-1] == text[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && q[i-1] == text[j-2] && q[i-2] == text[j-1] {
+				cur[j] = min(cur[j], before[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		before, prev, cur = prev, cur, before
+	}
+	return min(slices.Min(prev), limit+1)
+}
+
+func maxTypos(n int) int {
+	switch {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Fold lowercases s, strips diacritics and turns everything that isn't a
+// letter or digit into single spaces
+func Fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(t, s)
+	if err != nil {
+		stripped = s
+	}
+	return strings.Join(strings.FieldsFunc(strings.ToLower(stripped), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+func link(index map[string]map[string]struct{}, gram string, k string) {
+	set, ok := index[gram]
+	if !ok {
+		set = map[string]struct{}{}
+		index[gram] = set
+	}
+	set[k] = struct{}{}
+}
+
+func unlinkKey(index map[string]map[string]struct{}, gram string, k string) {
+	if set, ok := index[gram]; ok {
+		delete(set, k)
+		if len(set) == 0 {
+			delete(index, gram)
+		}
+	}
+}
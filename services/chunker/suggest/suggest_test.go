@@ -0,0 +1,173 @@
+package suggest
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func testIndex() *Index {
+	ix := New()
+	for id, text := range map[string]string{
+		"radiohead":  "Radiohead",
+		"portishead": "Portishead",
+		"bjork":      "Björk",
+		"metallica":  "Metallica",
+		"beck":       "Beck",
+		"low":        "Low",
+		"bloc":       "Bloc Party",
+	} {
+		ix.Put("artist", id, text)
+	}
+	return ix
+}
+
+func suggestIds(ix *Index, q string) []string {
+	var ids []string
+	for _, s := range ix.Suggest(q, 10, time.Second) {
+		ids = append(ids, s.Id)
+	}
+	return ids
+}
+
+func TestSuggestTypos(t *testing.T) {
+	ix := testIndex()
+	tests := []struct {
+		q    string
+		want string
+		dist int
+	}{
+		{"radiohead", "radiohead", 0},
+		{"Björk", "bjork", 0},
+		{"bjork", "bjork", 0},
+		// one substitution, insertion, deletion and swap each
+		{"radiohaed", "radiohead", 1},
+		{"bjrok", "bjork", 1},
+		{"metalica", "metallica", 1},
+		{"portisshead", "portishead", 1},
+		{"radiphead", "radiohead", 1},
+		{"metlali", "metallica", 1},
+		{"bjorj", "bjork", 1},
+		// a typo in what is typed so far
+		{"metsl", "metallica", 1},
+		{"partt", "bloc", 1},
+		// long queries get two
+		{"metallicca x", "", 0},
+		{"rdaiohaed", "radiohead", 2},
+	}
+	for _, tt := range tests {
+		got := ix.Suggest(tt.q, 10, time.Second)
+		if tt.want == "" {
+			if len(got) != 0 {
+				t.Errorf("%q: got %+v, want nothing", tt.q, got)
+			}
+			continue
+		}
+		if len(got) == 0 || got[0].Id != tt.want || got[0].Distance != tt.dist {
+			t.Errorf("%q: got %+v, want %s at distance %d first", tt.q, got, tt.want, tt.dist)
+		}
+	}
+}
+
+// up to three letters have to be typed right, four to seven may have one
+// typo
+func TestSuggestShortQueries(t *testing.T) {
+	ix := testIndex()
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"b", []string{"beck", "bjork", "bloc"}},
+		{"be", []string{"beck"}},
+		{"bj", []string{"bjork"}},
+		{"lo", []string{"low"}},
+		{"lpw", nil},
+		{"bek", nil},
+		{"bekc", []string{"beck"}},
+		{"bjrk", []string{"bjork"}},
+		{"brjk", nil},
+		{"", nil},
+		{"  !", nil},
+	}
+	for _, tt := range tests {
+		got := suggestIds(ix, tt.q)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestRanking(t *testing.T) {
+	ix := New()
+	ix.Put("track", "song", "Love Song")
+	ix.Put("track", "me", "Love Me")
+	ix.Put("track", "will", "Love Will Tear Us Apart")
+	ix.Put("track", "lover", "Lover")
+	ix.Put("track", "glove", "Glove Love")
+
+	// same distance and all at the head, the shortest goes first without
+	// any popularity
+	if got, want := suggestIds(ix, "love"), []string{"lover", "me", "song", "will", "glove"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	ix.AddPopularity("track", "will", 3)
+	ix.AddPopularity("track", "song", 1)
+	ix.AddPopularity("track", "glove", 10)
+	// popularity breaks the tie, a match further in the name still comes
+	// after the ones at the head
+	if got, want := suggestIds(ix, "love"), []string{"will", "song", "lover", "me", "glove"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// a closer match beats popularity
+	if got := suggestIds(ix, "love s"); len(got) == 0 || got[0] != "song" {
+		t.Fatalf("got %v, want song first", got)
+	}
+
+	// renaming keeps the popularity
+	ix.Put("track", "song", "Love Songs")
+	if got := ix.Suggest("love", 1, time.Second); len(got) != 1 || got[0].Id != "will" {
+		t.Fatalf("got %+v, want will", got)
+	}
+	if got := ix.Suggest("love songs", 1, time.Second); len(got) != 1 || got[0].Popularity != 1 {
+		t.Fatalf("got %+v, want the popularity kept", got)
+	}
+}
+
+func TestPrefixDistance(t *testing.T) {
+	tests := []struct {
+		q, text string
+		limit   int
+		want    int
+	}{
+		{"rad", "radiohead", 1, 0},
+		{"rda", "radiohead", 1, 1},
+		{"rxd", "radiohead", 1, 1},
+		{"rxx", "radiohead", 1, 2},
+		{"radio", "rad", 2, 2},
+		{"radio", "rad", 1, 2},
+		{"", "anything", 0, 0},
+	}
+	for _, tt := range tests {
+		if got := prefixDistance([]rune(tt.q), []rune(tt.text), tt.limit); got != tt.want {
+			t.Errorf("prefixDistance(%q, %q, %d) = %d, want %d", tt.q, tt.text, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := map[string]string{
+		"Björk":                  "bjork",
+		"  Sigur Rós!! ":         "sigur ros",
+		"AC/DC":                  "ac dc",
+		"Motörhead — Ace of ♠":   "motorhead ace of",
+		"Beyoncé & Jay-Z (Live)": "beyonce jay z live",
+	}
+	for in, want := range tests {
+		if got := Fold(in); got != want {
+			t.Errorf("Fold(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
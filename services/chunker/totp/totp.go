@@ -0,0 +1,172 @@
+// Package totp mints and checks the single use tokens the frontend puts on
+// every request it makes to the streamer.
+//
+// a token is "<kid>.<nonce>.<code>". the code is an HOTP (RFC 4226) style
+// truncation of HMAC-SHA256 over the current time step and the nonce, keyed
+// with the shared secret named by kid. the nonce lets the frontend mint any
+// number of distinct tokens within one time step, and the verifier remembers
+// every token it accepted for as long as it would stay valid so none of them
+// can be replayed.
+//
+// secrets are rotated by adding a new kid: the frontend mints with the new
+// secret while the streamer still accepts both, then the old one is dropped.
+//
+// the frontend only needs this package:
+//
+//	secrets, _ := totp.ParseSecrets(os.Getenv("CHUNKER_TOTP_SECRETS"))
+//	token, _ := totp.Generate(secrets[0], time.Now(), totp.DefaultStep)
+//	req.Header.Set(totp.Header, token)
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// Header carries the token
+	Header      = "X-Stream-Token"
+	DefaultStep = 30 * time.Second
+
+	digits    = 8
+	nonceSize = 12
+)
+
+var (
+	ErrMalformed   = errors.New("malformed token")
+	ErrUnknownKey  = errors.New("unknown key id")
+	ErrInvalidCode = errors.New("invalid or expired code")
+	ErrReplayed    = errors.New("token already used")
+)
+
+type Secret struct {
+	Id  string
+	Key []byte
+}
+
+// ParseSecrets reads "kid:base64key,kid:base64key", the first secret is the
+// one tokens should be minted with
+func ParseSecrets(value string) ([]Secret, error) {
+	var secrets []Secret
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("secret %q: expected kid:base64key", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", id, err)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("secret %q: key must be at least 16 bytes", id)
+		}
+		secrets = append(secrets, Secret{Id: id, Key: key})
+	}
+	return secrets, nil
+}
+
+// Generate mints a fresh token for the time step holding now
+func Generate(secret Secret, now time.Time, step time.Duration) (string, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+	return secret.Id + "." + encodedNonce + "." + code(secret.Key, counter(now, step), nonce), nil
+}
+
+type Verifier struct {
+	secrets map[string][]byte
+	step    time.Duration
+	skew    int
+
+	used *cache.Cache
+}
+
+// NewVerifier accepts codes up to skew steps before or after the current one
+func NewVerifier(secrets []Secret, step time.Duration, skew int) *Verifier {
+	keys := make(map[string][]byte, len(secrets))
+	for _, s := range secrets {
+		keys[s.Id] = s.Key
+	}
+	if step <= 0 {
+		step = DefaultStep
+	}
+	if skew < 0 {
+		skew = 0
+	}
+	// a token can't verify anymore once it is older than this
+	lifetime := time.Duration(2*skew+1) * step
+	return &Verifier{
+		secrets: keys,
+		step:    step,
+		skew:    skew,
+		used:    cache.New(lifetime, lifetime),
+	}
+}
+
+// Verify checks token against now and burns it, a second call with the
+// same token fails with ErrReplayed
+func (v *Verifier) Verify(token string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(parts[2]) != digits {
+		return ErrMalformed
+	}
+	key, ok := v.secrets[parts[0]]
+	if !ok {
+		return ErrUnknownKey
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(nonce) != nonceSize {
+		return ErrMalformed
+	}
+
+	current := counter(now, v.step)
+	valid := false
+	for d := -v.skew; d <= v.skew; d++ {
+		if hmac.Equal([]byte(code(key, current+uint64(d), nonce)), []byte(parts[2])) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidCode
+	}
+
+	// Add fails when the token is already there, that is the replay check
+	if err := v.used.Add(token, struct{}{}, cache.DefaultExpiration); err != nil {
+		return ErrReplayed
+	}
+	return nil
+}
+
+func counter(t time.Time, step time.Duration) uint64 {
+	return uint64(t.UnixNano() / int64(step))
+}
+
+// code is the RFC 4226 dynamic truncation of HMAC-SHA256(key, counter|nonce)
+func code(key []byte, counter uint64, nonce []byte) string {
+	msg := make([]byte, 8, 8+len(nonce))
+	binary.BigEndian.PutUint64(msg, counter)
+	msg = append(msg, nonce...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%100000000)
+}
@@ -0,0 +1,172 @@
+package totp
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oldSecret = Secret{Id: "k1", Key: []byte("0123456789abcdef0123456789abcdef")}
+	newSecret = Secret{Id: "k2", Key: []byte("fedcba9876543210fedcba9876543210")}
+)
+
+const step = 30 * time.Second
+
+// the start of a time step, so the edges are easy to name
+var stepStart = time.Unix(1700000010, 0).Truncate(step)
+
+func mint(t *testing.T, secret Secret, at time.Time) string {
+	t.Helper()
+	token, err := Generate(secret, at, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier([]Secret{oldSecret}, step, 1)
+
+	a, b := mint(t, oldSecret, stepStart), mint(t, oldSecret, stepStart)
+	if a == b {
+		t.Fatal("two tokens of the same step are equal, the nonce is missing")
+	}
+	for _, token := range []string{a, b} {
+		if err := v.Verify(token, stepStart); err != nil {
+			t.Fatalf("fresh token: %v", err)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier([]Secret{oldSecret}, step, 1)
+	token := mint(t, oldSecret, stepStart)
+
+	if err := v.Verify(token, stepStart); err != nil {
+		t.Fatal(err)
+	}
+	// the same step and the next one, the token is still valid by its code
+	for _, at := range []time.Time{stepStart, stepStart.Add(step)} {
+		if err := v.Verify(token, at); !errors.Is(err, ErrReplayed) {
+			t.Fatalf("replay at %v: got %v, want ErrReplayed", at.Sub(stepStart), err)
+		}
+	}
+	// a failed check doesn't burn a token
+	other := mint(t, oldSecret, stepStart)
+	if err := v.Verify(other, stepStart.Add(10*step)); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("got %v, want ErrInvalidCode", err)
+	}
+	if err := v.Verify(other, stepStart); err != nil {
+		t.Fatalf("token refused after a failed check: %v", err)
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	tests := []struct {
+		name string
+		skew int
+		// when the token was minted, relative to the verifier's clock
+		minted time.Duration
+		err    error
+	}{
+		{"same step", 1, 0, nil},
+		{"last instant of the step", 1, step - time.Nanosecond, nil},
+		{"one step behind", 1, -step, nil},
+		{"one step ahead", 1, step, nil},
+		{"first instant two steps behind", 1, -2 * step, ErrInvalidCode},
+		{"last instant two steps behind", 1, -step - time.Nanosecond, ErrInvalidCode},
+		{"two steps ahead", 1, 2 * step, ErrInvalidCode},
+		{"no skew, same step", 0, step - time.Nanosecond, nil},
+		{"no skew, previous step", 0, -time.Nanosecond, ErrInvalidCode},
+		{"no skew, next step", 0, step, ErrInvalidCode},
+		{"wider skew", 3, -3 * step, nil},
+		{"past the wider skew", 3, 4 * step, ErrInvalidCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier([]Secret{oldSecret}, step, tt.skew)
+			token := mint(t, oldSecret, stepStart.Add(tt.minted))
+			if err := v.Verify(token, stepStart); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	during := NewVerifier([]Secret{newSecret, oldSecret}, step, 1)
+	for _, secret := range []Secret{oldSecret, newSecret} {
+		if err := during.Verify(mint(t, secret, stepStart), stepStart); err != nil {
+			t.Fatalf("%s during rotation: %v", secret.Id, err)
+		}
+	}
+
+	done := NewVerifier([]Secret{newSecret}, step, 1)
+	if err := done.Verify(mint(t, oldSecret, stepStart), stepStart); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("old key after rotation: got %v, want ErrUnknownKey", err)
+	}
+
+	// a code made with one key doesn't pass under the id of another
+	token := mint(t, oldSecret, stepStart)
+	forged := newSecret.Id + strings.TrimPrefix(token, oldSecret.Id)
+	if err := during.Verify(forged, stepStart); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("code under another key id: got %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	v := NewVerifier([]Secret{oldSecret}, step, 1)
+	token := mint(t, oldSecret, stepStart)
+	parts := strings.Split(token, ".")
+	shortNonce := base64.RawURLEncoding.EncodeToString([]byte("short"))
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"empty", "", ErrMalformed},
+		{"no dots", "k1", ErrMalformed},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformed},
+		{"four parts", token + ".x", ErrMalformed},
+		{"short code", parts[0] + "." + parts[1] + "." + parts[2][:digits-1], ErrMalformed},
+		{"long code", token + "0", ErrMalformed},
+		{"nonce not base64", parts[0] + ".!!!!." + parts[2], ErrMalformed},
+		{"short nonce", parts[0] + "." + shortNonce + "." + parts[2], ErrMalformed},
+		{"unknown kid", "nope." + parts[1] + "." + parts[2], ErrUnknownKey},
+		{"wrong code", parts[0] + "." + parts[1] + ".00000000", ErrInvalidCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Verify(tt.token, stepStart); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(oldSecret.Key)
+	secrets, err := ParseSecrets(" k2:" + base64.StdEncoding.EncodeToString(newSecret.Key) + ", k1:" + key + ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets[0].Id != "k2" || secrets[1].Id != "k1" || string(secrets[1].Key) != string(oldSecret.Key) {
+		t.Fatalf("got %+v", secrets)
+	}
+
+	for _, value := range []string{
+		"k1",
+		":" + key,
+		"k.1:" + key,
+		"k1:not base64",
+		"k1:" + base64.StdEncoding.EncodeToString([]byte("too short")),
+	} {
+		if _, err := ParseSecrets(value); err == nil {
+			t.Errorf("ParseSecrets(%q) accepted it", value)
+		}
+	}
+}
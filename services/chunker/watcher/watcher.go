@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/rudyrdx/music-streamer/chunker/access"
+	"github.com/rudyrdx/music-streamer/chunker/config"
+	"github.com/rudyrdx/music-streamer/chunker/ingest"
+)
+
+// the watcher polls the configured drop folders and ingests audio files
+// once they stopped changing for the settle time. what was picked up is
+// kept in WatchedFiles so restarts don't import the same files again
+
+type fileState struct {
+	size    int64
+	modTime int64 // unix ms
+}
+
+type pendingFile struct {
+	state       fileState
+	stableSince time.Time
+}
+
+type Watcher struct {
+	app     core.App
+	cfg     *config.Config
+	done    map[string]fileState
+	pending map[string]*pendingFile
+}
+
+func New(app core.App, cfg *config.Config) *Watcher {
+	return &Watcher{
+		app:     app,
+		cfg:     cfg,
+		done:    map[string]fileState{},
+		pending: map[string]*pendingFile{},
+	}
+}
+
+func (w *Watcher) Run(ctx context.Context) {
+	if !access.IsVisibility(w.cfg.WatchVisibility) {
+		w.app.Logger().Error("Watcher", "message", "Invalid watch visibility, not watching", "visibility", w.cfg.WatchVisibility)
+		return
+	}
+	if w.cfg.WatchOwner != "" {
+		if _, err := w.app.FindRecordById("users", w.cfg.WatchOwner); err != nil {
+			w.app.Logger().Error("Watcher", "message", "Unknown watch owner, not watching", "owner", w.cfg.WatchOwner, "error", err)
+			return
+		}
+	}
+	if err := w.load(); err != nil {
+		w.app.Logger().Error("Watcher", "message", "Failed to load watched files", "error", err)
+	}
+
+	ticker := time.NewTicker(w.cfg.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		w.poll(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) load() error {
+	records, err := w.app.FindAllRecords("WatchedFiles")
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		w.done[r.GetString("path")] = fileState{
+			size:    int64(r.GetFloat("size")),
+			modTime: int64(r.GetFloat("mod_time")),
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) poll(now time.Time) {
+	seen := map[string]bool{}
+
+	for _, dir := range w.cfg.WatchDirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				w.app.Logger().Warn("Watcher", "message", "Failed to read path", "path", path, "error", err)
+				return nil
+			}
+			if d.IsDir() || !ingest.IsAudioFile(path) {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if path, err = filepath.Abs(path); err != nil {
+				return nil
+			}
+			state := fileState{size: info.Size(), modTime: info.ModTime().UnixMilli()}
+			seen[path] = true
+
+			previous, wasDone := w.done[path]
+			if wasDone && previous == state {
+				return nil
+			}
+
+			// the settle clock restarts every time the file changes
+			p, ok := w.pending[path]
+			if !ok || p.state != state {
+				w.pending[path] = &pendingFile{state: state, stableSince: now}
+				return nil
+			}
+			if now.Sub(p.stableSince) < w.cfg.WatchSettle {
+				return nil
+			}
+
+			delete(w.pending, path)
+			w.ingest(path, state, wasDone)
+			return nil
+		})
+	}
+
+	for path := range w.pending {
+		if !seen[path] {
+			delete(w.pending, path)
+		}
+	}
+}
+
+func (w *Watcher) ingest(path string, state fileState, changed bool) {
+	result, err := ingest.ImportFile(w.app, path, ingest.Options{
+		Copy:       w.cfg.WatchCopy,
+		DestDir:    w.cfg.UploadDir,
+		Owner:      w.cfg.WatchOwner,
+		Visibility: w.cfg.WatchVisibility,
+		Reimport:   changed,
+	})
+	if err != nil {
+		w.app.Logger().Warn("Watcher", "message", "Failed to ingest file", "path", path, "error", err)
+	} else {
+		w.app.Logger().Info("Watcher", "message", "File ingested", "path", path, "id", result.Id, "status", result.Status)
+	}
+
+	// failures are remembered too, the file is retried once it changes
+	if rErr := w.remember(path, state, result, err); rErr != nil {
+		w.app.Logger().Error("Watcher", "message", "Failed to save watched file", "path", path, "error", rErr)
+		return
+	}
+	w.done[path] = state
+}
+
+func (w *Watcher) remember(path string, state fileState, result ingest.Result, ingestErr error) error {
+	record, err := w.app.FindFirstRecordByData("WatchedFiles", "path", path)
+	if err != nil {
+		collection, err := w.app.FindCollectionByNameOrId("WatchedFiles")
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("path", path)
+	}
+
+	record.Set("size", state.size)
+	record.Set("mod_time", state.modTime)
+	record.Set("file", result.Id)
+	if ingestErr != nil {
+		record.Set("error", ingestErr.Error())
+	} else {
+		record.Set("error", "")
+	}
+	return w.app.Save(record)
+}